@@ -1,16 +1,24 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/conwayste/registrar/geo"
 	"github.com/conwayste/registrar/monitor"
+	"github.com/conwayste/registrar/version"
 
 	"github.com/didip/tollbooth"
 	"github.com/didip/tollbooth/limiter"
@@ -19,11 +27,16 @@ import (
 	"go.uber.org/zap"
 )
 
-const maxAddServerBodySize = 1000 // Consider increasing if we add more fields to the /addServer request body
+const maxAddServerBodySize = 4000 // Consider increasing if we add more fields to the /addServer request body
+const maxAddServerWait = 10 * time.Second
 const maxResponseSnippetLen = 150 // Increase/decrease depending on log volume
 const maxServerAddsPerSecPerIp = 10
 const maxServerListsPerSecPerIp = 30
 
+// ClientVersionHeader may be sent with GET /servers to list only the servers compatible with the client.
+// The client_version query parameter takes precedence over it.
+const ClientVersionHeader = "X-Conwayste-Client-Version"
+
 type RouteHandler func(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error
 
 func AddRoutes(router *mux.Router, m *monitor.Monitor, log *zap.Logger, useProxyHeaders bool) {
@@ -46,11 +59,47 @@ func AddRoutes(router *mux.Router, m *monitor.Monitor, log *zap.Logger, useProxy
 			WithMonitorAndLog(m, log, listServers),
 		),
 	).ServeHTTP)
+	router.HandleFunc("/servers/{addr}/history", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(listLimiter,
+			WithMonitorAndLog(m, log, serverHistory),
+		),
+	).ServeHTTP)
+	router.HandleFunc("/servers/{addr}/rooms", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(listLimiter,
+			WithMonitorAndLog(m, log, serverRooms),
+		),
+	).ServeHTTP)
+	// Diagnosis may probe the server, so it is limited like the endpoints that add servers
+	router.HandleFunc("/servers/{addr}/diagnosis", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(addLimiter,
+			WithMonitorAndLog(m, log, serverDiagnosis),
+		),
+	).ServeHTTP)
+	router.HandleFunc("/stats", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(listLimiter,
+			WithMonitorAndLog(m, log, stats),
+		),
+	).ServeHTTP)
 	router.HandleFunc("/addServer", maybeProxyHeaders(
 		tollbooth.LimitFuncHandler(addLimiter,
 			WithMonitorAndLog(m, log, addServer),
 		),
 	).ServeHTTP)
+	router.HandleFunc("/dnsVerification", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(listLimiter,
+			WithMonitorAndLog(m, log, dnsVerification),
+		),
+	).ServeHTTP)
+	router.HandleFunc("/renewLease", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(addLimiter,
+			WithMonitorAndLog(m, log, renewLease),
+		),
+	).ServeHTTP)
+	router.HandleFunc("/removeServer", maybeProxyHeaders(
+		tollbooth.LimitFuncHandler(addLimiter,
+			WithMonitorAndLog(m, log, removeServer),
+		),
+	).ServeHTTP)
 }
 
 //////////////////// MIDDLEWARE /////////////////////////////////
@@ -88,12 +137,57 @@ func WithMonitorAndLog(m *monitor.Monitor, log *zap.Logger, h RouteHandler) http
 				log.Info("API issue", zap.String("issue", apiErr.Err.Error()))
 			}
 			w.Header().Add("content-type", "application/json")
+			if apiErr.RetryAfter > 0 {
+				// Round up, so that retrying right after never fails
+				w.Header().Set("Retry-After", strconv.Itoa(int((apiErr.RetryAfter+time.Second-1)/time.Second)))
+			}
 			w.WriteHeader(apiErr.ResponseCode)
 			w.Write(bodyBytes)
 		}
 	}
 }
 
+// RequireBearerToken only calls h if the request has an "Authorization: Bearer <token>" header with the
+// given token. It is for admin endpoints.
+func RequireBearerToken(token string, log *zap.Logger, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer := BearerToken(r)
+		if token == "" || bearer == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			log.Info("API issue", zap.String("issue", "bad or missing bearer token"), zap.String("path", r.URL.Path))
+			w.Header().Add("content-type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "unauthorized"}`))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// BearerToken returns the token in the Authorization header, or "" if there isn't one.
+func BearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return auth[len(prefix):]
+}
+
+// AuthenticateOperator returns the operator whose API key was sent as the bearer token, or nil if none was
+// sent.
+func AuthenticateOperator(r *http.Request, m *monitor.Monitor) (*monitor.Operator, error) {
+	apiKey := BearerToken(r)
+	if apiKey == "" {
+		return nil, nil
+	}
+	if m.Operators != nil {
+		if operator, ok := m.Operators.Authenticate(apiKey); ok {
+			return operator, nil
+		}
+	}
+	return nil, NewApiError(http.StatusUnauthorized, "unknown API key", nil)
+}
+
 //////////////////// ROUTES /////////////////////////////////
 
 func listServers(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
@@ -103,6 +197,37 @@ func listServers(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log
 	}
 	serverList := m.ListServers(false)
 
+	if near := r.URL.Query().Get("near"); near != "" {
+		origin, ok, err := parseNear(near, m)
+		if err != nil {
+			return err
+		}
+		if ok {
+			sortByDistance(origin, serverList)
+		}
+	}
+	switch sortBy := r.URL.Query().Get("sort"); sortBy {
+	case "":
+	case "reliability":
+		sortByReliability(serverList)
+	default:
+		return NewApiError(http.StatusBadRequest, "sort must be reliability", nil)
+	}
+	if tags := r.URL.Query()["tag"]; len(tags) > 0 {
+		serverList = filterByTags(serverList, tags)
+	}
+	clientVersion := r.Header.Get(ClientVersionHeader)
+	if v := r.URL.Query().Get("client_version"); v != "" {
+		clientVersion = v
+	}
+	if clientVersion != "" {
+		client, err := version.Parse(clientVersion)
+		if err != nil {
+			return NewApiError(http.StatusBadRequest, err.Error(), nil)
+		}
+		serverList = filterCompatible(serverList, client, m.Compatibility)
+	}
+
 	// TODO: paging
 	var truncatedResults bool
 	if len(serverList) > 200 {
@@ -123,6 +248,210 @@ func listServers(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log
 	return nil
 }
 
+// parseResolution parses the resolution query parameter, which is "minute" (the default) or "hour".
+func parseResolution(r *http.Request) (monitor.Resolution, error) {
+	switch r.URL.Query().Get("resolution") {
+	case "", "minute":
+		return monitor.Minutely, nil
+	case "hour":
+		return monitor.Hourly, nil
+	}
+	return 0, NewApiError(http.StatusBadRequest, "resolution must be minute or hour", nil)
+}
+
+// serverHistory returns the uptime, player count, and ping history of one server.
+func serverHistory(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodGet {
+		return NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	res, err := parseResolution(r)
+	if err != nil {
+		return err
+	}
+	history, err := m.History(mux.Vars(r)["addr"], res)
+	if errors.Is(err, monitor.ErrNoHistory) {
+		return NewApiError(http.StatusNotFound, err.Error(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	responseBody, err := json.Marshal(history)
+	if err != nil {
+		// Probably unreachable
+		return err
+	}
+	successResponseBytes(w, responseBody)
+	return nil
+}
+
+// serverRooms returns the latest room list of one server.
+func serverRooms(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodGet {
+		return NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	rooms, err := m.RoomList(mux.Vars(r)["addr"])
+	if errors.Is(err, monitor.ErrNoRooms) {
+		return NewApiError(http.StatusNotFound, err.Error(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	responseBody, err := json.Marshal(rooms)
+	if err != nil {
+		// Probably unreachable
+		return err
+	}
+	successResponseBytes(w, responseBody)
+	return nil
+}
+
+// serverDiagnosis explains why a registered server isn't listed. GET serves what the registrar has seen of
+// the server while pinging it; POST also resolves and probes it, and requires a lease of the server in the
+// request body or its operator's API key, so that the registrar can't be used to send packets anywhere.
+func serverDiagnosis(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	serverAddr := mux.Vars(r)["addr"]
+	var diagnosis *monitor.Diagnosis
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		diagnosis, err = m.Diagnosis(serverAddr)
+	case http.MethodPost:
+		operator, authErr := AuthenticateOperator(r, m)
+		if authErr != nil {
+			return authErr
+		}
+		var reqBody LeaseRequestBody
+		if operator == nil {
+			if err := readJSONBody(r, &reqBody); err != nil {
+				return err
+			}
+		}
+		err = m.CheckHolder(serverAddr, reqBody.LeaseID, reqBody.LeaseSecret, operator)
+		if err == nil {
+			diagnosis, err = m.Diagnose(r.Context(), serverAddr)
+		}
+	default:
+		return NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	if errors.Is(err, monitor.ErrUnknownLease) || errors.Is(err, monitor.ErrWrongLeaseSecret) ||
+		errors.Is(err, monitor.ErrNotHolder) {
+		return NewApiErrorFromLeaseError(err)
+	}
+	if errors.Is(err, monitor.ErrNotRegistered) {
+		return NewApiError(http.StatusNotFound, err.Error(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	responseBody, err := json.Marshal(diagnosis)
+	if err != nil {
+		// Probably unreachable
+		return err
+	}
+	successResponseBytes(w, responseBody)
+	return nil
+}
+
+type StatsResponseBody struct {
+	Servers   int `json:"servers"` // registered servers, including those that are down
+	ServersUp int `json:"servers_up"`
+	Players   int `json:"players"`
+	Rooms     int `json:"rooms"`
+	// States counts the registered servers in each state
+	States  map[monitor.ServerState]int `json:"states"`
+	History []monitor.AggregatePoint    `json:"history"`
+}
+
+// stats returns the current totals of all servers, and their history.
+func stats(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodGet {
+		return NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	res, err := parseResolution(r)
+	if err != nil {
+		return err
+	}
+	body := StatsResponseBody{
+		Servers: len(m.ListServers(true)),
+		States:  m.StateCounts(),
+		History: m.AggregateHistory(res),
+	}
+	for _, s := range m.ListServers(false) {
+		body.ServersUp++
+		body.Players += s.Players
+		body.Rooms += s.Rooms
+	}
+	responseBody, err := json.Marshal(body)
+	if err != nil {
+		// Probably unreachable
+		return err
+	}
+	successResponseBytes(w, responseBody)
+	return nil
+}
+
+// filterCompatible returns the servers that a client can connect to.
+func filterCompatible(servers []*monitor.PublicServerInfo, client version.Version, mx *version.Matrix) []*monitor.PublicServerInfo {
+	filtered := []*monitor.PublicServerInfo{}
+	for _, s := range servers {
+		if mx.Compatible(client, s.Version) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// filterByTags returns the servers that have all of the tags.
+func filterByTags(servers []*monitor.PublicServerInfo, tags []string) []*monitor.PublicServerInfo {
+	filtered := []*monitor.PublicServerInfo{}
+	for _, s := range servers {
+		hasAll := true
+		for _, tag := range tags {
+			if !s.HasTag(tag) {
+				hasAll = false
+				break
+			}
+		}
+		if hasAll {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// parseNear parses the near query parameter, which is either an IP or a region name. It returns false if
+// the location of the IP is unknown.
+func parseNear(near string, m *monitor.Monitor) (geo.Location, bool, error) {
+	if ip := net.ParseIP(near); ip != nil {
+		if m.Locator == nil {
+			return geo.Location{}, false, nil
+		}
+		loc, ok := m.Locator.Locate(ip)
+		return loc, ok, nil
+	}
+	loc, ok := geo.RegionLocation(near)
+	if !ok {
+		return geo.Location{}, false, NewApiError(http.StatusBadRequest, "near must be an IP address or a known region", nil)
+	}
+	return loc, true, nil
+}
+
+// sortByReliability sorts the most reliable servers first. It is stable, so it can be combined with near.
+func sortByReliability(servers []*monitor.PublicServerInfo) {
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].Reliability > servers[j].Reliability })
+}
+
+func sortByDistance(origin geo.Location, servers []*monitor.PublicServerInfo) {
+	geo.SortByDistance(origin, len(servers),
+		func(i int) geo.Location {
+			if servers[i].Location != nil {
+				return *servers[i].Location
+			}
+			return geo.Location{Region: servers[i].Region, Country: servers[i].Country}
+		},
+		func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+}
+
 var hostAndPortRE = regexp.MustCompile(`^[^:]+:[1-9]\d*$`)
 
 func validHostAndPort(hostAndPort string) bool {
@@ -152,8 +481,33 @@ func addServer(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *
 	if !validHostAndPort(serverAddr) {
 		return NewApiError(http.StatusBadRequest, "Invalid host_and_port format; expected host, then colon, then port", nil)
 	}
+	wait, err := parseWait(r)
+	if err != nil {
+		return err
+	}
 
-	if err := m.AddServer(serverAddr); err != nil {
+	operator, err := AuthenticateOperator(r, m)
+	if err != nil {
+		return err
+	}
+
+	reg := &monitor.Registration{
+		Addr:        serverAddr,
+		Metadata:    reqBody.ServerMetadata,
+		Operator:    operator,
+		CallerIP:    callerIP(r),
+		LeaseID:     reqBody.LeaseID,
+		LeaseSecret: reqBody.LeaseSecret,
+	}
+	respBody := AddServerResponseBody{Added: true}
+	lease, err := m.Register(reg)
+	switch {
+	case errors.Is(err, monitor.ErrAlreadyRegistered):
+		// The server stays registered by whoever registered it first
+		respBody.AlreadyRegistered = true
+	case errors.Is(err, monitor.ErrUnknownLease), errors.Is(err, monitor.ErrWrongLeaseSecret):
+		return NewApiErrorFromLeaseError(err)
+	case err != nil:
 		// TODO: add stats counter increment
 
 		var serverAddErr monitor.ServerAddError
@@ -162,15 +516,169 @@ func addServer(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *
 		}
 
 		return NewApiError(http.StatusBadRequest, "unknown server error; check the logs", err)
+	default:
+		respBody.Verified = operator != nil || reg.DNSVerified
+		respBody.LeaseID = lease.ID
+		respBody.LeaseSecret = lease.Secret
+		respBody.LeaseTTL = int(m.LeaseTTL / time.Second)
+	}
+	if wait > 0 && !respBody.AlreadyRegistered {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		respBody.Status, err = m.ProbeNow(ctx, log, serverAddr)
+		if err != nil {
+			respBody.ProbeError = err.Error()
+		}
+	}
+	responseBody, err := json.Marshal(respBody)
+	if err != nil {
+		// Probably unreachable
+		return err
+	}
+	successResponseBytes(w, responseBody)
+	return nil
+}
+
+// parseWait parses the optional wait parameter of /addServer; 0 means don't wait.
+func parseWait(r *http.Request) (time.Duration, error) {
+	waitStr := r.URL.Query().Get("wait")
+	if waitStr == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(waitStr)
+	if err != nil || wait <= 0 || wait > maxAddServerWait {
+		return 0, NewApiError(http.StatusBadRequest,
+			fmt.Sprintf("wait must be a duration such as 3s, up to %v", maxAddServerWait), nil)
+	}
+	return wait, nil
+}
+
+// callerIP returns the IP that sent the request, or nil if it can't be parsed. With proxy headers, the
+// RemoteAddr has already been replaced by the client's IP.
+func callerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr // ProxyHeaders sets it without a port
+	}
+	return net.ParseIP(host)
+}
+
+type AddServerResponseBody struct {
+	Added    bool `json:"added"`
+	Verified bool `json:"verified,omitempty"`
+	// AlreadyRegistered is set if the server is registered by someone else, who holds its lease; the
+	// registration is left as it is, and no lease is granted
+	AlreadyRegistered bool `json:"already_registered,omitempty"`
+	// The lease must be renewed at /renewLease within LeaseTTL seconds, or the server will be delisted
+	LeaseID     string `json:"lease_id,omitempty"`
+	LeaseSecret string `json:"lease_secret,omitempty"`
+	LeaseTTL    int    `json:"lease_ttl,omitempty"`
+	// Status is the server's reply to a GetStatus sent right away, if the request asked to wait for it;
+	// ProbeError is set instead if the server didn't reply in time, or its reply couldn't be decoded
+	Status     *monitor.ProbeReply `json:"status,omitempty"`
+	ProbeError string              `json:"probe_error,omitempty"`
+}
+
+type DNSVerificationResponseBody struct {
+	Record string `json:"record"` // name of the TXT record
+	Value  string `json:"value"`
+}
+
+// dnsVerification returns the TXT record that verifies the host name given by the host query parameter.
+func dnsVerification(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodGet {
+		return NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	if m.DNSVerifier == nil {
+		return NewApiError(http.StatusNotFound, "DNS verification is not enabled on this registrar", nil)
+	}
+	host := r.URL.Query().Get("host")
+	if host == "" || strings.Contains(host, ":") || net.ParseIP(host) != nil {
+		return NewApiError(http.StatusBadRequest, "host must be a host name, without a port", nil)
+	}
+	responseBody, err := json.Marshal(DNSVerificationResponseBody{
+		Record: monitor.DNSVerificationRecord(host),
+		Value:  m.DNSVerifier.Token(host),
+	})
+	if err != nil {
+		// Probably unreachable
+		return err
+	}
+	successResponseBytes(w, responseBody)
+	return nil
+}
+
+// LeaseRequestBody is the request body of /renewLease and /removeServer.
+type LeaseRequestBody struct {
+	LeaseID     string `json:"lease_id"`
+	LeaseSecret string `json:"lease_secret"`
+}
+
+func renewLease(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	reqBody, err := readLeaseRequestBody(r)
+	if err != nil {
+		return err
 	}
+	if _, err := m.RenewLease(reqBody.LeaseID, reqBody.LeaseSecret); err != nil {
+		return NewApiErrorFromLeaseError(err)
+	}
+	successResponse(w, fmt.Sprintf(`{"lease_ttl":%d}`, int(m.LeaseTTL/time.Second)))
+	return nil
+}
 
-	successResponse(w, `{"added":true}`)
+// removeServer releases a lease. The server is delisted unless it has been registered again with another
+// lease.
+func removeServer(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	reqBody, err := readLeaseRequestBody(r)
+	if err != nil {
+		return err
+	}
+	serverAddr, err := m.ReleaseLease(reqBody.LeaseID, reqBody.LeaseSecret)
+	if err != nil {
+		return NewApiErrorFromLeaseError(err)
+	}
+	log.Info("lease released", zap.String("serverAddr", serverAddr))
+	successResponse(w, `{"removed":true}`)
+	return nil
+}
+
+func readLeaseRequestBody(r *http.Request) (*LeaseRequestBody, error) {
+	if r.Method != http.MethodPost {
+		return nil, NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	var reqBody LeaseRequestBody
+	if err := readJSONBody(r, &reqBody); err != nil {
+		return nil, err
+	}
+	if reqBody.LeaseID == "" || reqBody.LeaseSecret == "" {
+		return nil, NewApiError(http.StatusBadRequest, "lease_id and lease_secret are required", nil)
+	}
+	return &reqBody, nil
+}
+
+// readJSONBody unmarshals a JSON request body into v.
+func readJSONBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return errors.New("request body is nil")
+	}
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAddServerBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		return NewApiError(http.StatusBadRequest, "invalid JSON", err)
+	}
 	return nil
 }
 
 type AddServerRequestBody struct {
 	// HostAndPort is the public address (in "host:port" format)
 	HostAndPort string `json:"host_and_port"`
+	// LeaseID and LeaseSecret prove that the caller holds the server's lease, when registering it again
+	LeaseID     string `json:"lease_id,omitempty"`
+	LeaseSecret string `json:"lease_secret,omitempty"`
+	// Optional information about the server, shown in the server list
+	monitor.ServerMetadata
 }
 
 //////////////////// ERROR HANDLING /////////////////////////////////
@@ -191,6 +699,8 @@ type ApiError struct {
 	ResponseBody interface{}
 	Err          error
 	LogData      []zap.Field
+	// RetryAfter, if not zero, is sent in a Retry-After header
+	RetryAfter time.Duration
 }
 
 func (e ApiError) Error() string {
@@ -232,6 +742,32 @@ func NewApiErrorFromServerAddError(log *zap.Logger, err monitor.ServerAddError)
 		errorString = fmt.Sprintf("IP type is not allowed")
 	case monitor.ServerAddErrResolve:
 		errorString = fmt.Sprintf("failed to resolve server host name")
+	case monitor.ServerAddErrInvalid, monitor.ServerAddErrContentRejected:
+		// These messages are written by us, and only contain field names and limits
+		responseCode = http.StatusBadRequest
+		errorString = err.Error()
+	case monitor.ServerAddErrOwned, monitor.ServerAddErrOperatorQuota:
+		responseCode = http.StatusForbidden
+		errorString = err.Error()
+	case monitor.ServerAddErrCallerQuota, monitor.ServerAddErrTargetQuota, monitor.ServerAddErrTotalQuota,
+		monitor.ServerAddErrTooManyLeases:
+		responseCode = http.StatusTooManyRequests
+		errorString = err.Error()
+	case monitor.ServerAddErrReadOnly:
+		responseCode = http.StatusServiceUnavailable
+		errorString = "this registrar is a read-only follower; register with the primary"
+	}
+	apiErr := NewApiError(responseCode, errorString, err)
+	apiErr.RetryAfter = err.RetryAfter
+	return apiErr
+}
+
+func NewApiErrorFromLeaseError(err error) ApiError {
+	switch {
+	case errors.Is(err, monitor.ErrUnknownLease):
+		return NewApiError(http.StatusNotFound, err.Error(), err)
+	case errors.Is(err, monitor.ErrWrongLeaseSecret), errors.Is(err, monitor.ErrNotHolder):
+		return NewApiError(http.StatusForbidden, err.Error(), err)
 	}
-	return NewApiError(responseCode, errorString, err)
+	return NewApiError(http.StatusInternalServerError, "Internal Server Error", err)
 }
@@ -1,7 +1,22 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/conwayste/registrar/geo"
+	"github.com/conwayste/registrar/monitor"
+	"github.com/conwayste/registrar/version"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
 )
 
 func TestValidHostAndPort(t *testing.T) {
@@ -15,3 +30,378 @@ func TestValidHostAndPort(t *testing.T) {
 		t.Error("ruh roh")
 	}
 }
+
+func TestSortServersNearRegion(t *testing.T) {
+	m := monitor.NewMonitor()
+	origin, ok, err := parseNear("na-west", m)
+	if err != nil || !ok {
+		t.Fatalf("expected region to parse, got %v %v", ok, err)
+	}
+	servers := []*monitor.PublicServerInfo{
+		{Addr: "unknown:1"},
+		{Addr: "eu:1", Region: "eu-west"},
+		{Addr: "sf:1", Location: &geo.Location{Region: "na-west", Latitude: 37.8, Longitude: -122.4, HasCoords: true}},
+		{Addr: "nyc:1", Region: "na-east"},
+	}
+	sortByDistance(origin, servers)
+	expected := []string{"sf:1", "nyc:1", "eu:1", "unknown:1"}
+	for i, s := range servers {
+		if s.Addr != expected[i] {
+			t.Errorf("position %d: expected %s, got %s", i, expected[i], s.Addr)
+		}
+	}
+
+	if _, _, err := parseNear("atlantis", m); err == nil {
+		t.Error("expected error for unknown region")
+	}
+	if _, ok, err := parseNear("203.0.113.1", m); ok || err != nil {
+		t.Errorf("expected unknown location without a Locator, got %v %v", ok, err)
+	}
+}
+
+func TestFilterCompatible(t *testing.T) {
+	client, err := version.Parse("0.3.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []*monitor.PublicServerInfo{
+		{Addr: "old:1", Version: "0.2.9"},
+		{Addr: "same:1", Version: "0.3.4"},
+		{Addr: "junk:1", Version: "whatever"},
+	}
+	filtered := filterCompatible(servers, client, nil)
+	if len(filtered) != 1 || filtered[0].Addr != "same:1" {
+		t.Errorf("expected only same:1, got %v", filtered)
+	}
+}
+
+func TestLeaseEndpoints(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post("/addServer", `{"host_and_port":"127.0.0.1:2016"}`)
+	var added AddServerResponseBody
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &added) != nil || added.LeaseID == "" {
+		t.Fatalf("failed to register: %d %s", rec.Code, rec.Body)
+	}
+	if added.LeaseTTL != int(m.LeaseTTL/time.Second) {
+		t.Errorf("expected lease_ttl %d, got %d", int(m.LeaseTTL/time.Second), added.LeaseTTL)
+	}
+
+	if rec := post("/renewLease", `{"lease_id":"`+added.LeaseID+`","lease_secret":"nope"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for wrong secret, got %d", rec.Code)
+	}
+	leaseBody := `{"lease_id":"` + added.LeaseID + `","lease_secret":"` + added.LeaseSecret + `"}`
+	if rec := post("/renewLease", leaseBody); rec.Code != http.StatusOK {
+		t.Errorf("failed to renew: %d %s", rec.Code, rec.Body)
+	}
+	if rec := post("/removeServer", leaseBody); rec.Code != http.StatusOK {
+		t.Errorf("failed to remove: %d %s", rec.Code, rec.Body)
+	}
+	if len(m.ListServers(true)) != 0 {
+		t.Error("expected server to be removed")
+	}
+	if rec := post("/removeServer", leaseBody); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for released lease, got %d", rec.Code)
+	}
+}
+
+func TestAddServerAgainNeedsLease(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	post := func(body string) (*httptest.ResponseRecorder, AddServerResponseBody) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/addServer", strings.NewReader(body)))
+		var resp AddServerResponseBody
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	rec, added := post(`{"host_and_port":"127.0.0.1:2016"}`)
+	if rec.Code != http.StatusOK || added.LeaseID == "" {
+		t.Fatalf("failed to register: %d %s", rec.Code, rec.Body)
+	}
+	rec, again := post(`{"host_and_port":"127.0.0.1:2016","description":"hijacked"}`)
+	if rec.Code != http.StatusOK || !again.AlreadyRegistered || again.LeaseID != "" {
+		t.Errorf("expected already_registered without a lease, got %d %s", rec.Code, rec.Body)
+	}
+	if rec, _ := post(`{"host_and_port":"127.0.0.1:2016","lease_id":"` + added.LeaseID +
+		`","lease_secret":"nope"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for wrong secret, got %d", rec.Code)
+	}
+	rec, renewed := post(`{"host_and_port":"127.0.0.1:2016","lease_id":"` + added.LeaseID +
+		`","lease_secret":"` + added.LeaseSecret + `","description":"updated"}`)
+	if rec.Code != http.StatusOK || renewed.LeaseID != added.LeaseID || renewed.AlreadyRegistered {
+		t.Errorf("expected the lease to be renewed, got %d %s", rec.Code, rec.Body)
+	}
+	if regs := m.ListRegistrations(); len(regs) != 1 ||
+		regs[0].Metadata.Description != "updated" {
+		t.Errorf("expected the holder's metadata, got %+v", regs)
+	}
+}
+
+func TestQuotaErrorHasRetryAfter(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Quotas = monitor.Quotas{Total: 1}
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/addServer", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post(`{"host_and_port":"127.0.0.1:2016"}`); rec.Code != http.StatusOK {
+		t.Fatalf("failed to register: %d %s", rec.Code, rec.Body)
+	}
+	rec := post(`{"host_and_port":"127.0.0.1:2017"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d %s", rec.Code, rec.Body)
+	}
+	// Leases don't expire by default, so room may be made at any ping
+	if got, expected := rec.Header().Get("Retry-After"), "5"; got != expected {
+		t.Errorf("expected Retry-After %s, got %q", expected, got)
+	}
+
+	m.LeaseTTL = 10 * time.Minute // room is made as leases expire
+	rec = post(`{"host_and_port":"127.0.0.1:2017"}`)
+	if got, expected := rec.Header().Get("Retry-After"), "600"; got != expected {
+		t.Errorf("expected Retry-After %s, got %q", expected, got)
+	}
+}
+
+func TestDNSVerificationEndpoint(t *testing.T) {
+	m := monitor.NewMonitor()
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	if rec := get("/dnsVerification?host=myserver.example.com"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when disabled, got %d", rec.Code)
+	}
+	m.DNSVerifier = monitor.NewDNSVerifier([]byte("secret"))
+	rec := get("/dnsVerification?host=myserver.example.com")
+	var body DNSVerificationResponseBody
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil {
+		t.Fatalf("failed to get token: %d %s", rec.Code, rec.Body)
+	}
+	if body.Record != "_conwayste-registrar.myserver.example.com" || body.Value != m.DNSVerifier.Token("myserver.example.com") {
+		t.Errorf("unexpected response %+v", body)
+	}
+	if rec := get("/dnsVerification?host=myserver.example.com:2016"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for host with port, got %d", rec.Code)
+	}
+}
+
+func TestHistoryAndStatsEndpoints(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	if err := m.AddServer("127.0.0.1:2016"); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	// Nothing is recorded until the server is pinged
+	if rec := get("/servers/127.0.0.1:2016/history"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("/stats?resolution=fortnight"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+	rec := get("/stats?resolution=hour")
+	var body StatsResponseBody
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil {
+		t.Fatalf("failed to get stats: %d %s", rec.Code, rec.Body)
+	}
+	if body.Servers != 1 || body.ServersUp != 0 {
+		t.Errorf("expected 1 server that is down, got %+v", body)
+	}
+}
+
+func TestRoomsEndpointWithoutRoomList(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	if err := m.AddServer("127.0.0.1:2016"); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	for _, url := range []string{"/servers/127.0.0.1:2016/rooms", "/servers/127.0.0.1:2017/rooms"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d %s", url, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSortByReliability(t *testing.T) {
+	servers := []*monitor.PublicServerInfo{
+		{Addr: "near:1", Reliability: 50},
+		{Addr: "far:1", Reliability: 90},
+		{Addr: "nearer:1", Reliability: 50},
+	}
+	sortByReliability(servers)
+	expected := []string{"far:1", "near:1", "nearer:1"}
+	for i, s := range servers {
+		if s.Addr != expected[i] {
+			t.Errorf("position %d: expected %s, got %s", i, expected[i], s.Addr)
+		}
+	}
+}
+
+func TestDiagnosisEndpoint(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	lease, err := m.Register(&monitor.Registration{Addr: addr})
+	if err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	do := func(method, url, body string) (*httptest.ResponseRecorder, monitor.Diagnosis) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		var diagnosis monitor.Diagnosis
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &diagnosis); err != nil {
+				t.Fatalf("failed to unmarshal diagnosis: %v", err)
+			}
+		}
+		return rec, diagnosis
+	}
+
+	if rec, _ := do(http.MethodGet, "/servers/127.0.0.1:1/diagnosis", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unregistered server, got %d %s", rec.Code, rec.Body)
+	}
+	// Anyone gets what the registrar has seen, but the server isn't probed for them
+	rec, diagnosis := do(http.MethodGet, "/servers/"+addr+"/diagnosis", "")
+	if rec.Code != http.StatusOK || diagnosis.Addr != addr || diagnosis.Probe != nil {
+		t.Errorf("expected a diagnosis without a probe, got %d %s", rec.Code, rec.Body)
+	}
+	if rec, _ := do(http.MethodPost, "/servers/"+addr+"/diagnosis", `{}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a lease, got %d %s", rec.Code, rec.Body)
+	}
+	body := `{"lease_id":"` + lease.ID + `","lease_secret":"nope"}`
+	if rec, _ := do(http.MethodPost, "/servers/"+addr+"/diagnosis", body); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a wrong secret, got %d %s", rec.Code, rec.Body)
+	}
+	body = `{"lease_id":"` + lease.ID + `","lease_secret":"` + lease.Secret + `"}`
+	rec, diagnosis = do(http.MethodPost, "/servers/"+addr+"/diagnosis", body)
+	if rec.Code != http.StatusOK || diagnosis.Probe == nil || !diagnosis.Probe.PortUnreachable {
+		t.Errorf("expected %s to be unreachable, got %d %s", addr, rec.Code, rec.Body)
+	}
+}
+
+func TestAddServerWait(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var getStatus monitor.ServerGetStatus
+			if err := monitor.UnmarshalStrict(buf[:n], &getStatus); err == nil {
+				reply, _ := monitor.Marshal(&monitor.ServerStatus{Nonce: getStatus.Nonce,
+					ServerName: "waited for", PlayerCount: 2})
+				server.WriteTo(reply, addr)
+			}
+		}
+	}()
+	registrarConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer registrarConn.Close()
+
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Receive(ctx, zap.NewNop(), registrarConn)
+	for {
+		if _, err := m.ProbeNow(ctx, zap.NewNop(), "127.0.0.1:1"); !errors.Is(err, monitor.ErrNotReceiving) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	router := mux.NewRouter()
+	AddRoutes(router, m, zap.NewNop(), false)
+	post := func(query, addr string) (*httptest.ResponseRecorder, AddServerResponseBody) {
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(`{"host_and_port":"` + addr + `"}`)
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/addServer"+query, body))
+		var added AddServerResponseBody
+		json.Unmarshal(rec.Body.Bytes(), &added)
+		return rec, added
+	}
+
+	for _, query := range []string{"?wait=soon", "?wait=-1s", "?wait=1h"} {
+		if rec, _ := post(query, server.LocalAddr().String()); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d %s", query, rec.Code, rec.Body)
+		}
+	}
+	if len(m.ListRegistrations()) != 0 {
+		t.Fatal("expected no server to be registered with a bad wait")
+	}
+
+	rec, added := post("?wait=2s", server.LocalAddr().String())
+	if rec.Code != http.StatusOK || added.Status == nil || added.ProbeError != "" {
+		t.Fatalf("expected the server's status, got %d %s", rec.Code, rec.Body)
+	}
+	if added.Status.Name != "waited for" || added.Status.Players != 2 || added.Status.RTTMillis <= 0 {
+		t.Errorf("unexpected status %+v", added.Status)
+	}
+	if servers := m.ListServers(false); len(servers) != 1 {
+		t.Errorf("expected the server to be listed right away, got %+v", servers)
+	}
+	// Someone else registering it again doesn't get it probed
+	rec, added = post("?wait=2s", server.LocalAddr().String())
+	if rec.Code != http.StatusOK || !added.AlreadyRegistered || added.Status != nil || added.ProbeError != "" {
+		t.Errorf("expected no probe for someone else, got %d %s", rec.Code, rec.Body)
+	}
+
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+	rec, added = post("?wait=50ms", closedAddr)
+	if rec.Code != http.StatusOK || !added.Added || added.Status != nil ||
+		added.ProbeError != monitor.ErrProbeTimeout.Error() {
+		t.Errorf("expected a timeout, got %d %s", rec.Code, rec.Body)
+	}
+}
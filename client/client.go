@@ -0,0 +1,217 @@
+// Package client talks to a registrar over its HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/monitor"
+	"github.com/conwayste/registrar/operator"
+)
+
+const maxResponseBodySize = 10 * 1024 * 1024
+
+type Client struct {
+	// BaseURL is the scheme, host, and port of the registrar, e.g. "https://registry.conwayste.rs"
+	BaseURL    string
+	HTTPClient *http.Client
+	// Header holds extra headers to send with every request
+	Header http.Header
+}
+
+func New(baseURL string, httpClient *http.Client) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: httpClient,
+		Header:     http.Header{},
+	}
+}
+
+// Error is returned when the registrar responds with a non-2xx status code.
+type Error struct {
+	StatusCode int
+	// Message is the "error" field of the response body, or the whole body if it has no such field
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("registrar responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// ListServers lists the servers that are up. The query may be nil, or have parameters such as "tag".
+func (c *Client) ListServers(ctx context.Context, query url.Values) ([]*monitor.PublicServerInfo, error) {
+	var respBody struct {
+		Servers []*monitor.PublicServerInfo `json:"servers"`
+	}
+	path := "/servers"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &respBody); err != nil {
+		return nil, err
+	}
+	return respBody.Servers, nil
+}
+
+// Diagnosis returns what the registrar has seen of a registered server while pinging it, and why it isn't
+// listed, if it isn't. It fails with a 404 Error if the server isn't registered.
+func (c *Client) Diagnosis(ctx context.Context, hostAndPort string) (*monitor.Diagnosis, error) {
+	var respBody monitor.Diagnosis
+	if err := c.do(ctx, http.MethodGet, "/servers/"+url.PathEscape(hostAndPort)+"/diagnosis", nil, &respBody); err != nil {
+		return nil, err
+	}
+	return &respBody, nil
+}
+
+// AddServer registers a server. The returned lease must be renewed with RenewLease to keep it listed.
+func (c *Client) AddServer(ctx context.Context, hostAndPort string) (*api.AddServerResponseBody, error) {
+	return c.Register(ctx, &api.AddServerRequestBody{HostAndPort: hostAndPort})
+}
+
+// Register is like AddServer, but can also provide metadata.
+func (c *Client) Register(ctx context.Context, reqBody *api.AddServerRequestBody) (*api.AddServerResponseBody, error) {
+	var respBody api.AddServerResponseBody
+	if err := c.do(ctx, http.MethodPost, "/addServer", reqBody, &respBody); err != nil {
+		return nil, err
+	}
+	return &respBody, nil
+}
+
+// RegisterAndWait is like Register, but the registrar pings the server right away and waits up to wait for
+// its reply. The response has either the server's Status or a ProbeError.
+func (c *Client) RegisterAndWait(ctx context.Context, reqBody *api.AddServerRequestBody,
+	wait time.Duration) (*api.AddServerResponseBody, error) {
+	var respBody api.AddServerResponseBody
+	path := "/addServer?" + url.Values{"wait": {wait.String()}}.Encode()
+	if err := c.do(ctx, http.MethodPost, path, reqBody, &respBody); err != nil {
+		return nil, err
+	}
+	return &respBody, nil
+}
+
+// RenewLease renews the lease of a registration. It fails with a 404 Error if the lease has expired, in
+// which case the server should register again.
+func (c *Client) RenewLease(ctx context.Context, leaseID, leaseSecret string) error {
+	return c.do(ctx, http.MethodPost, "/renewLease", &api.LeaseRequestBody{LeaseID: leaseID, LeaseSecret: leaseSecret}, nil)
+}
+
+// RemoveServer releases the lease of a registration, delisting the server right away unless it has another
+// lease.
+func (c *Client) RemoveServer(ctx context.Context, leaseID, leaseSecret string) error {
+	return c.do(ctx, http.MethodPost, "/removeServer", &api.LeaseRequestBody{LeaseID: leaseID, LeaseSecret: leaseSecret}, nil)
+}
+
+// Promote promotes a follower registrar to primary. It is an admin endpoint; see SetAdminKey.
+func (c *Client) Promote(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/admin/promote", nil, nil)
+}
+
+// SetAdminKey makes the client authenticate with the given key, which admin endpoints require.
+func (c *Client) SetAdminKey(key string) {
+	c.Header.Set("Authorization", "Bearer "+key)
+}
+
+// SetAPIKey makes the client authenticate as an operator, so that servers it registers are verified and
+// owned by the operator.
+func (c *Client) SetAPIKey(key string) {
+	c.Header.Set("Authorization", "Bearer "+key)
+}
+
+// ListOwnServers lists all servers registered by the operator, whether or not they are up. See SetAPIKey.
+func (c *Client) ListOwnServers(ctx context.Context) ([]*monitor.PublicServerInfo, error) {
+	var respBody struct {
+		Servers []*monitor.PublicServerInfo `json:"servers"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/operator/servers", nil, &respBody); err != nil {
+		return nil, err
+	}
+	return respBody.Servers, nil
+}
+
+// RemoveOwnServer delists a server registered by the operator. See SetAPIKey.
+func (c *Client) RemoveOwnServer(ctx context.Context, hostAndPort string) error {
+	return c.do(ctx, http.MethodPost, "/operator/removeServer", &operator.RemoveServerRequestBody{HostAndPort: hostAndPort}, nil)
+}
+
+// CreateOperator creates an operator account and returns its API key. It is an admin endpoint.
+func (c *Client) CreateOperator(ctx context.Context, name string, maxServers int) (*operator.CreateResponseBody, error) {
+	var respBody operator.CreateResponseBody
+	reqBody := &operator.CreateRequestBody{Name: name, MaxServers: maxServers}
+	if err := c.do(ctx, http.MethodPost, "/admin/operators", reqBody, &respBody); err != nil {
+		return nil, err
+	}
+	return &respBody, nil
+}
+
+// ListOperators lists the operator accounts. It is an admin endpoint.
+func (c *Client) ListOperators(ctx context.Context) ([]operator.Account, error) {
+	var respBody struct {
+		Operators []operator.Account `json:"operators"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/operators", nil, &respBody); err != nil {
+		return nil, err
+	}
+	return respBody.Operators, nil
+}
+
+// DeleteOperator deletes an operator account. Its servers stay registered, but are no longer verified. It
+// is an admin endpoint.
+func (c *Client) DeleteOperator(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/operators/"+url.PathEscape(name), nil, nil)
+}
+
+// do sends reqBody (if not nil) as JSON, and unmarshals the response into respBody (if not nil).
+func (c *Client) do(ctx context.Context, method, path string, reqBody, respBody interface{}) error {
+	var bodyReader io.Reader
+	if reqBody != nil {
+		reqBytes, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(reqBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bodyReader)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	if reqBody != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		apiErr := &Error{StatusCode: resp.StatusCode, Message: string(respBytes)}
+		var errBody struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBytes, &errBody) == nil && errBody.Error != "" {
+			apiErr.Message = errBody.Error
+		}
+		return apiErr
+	}
+	if respBody != nil {
+		if err := json.Unmarshal(respBytes, respBody); err != nil {
+			return fmt.Errorf("failed to parse response body: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Command fakeserver runs one or more fake Conwayste servers that answer the registrar's GetStatus
+// pings and register themselves with it. It is meant for testing a registrar locally, e.g. one started
+// with -allowSpecialIPs so that loopback addresses can be registered.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	glog "log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/client"
+	"github.com/conwayste/registrar/fakeserver"
+	"github.com/conwayste/registrar/monitor"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	registrarURL     = flag.String("registrar", "http://127.0.0.1:8000", "base URL of the registrar to register with; disabled if empty")
+	host             = flag.String("host", "127.0.0.1", "IP address to listen on and register")
+	basePort         = flag.Int("basePort", 0, "UDP port of the first server; the rest use consecutive ports; 0 means pick any free ports")
+	count            = flag.Int("count", 1, "number of fake servers to run")
+	registerInterval = flag.Duration("registerInterval", time.Minute,
+		"how often each server renews its lease (or registers again if it was lost); 0 means register once, so the lease eventually expires")
+
+	name       = flag.String("name", "Fake Server", "server name; a number is appended when running more than one server")
+	version    = flag.String("version", "0.0.0", "server version")
+	players    = flag.Uint64("players", 0, "player count")
+	rooms      = flag.Uint64("rooms", 0, "room count; the rooms are also sent in reply to GetRoomList, with the players spread across them")
+	latency    = flag.Duration("latency", 0, "delay before each reply")
+	jitter     = flag.Duration("jitter", 0, "maximum random extra delay before each reply")
+	loss       = flag.Float64("loss", 0, "fraction of pings that are not answered")
+	malformed  = flag.Float64("malformed", 0, "fraction of replies that are garbage")
+	wrongNonce = flag.Float64("wrongNonce", 0, "fraction of replies that have the wrong nonce")
+	flap       = flag.Duration("flap", 0, "if non-zero, alternate between answering and ignoring pings with this period")
+)
+
+func main() {
+	flag.Parse()
+	log, err := zap.NewDevelopment()
+	if err != nil {
+		glog.Fatalf("failed to construct logger: %v", err)
+	}
+	defer log.Sync()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	// Cancel on SIGINT (Ctrl-C)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		log.Info("SIGINT received; cancelling...")
+		cancelFunc()
+	}()
+
+	grp, grpCtx := errgroup.WithContext(ctx)
+	c := client.New(*registrarURL, &http.Client{Timeout: 10 * time.Second})
+	for i := 0; i < *count; i++ {
+		cfg := fakeserver.Config{
+			Status: monitor.ServerStatus{
+				ServerVersion: *version,
+				PlayerCount:   *players,
+				RoomCount:     *rooms,
+				ServerName:    *name,
+			},
+			Behavior: fakeserver.Behavior{
+				Latency:        *latency,
+				Jitter:         *jitter,
+				LossRate:       *loss,
+				MalformedRate:  *malformed,
+				WrongNonceRate: *wrongNonce,
+				FlapPeriod:     *flap,
+			},
+			Rooms: fakeRooms(*rooms, *players),
+		}
+		if *count > 1 {
+			cfg.Status.ServerName = fmt.Sprintf("%s %d", *name, i+1)
+		}
+		port := 0
+		if *basePort != 0 {
+			port = *basePort + i
+		}
+		s, err := fakeserver.Listen(net.JoinHostPort(*host, strconv.Itoa(port)), cfg)
+		if err != nil {
+			log.Error("failed to listen", zap.Error(err))
+			cancelFunc()
+			break
+		}
+		defer s.Close()
+		hostAndPort := s.Addr().String()
+		sLog := log.With(zap.String("hostAndPort", hostAndPort))
+
+		grp.Go(func() error {
+			return s.Serve(grpCtx, sLog)
+		})
+		if *registrarURL != "" {
+			grp.Go(func() error {
+				return keepRegistered(grpCtx, sLog, c, hostAndPort)
+			})
+		}
+	}
+
+	log.Info("fake servers are running", zap.Int("count", *count))
+	if err := grp.Wait(); err != nil && err != context.Canceled {
+		log.Error("fake server exited", zap.Error(err))
+	}
+}
+
+// keepRegistered registers the server, then renews its lease every registerInterval, registering again if
+// the lease has been lost. Failures are logged and retried at the next interval. When ctx is done, the lease
+// is released so that the server is delisted right away. If the server is already registered by someone
+// else, no lease is granted, so there is nothing to renew or release.
+func keepRegistered(ctx context.Context, log *zap.Logger, c *client.Client, hostAndPort string) error {
+	var lease *api.AddServerResponseBody
+	defer func() {
+		if lease == nil {
+			return
+		}
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.RemoveServer(releaseCtx, lease.LeaseID, lease.LeaseSecret); err != nil {
+			log.Error("failed to release lease", zap.Error(err))
+		}
+	}()
+	for {
+		if lease != nil {
+			err := c.RenewLease(ctx, lease.LeaseID, lease.LeaseSecret)
+			var apiErr *client.Error
+			if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+				log.Info("lease lost; registering again")
+				lease = nil
+			} else if err != nil {
+				log.Error("failed to renew lease", zap.Error(err))
+			} else {
+				log.Debug("renewed lease")
+			}
+		}
+		if lease == nil {
+			var err error
+			if lease, err = c.AddServer(ctx, hostAndPort); err != nil {
+				log.Error("failed to register", zap.Error(err))
+			} else if lease.AlreadyRegistered {
+				log.Warn("already registered by someone else; not renewing or releasing its lease")
+				lease = nil
+				<-ctx.Done()
+				return ctx.Err()
+			} else {
+				log.Debug("registered")
+			}
+		}
+		if *registerInterval == 0 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*registerInterval):
+		}
+	}
+}
+
+// fakeRooms makes numRooms rooms of 8 players, with the players spread across them.
+func fakeRooms(numRooms, numPlayers uint64) []monitor.RoomInfo {
+	rooms := make([]monitor.RoomInfo, numRooms)
+	for i := range rooms {
+		rooms[i] = monitor.RoomInfo{Name: fmt.Sprintf("Room %d", i+1), Capacity: 8}
+	}
+	for i := uint64(0); i < numPlayers && numRooms > 0; i++ {
+		rooms[i%numRooms].Players++
+	}
+	for i := range rooms {
+		rooms[i].InProgress = rooms[i].Players > 1
+	}
+	return rooms
+}
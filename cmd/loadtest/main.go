@@ -0,0 +1,287 @@
+// Command loadtest runs a registrar in-process against many fake servers and concurrent HTTP clients,
+// and periodically reports throughput, latency, and resource usage. Run it briefly to size a deployment,
+// or for hours (-duration 0) as a soak test.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	glog "log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/client"
+	"github.com/conwayste/registrar/fakeserver"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	numServers     = flag.Int("servers", 2000, "number of fake servers")
+	listClients    = flag.Int("listClients", 20, "number of concurrent clients calling /servers")
+	addClients     = flag.Int("addClients", 5, "number of concurrent clients calling /addServer")
+	listRate       = flag.Float64("listRate", 20, "requests per second per /servers client; keep under the registrar's per-IP limit")
+	addRate        = flag.Float64("addRate", 5, "requests per second per /addServer client; keep under the registrar's per-IP limit")
+	duration       = flag.Duration("duration", time.Minute, "how long to run; 0 means until SIGINT")
+	reportInterval = flag.Duration("reportInterval", 5*time.Second, "how often to report")
+	pingInterval   = flag.Duration("pingInterval", time.Second, "how often the registrar pings every server")
+	latency        = flag.Duration("latency", 0, "delay before each fake server reply")
+	jitter         = flag.Duration("jitter", 0, "maximum random extra delay before each fake server reply")
+	loss           = flag.Float64("loss", 0, "fraction of pings that fake servers don't answer")
+	verbose        = flag.Bool("verbose", false, "show the registrar's logs")
+)
+
+func main() {
+	flag.Parse()
+	log := zap.NewNop()
+	if *verbose {
+		var err error
+		if log, err = zap.NewDevelopment(); err != nil {
+			glog.Fatalf("failed to construct logger: %v", err)
+		}
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	if *duration > 0 {
+		ctx, cancelFunc = context.WithTimeout(ctx, *duration)
+		defer cancelFunc()
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		cancelFunc()
+	}()
+
+	// Lock contention is read from the mutex profile, which must be enabled first
+	runtime.SetMutexProfileFraction(1)
+
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	m.PingInterval = *pingInterval
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		glog.Fatalf("failed to open UDP port: %v", err)
+	}
+	defer conn.Close()
+
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.Go(func() error {
+		return m.Send(grpCtx, log, conn)
+	})
+	grp.Go(func() error {
+		return m.Receive(grpCtx, log, conn)
+	})
+
+	router := mux.NewRouter()
+	api.AddRoutes(router, m, log, true) // Clients pretend to be behind a proxy, so each has its own IP
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		glog.Fatalf("failed to listen for HTTP: %v", err)
+	}
+	srv := &http.Server{Handler: router}
+	go srv.Serve(listener)
+	defer srv.Close()
+	baseURL := "http://" + listener.Addr().String()
+
+	serverAddrs := make([]string, 0, *numServers)
+	for i := 0; i < *numServers; i++ {
+		s, err := fakeserver.Listen("127.0.0.1:0", fakeserver.Config{
+			Status: monitor.ServerStatus{
+				ServerVersion: "0.0.0",
+				PlayerCount:   uint64(rand.Intn(10)),
+				RoomCount:     uint64(rand.Intn(3)),
+				ServerName:    fmt.Sprintf("Load Test %d", i+1),
+			},
+			Behavior: fakeserver.Behavior{Latency: *latency, Jitter: *jitter, LossRate: *loss},
+		})
+		if err != nil {
+			glog.Fatalf("failed to start fake server %d (raise the open file limit?): %v", i+1, err)
+		}
+		defer s.Close()
+		grp.Go(func() error {
+			return s.Serve(grpCtx, log)
+		})
+		addr := s.Addr().String()
+		serverAddrs = append(serverAddrs, addr)
+		if err := m.AddServer(addr); err != nil {
+			glog.Fatalf("failed to add fake server %d: %v", i+1, err)
+		}
+	}
+
+	listLatencies := &latencyRecorder{}
+	addLatencies := &latencyRecorder{}
+	for i := 0; i < *listClients+*addClients; i++ {
+		c := client.New(baseURL, &http.Client{Timeout: 10 * time.Second})
+		c.Header.Set("X-Forwarded-For", fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+		if i < *listClients {
+			grp.Go(func() error {
+				return runClient(grpCtx, *listRate, listLatencies, func() error {
+					_, err := c.ListServers(grpCtx, nil)
+					return err
+				})
+			})
+		} else {
+			grp.Go(func() error {
+				return runClient(grpCtx, *addRate, addLatencies, func() error {
+					_, err := c.AddServer(grpCtx, serverAddrs[rand.Intn(len(serverAddrs))])
+					return err
+				})
+			})
+		}
+	}
+
+	grp.Go(func() error {
+		return report(grpCtx, m, listLatencies, addLatencies)
+	})
+	if err := grp.Wait(); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+		glog.Fatalf("load test failed: %v", err)
+	}
+}
+
+// runClient calls do at the given rate until the context is done, recording latencies and errors.
+func runClient(ctx context.Context, rate float64, rec *latencyRecorder, do func() error) error {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		t := time.Now()
+		err := do()
+		if ctx.Err() != nil {
+			return nil
+		}
+		rec.Record(time.Since(t), err)
+	}
+}
+
+// latencyRecorder collects request latencies until they are taken by Take.
+type latencyRecorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (r *latencyRecorder) Record(d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies = append(r.latencies, d)
+}
+
+// Take returns the latencies (sorted) and error count recorded since the last call.
+func (r *latencyRecorder) Take() ([]time.Duration, int) {
+	r.mu.Lock()
+	latencies, errors := r.latencies, r.errors
+	r.latencies, r.errors = nil, 0
+	r.mu.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies, errors
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// mutexContention sums the mutex profile; delay is in CPU cycles, as the runtime reports it.
+func mutexContention() (events, delayCycles int64) {
+	n, _ := runtime.MutexProfile(nil)
+	records := make([]runtime.BlockProfileRecord, n+50)
+	n, _ = runtime.MutexProfile(records)
+	for _, r := range records[:n] {
+		events += r.Count
+		delayCycles += r.Cycles
+	}
+	return events, delayCycles
+}
+
+var reportColumns = []string{
+	"elapsed", "listed", "pings/s", "replies/s", "timeouts/s", "avg rtt", "dropped",
+	"list p50", "list p99", "list err", "add p50", "add p99", "add err",
+	"goroutines", "heap MB", "lock waits/s", "lock Mcyc/s",
+}
+
+func printRow(fields ...interface{}) {
+	for _, f := range fields {
+		fmt.Printf("%13v", f)
+	}
+	fmt.Println()
+}
+
+func report(ctx context.Context, m *monitor.Monitor, listLatencies, addLatencies *latencyRecorder) error {
+	header := make([]interface{}, len(reportColumns))
+	for i, c := range reportColumns {
+		header[i] = c
+	}
+	printRow(header...)
+
+	start := time.Now()
+	var prevStats monitor.Stats
+	prevEvents, prevCycles := mutexContention()
+	var memStats runtime.MemStats
+	ticker := time.NewTicker(*reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		secs := reportInterval.Seconds()
+
+		stats := m.Stats()
+		replies := stats.RepliesReceived - prevStats.RepliesReceived
+		var avgRTT time.Duration
+		if replies > 0 {
+			avgRTT = (stats.ReplyRTTTotal - prevStats.ReplyRTTTotal) / time.Duration(replies)
+		}
+		dropped := stats.DroppedQueueFull + stats.DroppedUnknownSender - prevStats.DroppedQueueFull - prevStats.DroppedUnknownSender
+		lists, listErrs := listLatencies.Take()
+		adds, addErrs := addLatencies.Take()
+		runtime.ReadMemStats(&memStats)
+		events, cycles := mutexContention()
+
+		printRow(
+			time.Since(start).Round(time.Second),
+			len(m.ListServers(false)),
+			fmt.Sprintf("%.0f", float64(stats.PingsSent-prevStats.PingsSent)/secs),
+			fmt.Sprintf("%.0f", float64(replies)/secs),
+			fmt.Sprintf("%.0f", float64(stats.PingsTimedOut-prevStats.PingsTimedOut)/secs),
+			avgRTT.Round(time.Microsecond),
+			dropped,
+			percentile(lists, 0.5).Round(time.Microsecond),
+			percentile(lists, 0.99).Round(time.Microsecond),
+			listErrs,
+			percentile(adds, 0.5).Round(time.Microsecond),
+			percentile(adds, 0.99).Round(time.Microsecond),
+			addErrs,
+			runtime.NumGoroutine(),
+			fmt.Sprintf("%.1f", float64(memStats.HeapAlloc)/(1<<20)),
+			fmt.Sprintf("%.0f", float64(events-prevEvents)/secs),
+			fmt.Sprintf("%.1f", float64(cycles-prevCycles)/secs/1e6),
+		)
+		prevStats, prevEvents, prevCycles = stats, events, cycles
+	}
+}
@@ -6,15 +6,21 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	glog "log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/federation"
+	"github.com/conwayste/registrar/geo"
 	"github.com/conwayste/registrar/monitor"
+	"github.com/conwayste/registrar/operator"
+	"github.com/conwayste/registrar/version"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -31,7 +37,54 @@ var (
 		"whether unusual (not global or not unicast) IPs are allowed; don't set to true in production")
 	useProxyHeaders = flag.Bool("useProxyHeaders", true,
 		"whether to trust X-Forwarded-For; must be true with a reverse proxy (nginx etc.); must be false otherwise")
-	backupFile = flag.String("backupFile", "backup.jsonl", "backup file to save and restore to; disabled if empty")
+	backupFile     = flag.String("backupFile", "backup.jsonl", "backup file to save and restore to; disabled if empty")
+	httpAddr       = flag.String("httpAddr", "127.0.0.1:8000", "address for the HTTP server to listen on")
+	federationName = flag.String("federationName", "",
+		"name of this registrar, as known to its peers, followers, and primary; required with -peersFile or -primaryFile")
+	peersFile = flag.String("peersFile", "",
+		"JSON file listing peer registrars to replicate registrations with; federation is disabled if empty")
+	followersFile = flag.String("followersFile", "",
+		"JSON file listing follower registrars allowed to replicate from this one; disabled if empty")
+	primaryFile = flag.String("primaryFile", "",
+		"JSON file describing the primary registrar; if set, this registrar is a read-only follower until promoted")
+	followerUsesProbeResults = flag.Bool("followerUsesProbeResults", false,
+		"whether a follower also lists servers that its primary sees as up")
+	geoIPFile   = flag.String("geoIPFile", "", "MaxMind DB (e.g. GeoLite2-City.mmdb) for locating servers; disabled if empty")
+	cidrMapFile = flag.String("cidrMapFile", "",
+		"file mapping networks to regions, used for IPs not in -geoIPFile; disabled if empty")
+	bannedWordsFile = flag.String("bannedWordsFile", "",
+		"file listing words (one per line) that are not allowed in server metadata; disabled if empty")
+	compatFile = flag.String("compatFile", "",
+		"JSON file with the client/server version compatibility matrix and deprecated server versions")
+	operatorsFile = flag.String("operatorsFile", "",
+		"file storing operator accounts (with hashed API keys), managed via /admin/operators; disabled if empty")
+	adminKeyFile          = flag.String("adminKeyFile", "", "file containing the key for admin endpoints; they are disabled if empty")
+	maxRegistrationsPerIP = flag.Int("maxRegistrationsPerIP", 0,
+		"most distinct servers that one caller IP may register per day; 0 means no limit")
+	maxRegistrationsPerPrefix = flag.Int("maxRegistrationsPerPrefix", 0,
+		"most distinct servers that callers in one /24 (IPv4) or /48 (IPv6) may register per day; 0 means no limit")
+	maxServersPerIP     = flag.Int("maxServersPerIP", 0, "most servers registered at one IP; 0 means no limit")
+	maxServersPerPrefix = flag.Int("maxServersPerPrefix", 0,
+		"most servers registered in one /24 (IPv4) or /48 (IPv6); 0 means no limit")
+	maxServers    = flag.Int("maxServers", 0, "most servers registered in total; 0 means no limit")
+	degradedAfter = flag.Int("degradedAfter", monitor.DefaultStateThresholds().DegradedAfter,
+		"missed pings in a row after which an up server is degraded (still listed)")
+	downAfter = flag.Int("downAfter", monitor.DefaultStateThresholds().DownAfter,
+		"missed pings in a row after which a server is down (not listed)")
+	delistAfter = flag.Int("delistAfter", monitor.DefaultStateThresholds().DelistAfter,
+		"missed pings in a row after which a server is delisted, and must register again")
+	upAfter = flag.Int("upAfter", monitor.DefaultStateThresholds().UpAfter,
+		"answered pings in a row after which a degraded or down server is up again")
+	historyFile = flag.String("historyFile", "",
+		"file to save the uptime and player count history of servers to, and restore it from; disabled if empty")
+	dnsVerificationKeyFile = flag.String("dnsVerificationKeyFile", "",
+		"file containing the secret key from which DNS verification tokens are derived; disabled if empty")
+	roomListInterval = flag.Duration("roomListInterval", 0,
+		"how often listed servers are asked for their room lists, with provisional packet variants; 0 disables room lists")
+	leaseTTL = flag.Duration("leaseTTL", 0,
+		"how long leases last unless renewed, after which servers are delisted; 0 means they never expire")
+	rendezvous = flag.Bool("rendezvous", false,
+		"let servers behind NAT register their public address over UDP, and introduce clients to them, with provisional packet variants")
 )
 
 func main() {
@@ -61,10 +114,127 @@ func main() {
 	}()
 
 	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = *allowSpecialIPs
+	m.Quotas = monitor.Quotas{
+		PerCallerIP:     *maxRegistrationsPerIP,
+		PerCallerPrefix: *maxRegistrationsPerPrefix,
+		PerTargetIP:     *maxServersPerIP,
+		PerTargetPrefix: *maxServersPerPrefix,
+		Total:           *maxServers,
+	}
+	m.StateThresholds = monitor.StateThresholds{
+		DegradedAfter: *degradedAfter,
+		DownAfter:     *downAfter,
+		DelistAfter:   *delistAfter,
+		UpAfter:       *upAfter,
+	}
+	m.RoomListInterval = *roomListInterval
+	m.LeaseTTL = *leaseTTL
+	m.Rendezvous = *rendezvous
+
+	var locators geo.Chain
+	if *geoIPFile != "" {
+		db, err := geo.OpenMMDB(*geoIPFile)
+		if err != nil {
+			log.Error("failed to open GeoIP database", zap.Error(err))
+			return
+		}
+		locators = append(locators, db)
+	}
+	if *cidrMapFile != "" {
+		cidrMap, err := geo.LoadCIDRMap(*cidrMapFile)
+		if err != nil {
+			log.Error("failed to load CIDR map", zap.Error(err))
+			return
+		}
+		locators = append(locators, cidrMap)
+	}
+	if len(locators) > 0 {
+		m.Locator = locators
+	}
+	if *bannedWordsFile != "" {
+		wordFilter, err := monitor.LoadWordFilter(*bannedWordsFile)
+		if err != nil {
+			log.Error("failed to load banned words", zap.Error(err))
+			return
+		}
+		m.ContentFilter = wordFilter
+	}
+	if *compatFile != "" {
+		m.Compatibility, err = version.LoadMatrix(*compatFile)
+		if err != nil {
+			log.Error("failed to load compatibility matrix", zap.Error(err))
+			return
+		}
+	}
+	var operators *operator.Store
+	if *operatorsFile != "" {
+		operators, err = operator.LoadStore(*operatorsFile)
+		if err != nil {
+			log.Error("failed to load operators", zap.Error(err))
+			return
+		}
+		m.Operators = operators
+	}
+	if *dnsVerificationKeyFile != "" {
+		b, err := ioutil.ReadFile(*dnsVerificationKeyFile)
+		if err != nil {
+			log.Error("failed to read DNS verification key", zap.Error(err))
+			return
+		}
+		m.DNSVerifier = monitor.NewDNSVerifier([]byte(strings.TrimSpace(string(b))))
+	}
+	if *historyFile != "" {
+		LoadHistoryFromFile(m, log, *historyFile)
+	}
 	if *backupFile != "" {
 		go LoadFromFile(m, log, *backupFile)
 	}
-	m.AllowSpecialIPs = *allowSpecialIPs
+
+	var adminKey string
+	if *adminKeyFile != "" {
+		b, err := ioutil.ReadFile(*adminKeyFile)
+		if err != nil {
+			log.Error("failed to read admin key", zap.Error(err))
+			return
+		}
+		adminKey = strings.TrimSpace(string(b))
+	}
+
+	if (*peersFile != "" || *primaryFile != "") && *federationName == "" {
+		log.Error("-federationName is required with -peersFile or -primaryFile")
+		return
+	}
+	if *peersFile != "" && *primaryFile != "" {
+		log.Error("a follower can't have peers; use either -peersFile or -primaryFile")
+		return
+	}
+	var fed *federation.Federation
+	if *peersFile != "" {
+		peers, err := federation.LoadPeers(*peersFile)
+		if err != nil {
+			log.Error("failed to load peers", zap.Error(err))
+			return
+		}
+		fed = federation.New(*federationName, peers, m, log)
+	}
+	var follower *federation.Follower
+	if *primaryFile != "" {
+		primary, err := federation.LoadPeer(*primaryFile)
+		if err != nil {
+			log.Error("failed to load primary", zap.Error(err))
+			return
+		}
+		follower = federation.NewFollower(*federationName, primary, m, log, *followerUsesProbeResults)
+
+		// Promote on SIGUSR1 (or via the admin endpoint)
+		promoteCh := make(chan os.Signal, 1)
+		notifyPromoteSignal(promoteCh)
+		go func() {
+			<-promoteCh
+			follower.Promote()
+		}()
+	}
 
 	conn, err := net.ListenPacket("udp", "0.0.0.0:0")
 	if err != nil {
@@ -85,12 +255,44 @@ func main() {
 			return BackupToFile(grpCtx, m, log, *backupFile)
 		})
 	}
+	if *historyFile != "" {
+		grp.Go(func() error {
+			return SaveHistoryToFile(grpCtx, m, log, *historyFile)
+		})
+	}
+	if fed != nil {
+		grp.Go(func() error {
+			return fed.Run(grpCtx)
+		})
+	}
+	if follower != nil {
+		grp.Go(func() error {
+			return follower.Run(grpCtx)
+		})
+	}
 
 	router := mux.NewRouter()
 	api.AddRoutes(router, m, log, *useProxyHeaders)
+	if fed != nil {
+		fed.AddRoutes(router)
+	}
+	if follower != nil {
+		follower.AddRoutes(router, adminKey)
+	}
+	if operators != nil {
+		operators.AddRoutes(router, m, log, adminKey)
+	}
+	if *followersFile != "" {
+		followers, err := federation.LoadPeers(*followersFile)
+		if err != nil {
+			log.Error("failed to load followers", zap.Error(err))
+			return
+		}
+		federation.AddReplicationRoutes(router, followers, m, log)
+	}
 	srv := &http.Server{
 		Handler: router,
-		Addr:    "127.0.0.1:8000",
+		Addr:    *httpAddr,
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
@@ -99,7 +301,7 @@ func main() {
 	go func() {
 		err := grp.Wait()
 		if err != nil && err != context.Canceled {
-			log.Error("error from Send, Receive, or Backup", zap.Error(err))
+			log.Error("error from Send, Receive, Backup, history, federation, or follower", zap.Error(err))
 		}
 		log.Info("errgroup exited; shutting down HTTP server...")
 		srv.Shutdown(ctx)
@@ -113,7 +315,11 @@ func main() {
 }
 
 type BackedUpServer struct {
-	Addr string `json:"addr"`
+	Addr        string                  `json:"addr"`
+	Metadata    *monitor.ServerMetadata `json:"metadata,omitempty"`
+	Operator    string                  `json:"operator,omitempty"`
+	DNSVerified bool                    `json:"dns_verified,omitempty"`
+	Leases      []monitor.LeaseRecord   `json:"leases,omitempty"`
 }
 
 // LoadFromFile restores a backup. Since it resolves each server serially, it can be slow.
@@ -138,7 +344,14 @@ func LoadFromFile(m *monitor.Monitor, log *zap.Logger, path string) {
 			log.Error("failed to unmarshal line", zap.Error(err), zap.Int("lineNo", i+1))
 			break
 		}
-		m.AddServer(b.Addr)
+		reg := &monitor.Registration{Addr: b.Addr, DNSVerified: b.DNSVerified, Leases: b.Leases}
+		if b.Metadata != nil {
+			reg.Metadata = *b.Metadata
+		}
+		if b.Operator != "" {
+			reg.Operator = &monitor.Operator{Name: b.Operator}
+		}
+		m.Restore(reg)
 	}
 	if err := scanner.Err(); err != nil {
 		log.Error("error while reading lines from backup file", zap.Error(err))
@@ -163,10 +376,16 @@ func BackupToFile(ctx context.Context, m *monitor.Monitor, log *zap.Logger, path
 			log.Error("failed to open backup file for writing", zap.String("tempPath", tempPath), zap.Error(err))
 			continue
 		}
-		addrs := m.ListServerAddresses()
-		for _, addr := range addrs {
+		regs := m.ListRegistrations()
+		for _, reg := range regs {
 			b := BackedUpServer{
-				Addr: addr,
+				Addr:        reg.Addr,
+				Metadata:    &reg.Metadata,
+				DNSVerified: reg.DNSVerified,
+				Leases:      reg.Leases,
+			}
+			if reg.Operator != nil {
+				b.Operator = reg.Operator.Name
 			}
 			line, err := json.Marshal(&b)
 			if err != nil {
@@ -187,3 +406,51 @@ func BackupToFile(ctx context.Context, m *monitor.Monitor, log *zap.Logger, path
 		}
 	}
 }
+
+// LoadHistoryFromFile restores the history saved by SaveHistoryToFile.
+func LoadHistoryFromFile(m *monitor.Monitor, log *zap.Logger, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("failed to open history file for loading", zap.Error(err))
+		}
+		return
+	}
+	defer f.Close()
+	if err := m.LoadHistory(f); err != nil {
+		log.Error("failed to load history", zap.Error(err))
+	}
+}
+
+// SaveHistoryToFile periodically saves the history of the servers to a file (safely)
+func SaveHistoryToFile(ctx context.Context, m *monitor.Monitor, log *zap.Logger, path string) error {
+	ticker := time.NewTicker(backupInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		tempPath := fmt.Sprintf(".%s.new%d", path, time.Now().UnixNano())
+		f, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE, 0755)
+		if err != nil {
+			log.Error("failed to open history file for writing", zap.String("tempPath", tempPath), zap.Error(err))
+			continue
+		}
+		if err := m.SaveHistory(f); err != nil {
+			log.Error("failed to save history", zap.Error(err))
+			f.Close()
+			os.Remove(tempPath)
+			continue
+		}
+		if err := f.Close(); err != nil {
+			log.Error("failed to close history file")
+			continue
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			log.Error("failed to move history file from temp location to perm. loc.", zap.Error(err))
+			continue
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Command registrarctl is a client for a registrar. It lists and registers servers, and probes servers
+// directly the same way the registrar does, to help figure out why a server isn't listed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/client"
+	"github.com/conwayste/registrar/monitor"
+)
+
+const usage = `Usage: registrarctl [flags] <command> [command flags] [args]
+
+Commands:
+  list                 list servers on the registrar
+  register host:port   register a server with the registrar
+  remove [host:port]   release the lease of a registration, or with -apiKeyFile, remove one of your servers
+  probe host:port      ping a server directly, as the registrar would, and ask the registrar whether it lists it
+
+Admin commands (require -adminKeyFile):
+  promote              promote a follower registrar to primary
+  operators            list operator accounts
+  add-operator name    create an operator account and print its API key
+  delete-operator name delete an operator account; its servers are no longer verified
+
+Run "registrarctl <command> -h" for the flags of a command.
+
+Flags:
+`
+
+var (
+	registrarURL = flag.String("registrar", "https://registry.conwayste.rs", "base URL of the registrar")
+	httpTimeout  = flag.Duration("httpTimeout", 10*time.Second, "timeout for requests to the registrar")
+	adminKeyFile = flag.String("adminKeyFile", "", "file containing the registrar's admin key, for admin commands")
+	apiKeyFile   = flag.String("apiKeyFile", "", "file containing an operator API key, to register servers as that operator")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(*registrarURL, &http.Client{Timeout: *httpTimeout})
+	if *adminKeyFile != "" && *apiKeyFile != "" {
+		fmt.Fprintln(os.Stderr, "error: -adminKeyFile and -apiKeyFile can't be used together")
+		os.Exit(2)
+	}
+	if *adminKeyFile != "" {
+		b, err := ioutil.ReadFile(*adminKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to read admin key: %v\n", err)
+			os.Exit(1)
+		}
+		c.SetAdminKey(strings.TrimSpace(string(b)))
+	}
+	if *apiKeyFile != "" {
+		b, err := ioutil.ReadFile(*apiKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to read API key: %v\n", err)
+			os.Exit(1)
+		}
+		c.SetAPIKey(strings.TrimSpace(string(b)))
+	}
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch cmd {
+	case "list":
+		err = list(c, args)
+	case "register":
+		err = register(c, args)
+	case "remove":
+		err = remove(c, args)
+	case "probe":
+		err = probe(c, args)
+	case "promote":
+		err = promote(c, args)
+	case "operators":
+		err = listOperators(c, args)
+	case "add-operator":
+		err = addOperator(c, args)
+	case "delete-operator":
+		err = deleteOperator(c, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func list(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "output JSON instead of a table")
+	name := fs.String("name", "", "only show servers whose name contains this (case insensitive)")
+	version := fs.String("version", "", "only show servers with this version")
+	minPlayers := fs.Int("minPlayers", 0, "only show servers with at least this many players")
+	tags := fs.String("tags", "", "only show servers with all of these comma-separated tags")
+	mine := fs.Bool("mine", false, "show the servers registered with -apiKeyFile, including those that are down")
+	fs.Parse(args)
+
+	var servers []*monitor.PublicServerInfo
+	var err error
+	if *mine {
+		servers, err = c.ListOwnServers(context.Background())
+	} else {
+		query := url.Values{}
+		for _, tag := range splitList(*tags) {
+			query.Add("tag", tag)
+		}
+		servers, err = c.ListServers(context.Background(), query)
+	}
+	if err != nil {
+		return err
+	}
+	filtered := []*monitor.PublicServerInfo{}
+	for _, s := range servers {
+		if *name != "" && !strings.Contains(strings.ToLower(s.Name), strings.ToLower(*name)) {
+			continue
+		}
+		if *version != "" && s.Version != *version {
+			continue
+		}
+		if s.Players < *minPlayers {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(filtered)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDR\tNAME\tVERSION\tPLAYERS\tROOMS\tREGION\tTAGS\tVERIFIED\tSTATE\tMISSED PINGS")
+	for _, s := range filtered {
+		players := fmt.Sprint(s.Players)
+		if s.MaxPlayers > 0 {
+			players = fmt.Sprintf("%d/%d", s.Players, s.MaxPlayers)
+		}
+		verified := ""
+		if s.Verified {
+			verified = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%d\n", s.Addr, s.Name, s.Version, players, s.Rooms,
+			s.Region, strings.Join(s.Tags, ","), verified, s.State, s.MissedPings)
+	}
+	return tw.Flush()
+}
+
+func register(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	reqBody := api.AddServerRequestBody{}
+	fs.StringVar(&reqBody.Description, "description", "", "description of the server")
+	tags := fs.String("tags", "", "comma-separated tags")
+	fs.IntVar(&reqBody.MaxPlayers, "maxPlayers", 0, "maximum number of players")
+	fs.StringVar(&reqBody.GameMode, "gameMode", "", "game rules variant")
+	fs.BoolVar(&reqBody.PasswordProtected, "passwordProtected", false, "whether rooms are password protected")
+	fs.StringVar(&reqBody.Website, "website", "", "website URL")
+	fs.StringVar(&reqBody.LeaseID, "leaseID", "", "lease ID from registering the server before, to register it again")
+	fs.StringVar(&reqBody.LeaseSecret, "leaseSecret", "", "lease secret from registering the server before")
+	wait := fs.Duration("wait", 0, "if set, wait up to this long for the server to answer a ping, and fail if it doesn't")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one host:port argument")
+	}
+	reqBody.HostAndPort = fs.Arg(0)
+	reqBody.Tags = splitList(*tags)
+	var lease *api.AddServerResponseBody
+	var err error
+	if *wait > 0 {
+		lease, err = c.RegisterAndWait(context.Background(), &reqBody, *wait)
+	} else {
+		lease, err = c.Register(context.Background(), &reqBody)
+	}
+	if err != nil {
+		return err
+	}
+	if lease.AlreadyRegistered {
+		return fmt.Errorf("already registered by someone else; pass -leaseID and -leaseSecret to register it again")
+	}
+	if *wait == 0 {
+		fmt.Println("registered; the server is listed once it answers a ping from the registrar")
+	}
+	fmt.Printf("lease ID:     %s\nlease secret: %s\n", lease.LeaseID, lease.LeaseSecret)
+	if lease.LeaseTTL > 0 {
+		fmt.Printf("renew within: %ds\n", lease.LeaseTTL)
+	}
+	if *wait > 0 {
+		if lease.Status == nil {
+			return fmt.Errorf("registered, but the server didn't answer: %s", lease.ProbeError)
+		}
+		st := lease.Status
+		fmt.Printf("name:         %s\nversion:      %s\nplayers:      %d\nrooms:        %d\nrtt:          %.1fms\n",
+			st.Name, st.Version, st.Players, st.Rooms, st.RTTMillis)
+	}
+	return nil
+}
+
+func remove(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	leaseID := fs.String("leaseID", "", "lease ID returned when the server was registered")
+	leaseSecret := fs.String("leaseSecret", "", "lease secret returned when the server was registered")
+	fs.Parse(args)
+	var err error
+	switch {
+	case fs.NArg() == 1 && *apiKeyFile != "":
+		err = c.RemoveOwnServer(context.Background(), fs.Arg(0))
+	case fs.NArg() == 0 && *leaseID != "" && *leaseSecret != "":
+		err = c.RemoveServer(context.Background(), *leaseID, *leaseSecret)
+	default:
+		return fmt.Errorf("expected either -leaseID and -leaseSecret, or -apiKeyFile and a host:port argument")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("removed")
+	return nil
+}
+
+func listOperators(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("operators", flag.ExitOnError)
+	fs.Parse(args)
+	operators, err := c.ListOperators(context.Background())
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tMAX SERVERS")
+	for _, o := range operators {
+		maxServers := "unlimited"
+		if o.MaxServers > 0 {
+			maxServers = fmt.Sprint(o.MaxServers)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", o.Name, maxServers)
+	}
+	return tw.Flush()
+}
+
+func addOperator(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("add-operator", flag.ExitOnError)
+	maxServers := fs.Int("maxServers", 0, "the most servers the operator may register; 0 means no limit")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one name argument")
+	}
+	created, err := c.CreateOperator(context.Background(), fs.Arg(0), *maxServers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created operator %s; its API key (which can't be shown again) is:\n%s\n", created.Name, created.APIKey)
+	return nil
+}
+
+func deleteOperator(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("delete-operator", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one name argument")
+	}
+	if err := c.DeleteOperator(context.Background(), fs.Arg(0)); err != nil {
+		return err
+	}
+	fmt.Println("deleted")
+	return nil
+}
+
+func promote(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	fs.Parse(args)
+	if err := c.Promote(context.Background()); err != nil {
+		return err
+	}
+	fmt.Println("promoted; the registrar now accepts registrations")
+	return nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
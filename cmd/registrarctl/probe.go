@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/conwayste/registrar/client"
+	"github.com/conwayste/registrar/monitor"
+)
+
+const maxPacketSize = 1448
+
+// probeResult is the outcome of a single GetStatus sent directly to a server.
+type probeResult struct {
+	Status *monitor.ServerStatus // nil unless a valid reply arrived
+	RTT    time.Duration
+	// Problem explains why there is no Status; empty if there is one
+	Problem string
+}
+
+func probe(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	count := fs.Int("count", 3, "number of pings to send")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for each reply")
+	skipRegistrar := fs.Bool("skipRegistrar", false, "don't ask the registrar whether it lists the server")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one host:port argument")
+	}
+	hostAndPort := fs.Arg(0)
+
+	dst, err := net.ResolveUDPAddr("udp", hostAndPort)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s; the registrar will reject it too: %w", hostAndPort, err)
+	}
+	fmt.Printf("resolved %s to %s\n", hostAndPort, dst)
+	if !dst.IP.IsGlobalUnicast() {
+		fmt.Println("warning: this is not a global unicast IP; the official registrar will reject it")
+	}
+
+	replies := 0
+	for i := 0; i < *count; i++ {
+		result, err := probeOnce(dst, *timeout)
+		if err != nil {
+			return err
+		}
+		if result.Status == nil {
+			fmt.Printf("ping %d: %s\n", i+1, result.Problem)
+			continue
+		}
+		replies++
+		s := result.Status
+		fmt.Printf("ping %d: rtt=%v name=%q version=%q players=%d rooms=%d\n",
+			i+1, result.RTT, s.ServerName, s.ServerVersion, s.PlayerCount, s.RoomCount)
+	}
+	fmt.Printf("%d of %d pings answered\n", replies, *count)
+	if replies == 0 {
+		fmt.Println("the server never answered; check that it is running and that the UDP port is open in any firewall or NAT")
+	}
+
+	if *skipRegistrar {
+		return nil
+	}
+	return printDiagnosis(c, hostAndPort)
+}
+
+// printDiagnosis prints whether the registrar lists a server, and if it doesn't, why.
+func printDiagnosis(c *client.Client, hostAndPort string) error {
+	d, err := c.Diagnosis(context.Background(), hostAndPort)
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		fmt.Println("the registrar does not have this server registered; it must be registered with exactly this host:port")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get the registrar's diagnosis of the server: %w", err)
+	}
+	fmt.Printf("the registrar has this server registered (state: %s, pings sent: %d, replies: %d)\n", d.State,
+		d.PingsSent, d.Replies)
+	if d.Problem == "" {
+		fmt.Println("the registrar lists this server")
+	} else {
+		fmt.Printf("the registrar does not list this server: %s\n", d.Problem)
+	}
+	return nil
+}
+
+// probeOnce sends a GetStatus from a fresh socket and waits for the reply. An error is only returned
+// for local failures; problems with the server are described in the result.
+func probeOnce(dst *net.UDPAddr, timeout time.Duration) (*probeResult, error) {
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	nonce := rand.Uint64()
+	packetBytes, err := monitor.Marshal(&monitor.ServerGetStatus{Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+	sentTime := time.Now()
+	if _, err := conn.Write(packetBytes); err != nil {
+		return nil, fmt.Errorf("failed to send GetStatus: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(sentTime.Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxPacketSize)
+	n, err := conn.Read(buf)
+	rtt := time.Since(sentTime)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Timeout() {
+			return &probeResult{Problem: fmt.Sprintf("no reply within %v", timeout)}, nil
+		}
+		// A connected UDP socket reports ICMP port unreachable as an error here
+		return &probeResult{Problem: fmt.Sprintf("error receiving reply (nothing listening on the port?): %v", err)}, nil
+	}
+
+	var status monitor.ServerStatus
+	if err := monitor.UnmarshalStrict(buf[:n], &status); err != nil {
+		return &probeResult{Problem: fmt.Sprintf("reply is not a valid Status packet (%v): %x", err, buf[:n])}, nil
+	}
+	if status.Nonce != nonce {
+		return &probeResult{Problem: fmt.Sprintf("reply has nonce %d but %d was sent; the registrar ignores such replies", status.Nonce, nonce)}, nil
+	}
+	return &probeResult{Status: &status, RTT: rtt}, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/client"
+	"github.com/conwayste/registrar/fakeserver"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func TestProbeOnce(t *testing.T) {
+	tests := []struct {
+		desc     string
+		behavior fakeserver.Behavior
+		problem  string
+	}{
+		{"well behaved", fakeserver.Behavior{}, ""},
+		{"no reply", fakeserver.Behavior{LossRate: 1}, "no reply"},
+		{"wrong nonce", fakeserver.Behavior{WrongNonceRate: 1}, "nonce"},
+		{"malformed", fakeserver.Behavior{MalformedRate: 1}, "not a valid Status"},
+	}
+	for _, test := range tests {
+		status := monitor.ServerStatus{ServerName: "fake", ServerVersion: "1.0.0"}
+		s, err := fakeserver.Listen("127.0.0.1:0", fakeserver.Config{Status: status, Behavior: test.behavior})
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go s.Serve(ctx, zap.NewNop())
+
+		result, err := probeOnce(s.Addr(), 200*time.Millisecond)
+		cancel()
+		s.Close()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.desc, err)
+		}
+		if test.problem == "" {
+			if result.Status == nil || result.Status.ServerName != "fake" {
+				t.Errorf("%s: expected status, got %+v", test.desc, result)
+			}
+		} else if result.Status != nil || !strings.Contains(result.Problem, test.problem) {
+			t.Errorf("%s: expected problem containing %q, got %+v", test.desc, test.problem, result)
+		}
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	return string(out)
+}
+
+func TestPrintDiagnosis(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	router := mux.NewRouter()
+	api.AddRoutes(router, m, zap.NewNop(), false)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	c := client.New(srv.URL, &http.Client{Timeout: time.Second})
+
+	out := captureStdout(t, func() error { return printDiagnosis(c, "127.0.0.1:2016") })
+	if !strings.Contains(out, "does not have this server registered") {
+		t.Errorf("expected the server not to be registered, got %q", out)
+	}
+
+	// A registered server that hasn't answered yet isn't listed, and the registrar says why
+	if err := m.AddServer("127.0.0.1:2016"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	out = captureStdout(t, func() error { return printDiagnosis(c, "127.0.0.1:2016") })
+	if !strings.Contains(out, "state: pending") || !strings.Contains(out, "does not list this server: ") {
+		t.Errorf("expected the registrar's problem with the pending server, got %q", out)
+	}
+}
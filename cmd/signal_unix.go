@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPromoteSignal arranges for SIGUSR1 to be sent to ch, to promote a follower.
+func notifyPromoteSignal(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+// notifyPromoteSignal does nothing, since Windows has no SIGUSR1; use the admin endpoint instead.
+func notifyPromoteSignal(ch chan<- os.Signal) {
+}
@@ -0,0 +1,205 @@
+// Package codec encodes Go structs in the binary format that netwayste (the Conwayste network library)
+// uses on the wire, which is the format of Rust's bincode with its default (legacy) options: little-endian,
+// fixed-width integers, and a u64 length before each string and vector.
+//
+// The wire format is derived from struct definitions. Fields are encoded in order:
+//
+//   - bool is one byte, 0 or 1
+//   - integers have the width of their Go type (int and uint are 64 bits), unless a tag says otherwise
+//   - floats are IEEE 754
+//   - strings and slices are a length followed by their bytes or elements
+//   - arrays are their elements, without a length
+//   - pointers are options: a 0 byte for nil, or a 1 byte followed by the value
+//   - structs are their fields
+//   - interfaces are enums (see RegisterEnum): a u32 variant number followed by the variant's fields
+//
+// Fields are tuned with `nw` struct tags, whose options are separated by commas:
+//
+//   - "u8", "u16", "u32", "u64", "i8", "i16", "i32" or "i64" sets the width of an integer
+//   - "len=u8" (or another unsigned width) sets the width of the length of a string or slice
+//   - "-" skips the field
+//   - "max=N" caps the value of an integer, or the length of a string or slice (bytes of a string, elements of
+//     a slice)
+//   - "text" requires a string to be valid UTF-8 without control characters
+//
+// The "max" and "text" options are only checked by UnmarshalStrict, which is meant for data from untrusted
+// peers.
+//
+// A struct that is an enum variant has a blank field tagged with its variant number, e.g.
+//
+//	type GetStatus struct {
+//		_     struct{} `nw:"variant=4"`
+//		Nonce uint64
+//	}
+//
+// Marshal and Unmarshal write and check the variant number of such a struct, so that packets, which are
+// variants of netwayste's Packet enum, can be encoded on their own.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnsupportedType = errors.New("type can't be encoded")
+	ErrMalformed       = errors.New("malformed data")
+	ErrWrongVariant    = errors.New("wrong variant")
+	ErrOverflow        = errors.New("value doesn't fit in its encoded width")
+)
+
+// Reasons that data is malformed, given by the Reason of a *DecodeError, along with ErrOverflow for an integer
+// that doesn't fit in the field it is decoded into.
+var (
+	ErrTruncated     = errors.New("data ends too soon")
+	ErrTrailingBytes = errors.New("bytes left after the value")
+	ErrTooLong       = errors.New("too long")
+	ErrInvalidText   = errors.New("not valid UTF-8 text")
+	ErrOutOfRange    = errors.New("value out of range")
+)
+
+// DecodeError describes why data couldn't be decoded. It matches ErrMalformed as well as its Reason with
+// errors.Is.
+type DecodeError struct {
+	Field  string // the name of the field being decoded, if any
+	Offset int    // where in the data the problem was found
+	Reason error  // ErrTruncated, ErrTrailingBytes, ErrTooLong, ErrInvalidText, ErrOutOfRange or ErrOverflow
+	Detail string
+}
+
+func (e *DecodeError) Error() string {
+	s := fmt.Sprintf("%v at offset %d", ErrMalformed, e.Offset)
+	if e.Field != "" {
+		s += " in " + e.Field
+	}
+	s += ": " + e.Reason.Error()
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	return s
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Reason
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+const tagName = "nw"
+
+// width is a number of bytes, and whether the integer is signed.
+type width struct {
+	bytes  int
+	signed bool
+}
+
+var widths = map[string]width{
+	"u8": {1, false}, "u16": {2, false}, "u32": {4, false}, "u64": {8, false},
+	"i8": {1, true}, "i16": {2, true}, "i32": {4, true}, "i64": {8, true},
+}
+
+var defaultLenWidth = width{8, false}
+
+// field is how one field of a struct is encoded.
+type field struct {
+	index    int
+	name     string
+	width    width // zero means the width of the Go type
+	lenWidth width
+	max      uint64 // checked by UnmarshalStrict if hasMax
+	hasMax   bool
+	text     bool
+}
+
+// structInfo is how a struct is encoded. It is derived from the struct's definition once, then cached.
+type structInfo struct {
+	fields     []field
+	hasVariant bool
+	variant    uint32
+}
+
+var structInfos sync.Map // reflect.Type -> *structInfo
+
+func getStructInfo(t reflect.Type) (*structInfo, error) {
+	if info, ok := structInfos.Load(t); ok {
+		return info.(*structInfo), nil
+	}
+	info := &structInfo{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get(tagName)
+		if sf.Name == "_" {
+			if strings.HasPrefix(tag, "variant=") {
+				n, err := strconv.ParseUint(strings.TrimPrefix(tag, "variant="), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%v: bad variant tag %q", t, tag)
+				}
+				info.hasVariant = true
+				info.variant = uint32(n)
+			}
+			continue
+		}
+		if tag == "-" {
+			continue
+		}
+		if sf.PkgPath != "" {
+			return nil, fmt.Errorf("%w: %v has unexported field %s", ErrUnsupportedType, t, sf.Name)
+		}
+		f := field{index: i, name: sf.Name, lenWidth: defaultLenWidth}
+		for _, opt := range strings.Split(tag, ",") {
+			switch {
+			case opt == "":
+			case strings.HasPrefix(opt, "len="):
+				w, ok := widths[strings.TrimPrefix(opt, "len=")]
+				if !ok || w.signed {
+					return nil, fmt.Errorf("%v.%s: bad length width %q", t, sf.Name, opt)
+				}
+				f.lenWidth = w
+			case strings.HasPrefix(opt, "max="):
+				n, err := strconv.ParseUint(strings.TrimPrefix(opt, "max="), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%v.%s: bad max %q", t, sf.Name, opt)
+				}
+				f.max = n
+				f.hasMax = true
+			case opt == "text":
+				if sf.Type.Kind() != reflect.String {
+					return nil, fmt.Errorf("%v.%s: text option on a %v", t, sf.Name, sf.Type)
+				}
+				f.text = true
+			default:
+				w, ok := widths[opt]
+				if !ok {
+					return nil, fmt.Errorf("%v.%s: unknown tag option %q", t, sf.Name, opt)
+				}
+				f.width = w
+			}
+		}
+		info.fields = append(info.fields, f)
+	}
+	actual, _ := structInfos.LoadOrStore(t, info)
+	return actual.(*structInfo), nil
+}
+
+// Variant returns the variant number of an enum variant (see RegisterEnum), which may be a struct or a
+// pointer to one.
+func Variant(v interface{}) (uint32, bool) {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return 0, false
+	}
+	info, err := getStructInfo(t)
+	if err != nil || !info.hasVariant {
+		return 0, false
+	}
+	return info.variant, true
+}
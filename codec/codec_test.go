@@ -0,0 +1,195 @@
+package codec
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type shape interface {
+	isShape()
+}
+
+type circle struct {
+	_      struct{} `nw:"variant=0"`
+	Radius uint16
+}
+
+type square struct {
+	_    struct{} `nw:"variant=1"`
+	Side int8
+}
+
+type nothing struct {
+	_ struct{} `nw:"variant=2"`
+}
+
+func (circle) isShape()  {}
+func (*square) isShape() {}
+func (nothing) isShape() {}
+
+func init() {
+	RegisterEnum((*shape)(nil), circle{}, &square{}, nothing{})
+}
+
+type point struct {
+	X, Y int32
+}
+
+type drawing struct {
+	_       struct{} `nw:"variant=7"`
+	Name    string   `nw:"len=u8"`
+	Origin  point
+	Corner  *point
+	Missing *point
+	Shapes  []shape
+	Counts  []int `nw:"u16"`
+	Pair    [2]bool
+	Raw     []byte
+	Ratio   float32
+	Ignored string `nw:"-"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	d := drawing{
+		Name:   "hi",
+		Origin: point{-1, 2},
+		Corner: &point{3, 4},
+		Shapes: []shape{circle{Radius: 5}, &square{Side: -6}, nothing{}},
+		Counts: []int{7, 65535},
+		Pair:   [2]bool{true, false},
+		Raw:    []byte{0xAB},
+		Ratio:  0.5,
+	}
+	b, err := Marshal(&d)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	expected := "07000000" + // variant
+		"02" + "6869" + // name
+		"ffffffff" + "02000000" + // origin
+		"01" + "03000000" + "04000000" + // corner
+		"00" + // missing
+		"0300000000000000" + "00000000" + "0500" + "01000000" + "fa" + "02000000" + // shapes
+		"0200000000000000" + "0700" + "ffff" + // counts
+		"0100" + // pair
+		"0100000000000000" + "ab" + // raw
+		"0000003f" // ratio
+	if got := hex.EncodeToString(b); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	d.Ignored = "not encoded"
+	var decoded drawing
+	if err := Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	d.Ignored = ""
+	if !reflect.DeepEqual(d, decoded) {
+		t.Errorf("expected %+v, got %+v", d, decoded)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := Marshal(&drawing{Counts: []int{65536}}); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected ErrOverflow for a count too big for u16, got %v", err)
+	}
+	if _, err := Marshal(&drawing{Shapes: []shape{nil}}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected ErrUnsupportedType for a nil enum, got %v", err)
+	}
+	if _, err := Marshal(&struct{ M map[string]int }{}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected ErrUnsupportedType for a map, got %v", err)
+	}
+
+	var c circle
+	if err := Unmarshal([]byte{1, 0, 0, 0, 0, 0}, &c); !errors.Is(err, ErrWrongVariant) {
+		t.Errorf("expected ErrWrongVariant, got %v", err)
+	}
+	if err := Unmarshal([]byte{0, 0, 0, 0, 5}, &c); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for a short packet, got %v", err)
+	}
+	var p struct{ P *point }
+	if err := Unmarshal([]byte{2}, &p); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for a bad option tag, got %v", err)
+	}
+	var s struct{ S string }
+	if err := Unmarshal([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'x'}, &s); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for a huge length, got %v", err)
+	}
+	var small struct {
+		N int8 `nw:"u16"`
+	}
+	var decodeErr *DecodeError
+	err := Unmarshal([]byte{0, 1}, &small)
+	if !errors.Is(err, ErrMalformed) || !errors.Is(err, ErrOverflow) || !errors.As(err, &decodeErr) ||
+		decodeErr.Field != "N" || decodeErr.Offset != 0 {
+		t.Errorf("expected ErrMalformed for a value too big for its field, got %v", err)
+	}
+	var shapes struct{ S []shape }
+	if err := Unmarshal([]byte{1, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0}, &shapes); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for an unknown variant, got %v", err)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	if n, ok := Variant(&square{}); !ok || n != 1 {
+		t.Errorf("expected variant 1, got %d %v", n, ok)
+	}
+	if _, ok := Variant(point{}); ok {
+		t.Error("expected point not to be a variant")
+	}
+}
+
+type limited struct {
+	Name  string `nw:"len=u8,max=5,text"`
+	Count uint16 `nw:"max=10"`
+	Delta int8   `nw:"max=3"`
+	Items []byte `nw:"len=u8,max=2"`
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	valid := []byte{2, 'h', 'i', 10, 0, 0xfd, 1, 0xab}
+	var l limited
+	if err := UnmarshalStrict(valid, &l); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	expected := limited{Name: "hi", Count: 10, Delta: -3, Items: []byte{0xab}}
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("expected %+v, got %+v", expected, l)
+	}
+
+	tests := []struct {
+		desc   string
+		data   []byte
+		reason error
+		field  string
+		offset int
+	}{
+		{"trailing bytes", append(valid[:len(valid):len(valid)], 0), ErrTrailingBytes, "", 8},
+		{"truncated", valid[:len(valid)-1], ErrTruncated, "Items", 6},
+		{"long string", []byte{6, 'a', 'b', 'c', 'd', 'e', 'f', 0, 0, 0, 0}, ErrTooLong, "Name", 0},
+		{"long slice", []byte{0, 0, 0, 0, 3, 1, 2, 3}, ErrTooLong, "Items", 4},
+		{"invalid UTF-8", []byte{2, 0xc3, 0x28, 0, 0, 0, 0}, ErrInvalidText, "Name", 1},
+		{"control character", []byte{2, 'a', '\n', 0, 0, 0, 0}, ErrInvalidText, "Name", 1},
+		{"big count", []byte{0, 11, 0, 0, 0}, ErrOutOfRange, "Count", 1},
+		{"big delta", []byte{0, 0, 0, 4, 0}, ErrOutOfRange, "Delta", 3},
+	}
+	for _, test := range tests {
+		err := UnmarshalStrict(test.data, &limited{})
+		var decodeErr *DecodeError
+		if !errors.Is(err, ErrMalformed) || !errors.Is(err, test.reason) || !errors.As(err, &decodeErr) {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.reason, err)
+			continue
+		}
+		if decodeErr.Field != test.field || decodeErr.Offset != test.offset {
+			t.Errorf("%s: expected field %q at offset %d, got %q at %d", test.desc, test.field, test.offset,
+				decodeErr.Field, decodeErr.Offset)
+		}
+	}
+
+	// Unmarshal doesn't check limits
+	if err := Unmarshal([]byte{2, 'a', '\n', 11, 0, 4, 3, 1, 2, 3, 0}, &l); err != nil {
+		t.Errorf("expected Unmarshal to ignore limits, got %v", err)
+	}
+}
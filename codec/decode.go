@@ -0,0 +1,284 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Unmarshal decodes data into v, which must be a non-nil pointer. If v points to an enum variant, the
+// variant number is checked first, and ErrWrongVariant is returned if it doesn't match. Bytes after the
+// encoded value are ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(&decoder{data: data}, v)
+}
+
+// UnmarshalStrict is like Unmarshal, but also rejects bytes after the encoded value and checks the "max"
+// and "text" options of fields. Data that breaks them gives a *DecodeError.
+func UnmarshalStrict(data []byte, v interface{}) error {
+	d := &decoder{data: data, strict: true}
+	if err := unmarshal(d, v); err != nil {
+		return err
+	}
+	if left := len(d.data) - d.off; left > 0 {
+		return d.errorf(d.off, field{}, ErrTrailingBytes, "%d bytes", left)
+	}
+	return nil
+}
+
+func unmarshal(d *decoder, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("%w: Unmarshal needs a non-nil pointer, got %T", ErrUnsupportedType, v)
+	}
+	rv = rv.Elem()
+	if rv.Kind() == reflect.Struct {
+		info, err := getStructInfo(rv.Type())
+		if err != nil {
+			return err
+		}
+		if info.hasVariant {
+			n, err := d.uint(4)
+			if err != nil {
+				return err
+			}
+			if uint32(n) != info.variant {
+				return ErrWrongVariant
+			}
+		}
+	}
+	return d.value(rv, field{lenWidth: defaultLenWidth})
+}
+
+type decoder struct {
+	data   []byte
+	off    int
+	strict bool
+}
+
+// errorf returns a *DecodeError for a problem found at offset off.
+func (d *decoder) errorf(off int, f field, reason error, format string, args ...interface{}) error {
+	return &DecodeError{Field: f.name, Offset: off, Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.off {
+		return nil, d.errorf(d.off, field{}, ErrTruncated, "%d bytes needed, but only %d left", n,
+			len(d.data)-d.off)
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// uint reads an n-byte little-endian integer.
+func (d *decoder) uint(n int) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for i := n - 1; i >= 0; i-- {
+		x = x<<8 | uint64(b[i])
+	}
+	return x, nil
+}
+
+// length reads the length of a string or slice, which can't be more than the bytes left, or than its max
+// when strict.
+func (d *decoder) length(f field) (int, error) {
+	n, err := d.uint(f.lenWidth.bytes)
+	if err != nil {
+		return 0, err
+	}
+	if d.strict && f.hasMax && n > f.max {
+		return 0, d.errorf(d.off-f.lenWidth.bytes, f, ErrTooLong, "length %d is more than %d", n, f.max)
+	}
+	if n > uint64(len(d.data)-d.off) {
+		return 0, d.errorf(d.off-f.lenWidth.bytes, f, ErrTruncated, "length %d is more than the %d bytes left", n,
+			len(d.data)-d.off)
+	}
+	return int(n), nil
+}
+
+// checkText checks that s is valid UTF-8 without control characters.
+func (d *decoder) checkText(s string, f field) error {
+	if !utf8.ValidString(s) {
+		return d.errorf(d.off-len(s), f, ErrInvalidText, "%q", s)
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return d.errorf(d.off-len(s), f, ErrInvalidText, "control character %U", r)
+		}
+	}
+	return nil
+}
+
+// value reads into v, using the tags of the field it is in (or the defaults for a top-level value).
+func (d *decoder) value(v reflect.Value, f field) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.uint(1)
+		if err != nil {
+			return err
+		}
+		if b > 1 {
+			return d.errorf(d.off-1, f, ErrOutOfRange, "bool is %d", b)
+		}
+		v.SetBool(b == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return d.integer(v, f)
+	case reflect.Float32:
+		x, err := d.uint(4)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(uint32(x))))
+	case reflect.Float64:
+		x, err := d.uint(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(x))
+	case reflect.String:
+		n, err := d.length(f)
+		if err != nil {
+			return err
+		}
+		b, _ := d.take(n)
+		if d.strict && f.text {
+			if err := d.checkText(string(b), f); err != nil {
+				return err
+			}
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		n, err := d.length(f)
+		if err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && f.width.bytes == 0 {
+			b, _ := d.take(n)
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		return d.elements(v, f)
+	case reflect.Array:
+		return d.elements(v, f)
+	case reflect.Ptr:
+		tag, err := d.uint(1)
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case 0:
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		case 1:
+			p := reflect.New(v.Type().Elem())
+			if err := d.value(p.Elem(), f); err != nil {
+				return err
+			}
+			v.Set(p)
+			return nil
+		}
+		return d.errorf(d.off-1, f, ErrOutOfRange, "option tag is %d", tag)
+	case reflect.Struct:
+		info, err := getStructInfo(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, sf := range info.fields {
+			if err := d.value(v.Field(sf.index), sf); err != nil {
+				return err
+			}
+		}
+	case reflect.Interface:
+		e := getEnum(v.Type())
+		if e == nil {
+			return fmt.Errorf("%w: %v is not a registered enum", ErrUnsupportedType, v.Type())
+		}
+		n, err := d.uint(4)
+		if err != nil {
+			return err
+		}
+		vt, ok := e.variants[uint32(n)]
+		if !ok {
+			return d.errorf(d.off-4, f, ErrOutOfRange, "unknown variant %d of %v", n, v.Type())
+		}
+		if vt.Kind() == reflect.Ptr {
+			p := reflect.New(vt.Elem())
+			if err := d.value(p.Elem(), f); err != nil {
+				return err
+			}
+			v.Set(p)
+			return nil
+		}
+		p := reflect.New(vt)
+		if err := d.value(p.Elem(), f); err != nil {
+			return err
+		}
+		v.Set(p.Elem())
+	default:
+		return fmt.Errorf("%w: %v", ErrUnsupportedType, v.Type())
+	}
+	return nil
+}
+
+// integer reads an integer, which must fit in v.
+func (d *decoder) integer(v reflect.Value, f field) error {
+	w := intWidth(v.Type(), f)
+	x, err := d.uint(w.bytes)
+	if err != nil {
+		return err
+	}
+	if w.signed {
+		shift := uint(64 - 8*w.bytes)
+		signed := int64(x<<shift) >> shift // sign-extend
+		if d.strict && f.hasMax && signed > 0 && uint64(signed) > f.max {
+			return d.errorf(d.off-w.bytes, f, ErrOutOfRange, "%d is more than %d", signed, f.max)
+		}
+		if v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64 {
+			if signed < 0 || v.OverflowUint(uint64(signed)) {
+				return d.errorf(d.off-w.bytes, f, ErrOverflow, "%d doesn't fit in %v", signed, v.Type())
+			}
+			v.SetUint(uint64(signed))
+			return nil
+		}
+		if v.OverflowInt(signed) {
+			return d.errorf(d.off-w.bytes, f, ErrOverflow, "%d doesn't fit in %v", signed, v.Type())
+		}
+		v.SetInt(signed)
+		return nil
+	}
+	if d.strict && f.hasMax && x > f.max {
+		return d.errorf(d.off-w.bytes, f, ErrOutOfRange, "%d is more than %d", x, f.max)
+	}
+	if v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64 {
+		if x > math.MaxInt64 || v.OverflowInt(int64(x)) {
+			return d.errorf(d.off-w.bytes, f, ErrOverflow, "%d doesn't fit in %v", x, v.Type())
+		}
+		v.SetInt(int64(x))
+		return nil
+	}
+	if v.OverflowUint(x) {
+		return d.errorf(d.off-w.bytes, f, ErrOverflow, "%d doesn't fit in %v", x, v.Type())
+	}
+	v.SetUint(x)
+	return nil
+}
+
+// elements reads the elements of a slice (already made) or array.
+func (d *decoder) elements(v reflect.Value, f field) error {
+	ef := field{name: f.name, width: f.width, lenWidth: defaultLenWidth}
+	for i := 0; i < v.Len(); i++ {
+		if err := d.value(v.Index(i), ef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Marshal encodes v, which is usually a pointer to a struct. If the struct is an enum variant, its variant
+// number is written first.
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("%w: nil %T", ErrUnsupportedType, v)
+		}
+		rv = rv.Elem()
+	}
+	e := &encoder{}
+	if err := e.variant(rv); err != nil {
+		return nil, err
+	}
+	if err := e.value(rv, field{lenWidth: defaultLenWidth}); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+// variant writes the variant number of v if it is an enum variant.
+func (e *encoder) variant(v reflect.Value) error {
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	info, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+	if info.hasVariant {
+		e.uint(uint64(info.variant), 4)
+	}
+	return nil
+}
+
+// uint writes the low n bytes of x, little-endian.
+func (e *encoder) uint(x uint64, n int) {
+	for i := 0; i < n; i++ {
+		e.buf = append(e.buf, byte(x>>(8*i)))
+	}
+}
+
+func (e *encoder) length(n int, w width) error {
+	if !fitsUnsigned(uint64(n), w.bytes) {
+		return fmt.Errorf("%w: length %d", ErrOverflow, n)
+	}
+	e.uint(uint64(n), w.bytes)
+	return nil
+}
+
+// value writes v, using the tags of the field it is in (or the defaults for a top-level value).
+func (e *encoder) value(v reflect.Value, f field) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		var b uint64
+		if v.Bool() {
+			b = 1
+		}
+		e.uint(b, 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w := intWidth(v.Type(), f)
+		x := v.Int()
+		if (w.signed && !fitsSigned(x, w.bytes)) || (!w.signed && (x < 0 || !fitsUnsigned(uint64(x), w.bytes))) {
+			return fmt.Errorf("%w: %s = %d", ErrOverflow, f.name, x)
+		}
+		e.uint(uint64(x), w.bytes)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w := intWidth(v.Type(), f)
+		x := v.Uint()
+		if (w.signed && (x > math.MaxInt64 || !fitsSigned(int64(x), w.bytes))) || (!w.signed && !fitsUnsigned(x, w.bytes)) {
+			return fmt.Errorf("%w: %s = %d", ErrOverflow, f.name, x)
+		}
+		e.uint(x, w.bytes)
+	case reflect.Float32:
+		e.uint(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.uint(math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		if err := e.length(v.Len(), f.lenWidth); err != nil {
+			return err
+		}
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice:
+		if err := e.length(v.Len(), f.lenWidth); err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && f.width.bytes == 0 {
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		return e.elements(v, f)
+	case reflect.Array:
+		return e.elements(v, f)
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.uint(0, 1)
+			return nil
+		}
+		e.uint(1, 1)
+		return e.value(v.Elem(), f)
+	case reflect.Struct:
+		info, err := getStructInfo(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, sf := range info.fields {
+			if err := e.value(v.Field(sf.index), sf); err != nil {
+				return err
+			}
+		}
+	case reflect.Interface:
+		if getEnum(v.Type()) == nil {
+			return fmt.Errorf("%w: %v is not a registered enum", ErrUnsupportedType, v.Type())
+		}
+		if v.IsNil() {
+			return fmt.Errorf("%w: nil %v in %s", ErrUnsupportedType, v.Type(), f.name)
+		}
+		variant := v.Elem()
+		for variant.Kind() == reflect.Ptr {
+			variant = variant.Elem()
+		}
+		if err := e.variant(variant); err != nil {
+			return err
+		}
+		return e.value(variant, f)
+	default:
+		return fmt.Errorf("%w: %v", ErrUnsupportedType, v.Type())
+	}
+	return nil
+}
+
+// elements writes the elements of a slice or array. A width tag on the field applies to each element.
+func (e *encoder) elements(v reflect.Value, f field) error {
+	ef := field{name: f.name, width: f.width, lenWidth: defaultLenWidth}
+	for i := 0; i < v.Len(); i++ {
+		if err := e.value(v.Index(i), ef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intWidth returns the encoded width of an integer field.
+func intWidth(t reflect.Type, f field) width {
+	if f.width.bytes != 0 {
+		return f.width
+	}
+	signed := t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64
+	if t.Kind() == reflect.Int || t.Kind() == reflect.Uint {
+		return width{8, signed}
+	}
+	return width{int(t.Size()), signed}
+}
+
+func fitsSigned(x int64, n int) bool {
+	if n >= 8 {
+		return true
+	}
+	limit := int64(1) << (8*n - 1)
+	return x >= -limit && x < limit
+}
+
+func fitsUnsigned(x uint64, n int) bool {
+	return n >= 8 || x < uint64(1)<<(8*n)
+}
@@ -0,0 +1,53 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// enum is the variants of an interface type, by variant number.
+type enum struct {
+	variants map[uint32]reflect.Type
+}
+
+var (
+	enumsMu sync.RWMutex
+	enums   = make(map[reflect.Type]*enum) // keyed by interface type
+)
+
+// RegisterEnum lets fields of an interface type be encoded, as one of the given variants. iface is a nil
+// pointer to the interface, e.g. (*Packet)(nil), and each variant is a struct with a variant tag (or a pointer
+// to one) that implements it. A field holding a pointer to a struct is decoded as a pointer if the variant
+// was registered as a pointer.
+func RegisterEnum(iface interface{}, variants ...interface{}) {
+	it := reflect.TypeOf(iface)
+	if it == nil || it.Kind() != reflect.Ptr || it.Elem().Kind() != reflect.Interface {
+		panic(fmt.Sprintf("codec: RegisterEnum needs a nil pointer to an interface, got %T", iface))
+	}
+	it = it.Elem()
+	e := &enum{variants: make(map[uint32]reflect.Type)}
+	for _, v := range variants {
+		vt := reflect.TypeOf(v)
+		if !vt.Implements(it) {
+			panic(fmt.Sprintf("codec: %v does not implement %v", vt, it))
+		}
+		n, ok := Variant(v)
+		if !ok {
+			panic(fmt.Sprintf("codec: %v has no variant tag", vt))
+		}
+		if other, ok := e.variants[n]; ok {
+			panic(fmt.Sprintf("codec: %v and %v are both variant %d", other, vt, n))
+		}
+		e.variants[n] = vt
+	}
+	enumsMu.Lock()
+	defer enumsMu.Unlock()
+	enums[it] = e
+}
+
+func getEnum(t reflect.Type) *enum {
+	enumsMu.RLock()
+	defer enumsMu.RUnlock()
+	return enums[t]
+}
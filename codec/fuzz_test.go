@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func FuzzUnmarshal(f *testing.F) {
+	valid, err := Marshal(&drawing{
+		Name:   "hi",
+		Corner: &point{3, 4},
+		Shapes: []shape{circle{Radius: 5}, &square{Side: -6}, nothing{}},
+		Counts: []int{7},
+		Raw:    []byte{0xAB},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add([]byte{2, 'h', 'i', 10, 0, 0xfd, 1, 0xab})
+	f.Add([]byte{})
+	f.Add([]byte{0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Whatever is wrong with the data, decoding says it is malformed, unless it is another variant
+		var d drawing
+		for _, unmarshal := range []func([]byte, interface{}) error{Unmarshal, UnmarshalStrict} {
+			err := unmarshal(data, &d)
+			if err != nil && !errors.Is(err, ErrMalformed) && !errors.Is(err, ErrWrongVariant) {
+				t.Fatalf("expected ErrMalformed or ErrWrongVariant, got %v", err)
+			}
+		}
+		var small struct {
+			N int8 `nw:"u16"`
+		}
+		if err := Unmarshal(data, &small); err != nil && !errors.Is(err, ErrMalformed) {
+			t.Fatalf("expected ErrMalformed, got %v", err)
+		}
+
+		// Strictly decoded data has a canonical encoding, so it encodes back to the same bytes
+		var l limited
+		if err := UnmarshalStrict(data, &l); err == nil {
+			checkRoundTrip(t, data, &l)
+		}
+		var shapes struct {
+			S []shape `nw:"len=u8,max=4"`
+			P *point
+		}
+		if err := UnmarshalStrict(data, &shapes); err == nil {
+			checkRoundTrip(t, data, &shapes)
+		}
+	})
+}
+
+// checkRoundTrip checks that v, a pointer to a value strictly decoded from data, encodes back to data and
+// decodes again to an equal value.
+func checkRoundTrip(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal %+v: %v", v, err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("decoded %x but encoded %x", data, b)
+	}
+	fresh := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+	if err := UnmarshalStrict(b, fresh); err != nil || !reflect.DeepEqual(fresh, v) {
+		t.Fatalf("expected %+v, got %+v %v", v, fresh, err)
+	}
+}
+
+// FuzzDecodeString fuzzes the decoding of a string, which reads a length from the data and must neither
+// allocate nor read past the data whatever the length claims.
+func FuzzDecodeString(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 0, 0, 0, 0, 0, 'v', 'e', 'r'}, false)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'x'}, false)
+	f.Add([]byte{2, 0, 0, 0, 0, 0, 0, 0, 'a', '\n'}, true)
+	f.Add([]byte{2, 0, 0, 0, 0, 0, 0, 0, 0xc3, 0x28}, true)
+	f.Fuzz(func(t *testing.T, data []byte, strict bool) {
+		var s string
+		d := &decoder{data: data, strict: strict}
+		fld := field{name: "S", lenWidth: defaultLenWidth, max: 16, hasMax: true, text: true}
+		if err := d.value(reflect.ValueOf(&s).Elem(), fld); err != nil {
+			return
+		}
+		if d.off != defaultLenWidth.bytes+len(s) || d.off > len(data) {
+			t.Fatalf("read %d bytes for a string of %d from %d bytes", d.off, len(s), len(data))
+		}
+		if !strict {
+			return
+		}
+		if len(s) > 16 || !utf8.ValidString(s) {
+			t.Fatalf("strict decoding accepted %q", s)
+		}
+		for _, r := range s {
+			if unicode.IsControl(r) {
+				t.Fatalf("strict decoding accepted %q", s)
+			}
+		}
+	})
+}
@@ -0,0 +1,239 @@
+// Package fakeserver imitates the UDP status protocol of Conwayste servers, so that the registrar can be
+// exercised locally without running real servers.
+package fakeserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/conwayste/registrar/monitor"
+
+	"go.uber.org/zap"
+)
+
+const (
+	maxPacketSize     = 1448
+	packetReadTimeout = 500 * time.Millisecond
+	maxRoomsPerPart   = 128 // the most rooms the registrar accepts in a RoomList
+)
+
+// Behavior describes how a fake server misbehaves. The zero value is a perfectly behaved server.
+type Behavior struct {
+	Latency        time.Duration // delay before each reply
+	Jitter         time.Duration // maximum random extra delay before each reply
+	LossRate       float64       // fraction of GetStatus requests that are not answered
+	MalformedRate  float64       // fraction of replies that are garbage instead of a Status
+	WrongNonceRate float64       // fraction of replies that carry a nonce that wasn't sent
+	// FlapPeriod, if non-zero, makes the server alternate between answering and ignoring all requests,
+	// switching every FlapPeriod, starting with answering.
+	FlapPeriod time.Duration
+}
+
+type Config struct {
+	// Status is sent in reply to each GetStatus; its Nonce is replaced by the request's nonce.
+	Status   monitor.ServerStatus
+	Behavior Behavior
+	// Rooms are sent in reply to each GetRoomList, split across as many datagrams as needed. Behavior doesn't
+	// apply to these replies.
+	Rooms []monitor.RoomInfo
+}
+
+// Stats counts packets handled by a Server.
+type Stats struct {
+	Requests         uint64 // GetStatus packets received
+	Replies          uint64 // replies sent, including malformed ones and ones with a wrong nonce
+	RoomListRequests uint64 // GetRoomList packets received
+}
+
+type Server struct {
+	// Counters; accessed atomically, so keep them first for alignment
+	requests         uint64
+	replies          uint64
+	roomListRequests uint64
+
+	conn    net.PacketConn
+	cfg     Config
+	started time.Time
+	rng     *rand.Rand
+	rngMu   sync.Mutex // guards rng
+}
+
+// Listen opens the UDP socket for a fake server at the given address, e.g. "127.0.0.1:0".
+func Listen(addr string, cfg Config) (*Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		conn:    conn,
+		cfg:     cfg,
+		started: time.Now(),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Server) Stats() Stats {
+	return Stats{
+		Requests:         atomic.LoadUint64(&s.requests),
+		Replies:          atomic.LoadUint64(&s.replies),
+		RoomListRequests: atomic.LoadUint64(&s.roomListRequests),
+	}
+}
+
+// Serve answers GetStatus requests until the context is cancelled or the socket fails.
+func (s *Server) Serve(ctx context.Context, log *zap.Logger) error {
+	packetBuf := make([]byte, maxPacketSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := s.conn.SetReadDeadline(time.Now().Add(packetReadTimeout)); err != nil {
+			log.Error("failed to set read timeout", zap.Error(err))
+		}
+		n, addr, err := s.conn.ReadFrom(packetBuf)
+		if n > 0 {
+			s.handle(log, addr, packetBuf[:n])
+		}
+		if err != nil {
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || !opErr.Timeout() {
+				return err
+			}
+		}
+	}
+}
+
+// handle answers a GetStatus or GetRoomList.
+func (s *Server) handle(log *zap.Logger, addr net.Addr, packetBytes []byte) {
+	var getStatus monitor.ServerGetStatus
+	err := monitor.UnmarshalStrict(packetBytes, &getStatus)
+	if errors.Is(err, monitor.ErrWrongVariant) {
+		var getRoomList monitor.ServerGetRoomList
+		if err = monitor.UnmarshalStrict(packetBytes, &getRoomList); err == nil {
+			atomic.AddUint64(&s.roomListRequests, 1)
+			s.replyRooms(log, addr, getRoomList.Nonce)
+			return
+		}
+	}
+	if err != nil {
+		log.Debug("ignoring packet that isn't a GetStatus or GetRoomList", zap.Error(err))
+	} else {
+		atomic.AddUint64(&s.requests, 1)
+		s.reply(log, addr, getStatus.Nonce)
+	}
+}
+
+func (s *Server) reply(log *zap.Logger, addr net.Addr, nonce uint64) {
+	b := s.cfg.Behavior
+	if b.FlapPeriod > 0 && (time.Since(s.started)/b.FlapPeriod)%2 == 1 {
+		return
+	}
+
+	s.rngMu.Lock()
+	lost := s.rng.Float64() < b.LossRate
+	malformed := s.rng.Float64() < b.MalformedRate
+	wrongNonce := s.rng.Float64() < b.WrongNonceRate
+	delay := b.Latency
+	if b.Jitter > 0 {
+		delay += time.Duration(s.rng.Int63n(int64(b.Jitter)))
+	}
+	if wrongNonce {
+		nonce = ^nonce
+	}
+	garbage := make([]byte, 1+s.rng.Intn(32))
+	s.rng.Read(garbage)
+	s.rngMu.Unlock()
+
+	if lost {
+		return
+	}
+	status := s.cfg.Status
+	status.Nonce = nonce
+	packetBytes, err := monitor.Marshal(&status)
+	if err != nil {
+		log.Error("failed to marshal Status", zap.Error(err))
+		return
+	}
+	if malformed {
+		packetBytes = garbage
+	}
+
+	send := func() {
+		if _, err := s.conn.WriteTo(packetBytes, addr); err != nil {
+			log.Debug("failed to send reply", zap.Error(err))
+			return
+		}
+		atomic.AddUint64(&s.replies, 1)
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, send)
+	} else {
+		send()
+	}
+}
+
+// replyRooms sends the configured rooms, in as many parts as needed for each to fit in a datagram.
+func (s *Server) replyRooms(log *zap.Logger, addr net.Addr, nonce uint64) {
+	parts, err := splitRooms(nonce, s.cfg.Rooms)
+	if err != nil {
+		log.Error("failed to split room list", zap.Error(err))
+		return
+	}
+	for _, part := range parts {
+		if _, err := s.conn.WriteTo(part, addr); err != nil {
+			log.Debug("failed to send room list", zap.Error(err))
+			return
+		}
+	}
+}
+
+// splitRooms encodes rooms as RoomList packets, putting as many rooms in each as fit.
+func splitRooms(nonce uint64, rooms []monitor.RoomInfo) ([][]byte, error) {
+	var lists []*monitor.ServerRoomList
+	list := &monitor.ServerRoomList{Nonce: nonce}
+	for _, room := range rooms {
+		list.Rooms = append(list.Rooms, room)
+		b, err := monitor.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxPacketSize || len(list.Rooms) > maxRoomsPerPart {
+			list.Rooms = list.Rooms[:len(list.Rooms)-1]
+			lists = append(lists, list)
+			list = &monitor.ServerRoomList{Nonce: nonce, Rooms: []monitor.RoomInfo{room}}
+		}
+	}
+	lists = append(lists, list)
+	if len(lists) > math.MaxUint8 {
+		return nil, fmt.Errorf("%d rooms need too many parts", len(rooms))
+	}
+	var parts [][]byte
+	for i, list := range lists {
+		list.Part = uint8(i)
+		list.Parts = uint8(len(lists))
+		b, err := monitor.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, b)
+	}
+	return parts, nil
+}
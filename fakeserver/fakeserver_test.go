@@ -0,0 +1,121 @@
+package fakeserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/conwayste/registrar/monitor"
+
+	"go.uber.org/zap"
+)
+
+func startServer(t *testing.T, cfg Config) (*Server, context.CancelFunc) {
+	t.Helper()
+	s, err := Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Serve(ctx, zap.NewNop())
+	return s, func() {
+		cancel()
+		s.Close()
+	}
+}
+
+// ping sends a GetStatus to the server and returns the reply, or nil if there was none.
+func ping(t *testing.T, s *Server, nonce uint64) []byte {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, s.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	packetBytes, err := monitor.Marshal(&monitor.ServerGetStatus{Nonce: nonce})
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	if _, err := conn.Write(packetBytes); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, maxPacketSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestServerRepliesWithStatus(t *testing.T) {
+	cfg := Config{Status: monitor.ServerStatus{ServerName: "fake", ServerVersion: "1.2.3", PlayerCount: 4, RoomCount: 2}}
+	s, stop := startServer(t, cfg)
+	defer stop()
+
+	reply := ping(t, s, 42)
+	var status monitor.ServerStatus
+	if err := monitor.Unmarshal(reply, &status); err != nil {
+		t.Fatalf("failed to unmarshal reply: %v", err)
+	}
+	expected := cfg.Status
+	expected.Nonce = 42
+	if status != expected {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+	if stats := s.Stats(); stats != (Stats{Requests: 1, Replies: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestServerMisbehaves(t *testing.T) {
+	s, stop := startServer(t, Config{Behavior: Behavior{LossRate: 1}})
+	defer stop()
+	if reply := ping(t, s, 42); reply != nil {
+		t.Errorf("expected no reply from lossy server, got %v", reply)
+	}
+
+	s, stop = startServer(t, Config{Behavior: Behavior{WrongNonceRate: 1}})
+	defer stop()
+	var status monitor.ServerStatus
+	if err := monitor.Unmarshal(ping(t, s, 42), &status); err != nil {
+		t.Fatalf("failed to unmarshal reply: %v", err)
+	}
+	if status.Nonce == 42 {
+		t.Error("expected wrong nonce")
+	}
+}
+
+func TestSplitRooms(t *testing.T) {
+	var rooms []monitor.RoomInfo
+	for i := 0; i < 300; i++ {
+		rooms = append(rooms, monitor.RoomInfo{Name: fmt.Sprintf("room %d with a fairly long name", i), Capacity: 8})
+	}
+	parts, err := splitRooms(42, rooms)
+	if err != nil {
+		t.Fatalf("failed to split: %v", err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %d", len(parts))
+	}
+	var got []monitor.RoomInfo
+	for i, part := range parts {
+		if len(part) > maxPacketSize {
+			t.Errorf("part %d is %d bytes", i, len(part))
+		}
+		var roomList monitor.ServerRoomList
+		if err := monitor.UnmarshalStrict(part, &roomList); err != nil {
+			t.Fatalf("failed to decode part %d: %v", i, err)
+		}
+		if roomList.Nonce != 42 || int(roomList.Part) != i || int(roomList.Parts) != len(parts) {
+			t.Errorf("unexpected part %d: %+v", i, roomList)
+		}
+		got = append(got, roomList.Rooms...)
+	}
+	if !reflect.DeepEqual(got, rooms) {
+		t.Errorf("expected the rooms back in order, got %d rooms", len(got))
+	}
+}
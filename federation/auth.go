@@ -0,0 +1,63 @@
+package federation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every request between peers carries the sender's name, the time it was sent, and an HMAC-SHA256, keyed
+// with the key shared by the two peers, of the method, path, time, and body. Requests whose time is
+// too far from the receiver's clock are rejected, to limit replays.
+const (
+	peerHeader      = "X-Registrar-Peer"
+	timestampHeader = "X-Registrar-Timestamp"
+	signatureHeader = "X-Registrar-Signature"
+	maxClockSkew    = 5 * time.Minute
+)
+
+var (
+	ErrUnknownPeer  = errors.New("unknown peer")
+	ErrBadTimestamp = errors.New("missing or expired timestamp")
+	ErrBadSignature = errors.New("bad signature")
+)
+
+func signature(key, method, path, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func signRequest(req *http.Request, name, key string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(peerHeader, name)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, hex.EncodeToString(signature(key, req.Method, req.URL.Path, timestamp, body)))
+}
+
+// verifyRequest checks the signature of a request from one of peers, and returns the peer.
+func verifyRequest(req *http.Request, peers map[string]PeerConfig, body []byte, now time.Time) (PeerConfig, error) {
+	peer, ok := peers[req.Header.Get(peerHeader)]
+	if !ok {
+		return PeerConfig{}, ErrUnknownPeer
+	}
+	timestamp := req.Header.Get(timestampHeader)
+	unixSecs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return PeerConfig{}, ErrBadTimestamp
+	}
+	skew := now.Sub(time.Unix(unixSecs, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return PeerConfig{}, ErrBadTimestamp
+	}
+	gotSig, err := hex.DecodeString(req.Header.Get(signatureHeader))
+	if err != nil || !hmac.Equal(gotSig, signature(peer.Key, req.Method, req.URL.Path, timestamp, body)) {
+		return PeerConfig{}, ErrBadSignature
+	}
+	return peer, nil
+}
@@ -0,0 +1,501 @@
+// Package federation replicates registrations between registrars, so that there is no single point of
+// failure. Each registrar pings every server itself; they only share registrations and what they see.
+//
+// The rules for merging are:
+//
+//   - A registration is identified by the host:port it was registered with.
+//   - Each registration records the last time any registrar accepted it (RegisteredAt), and the last time
+//     any registrar delisted it for missing too many pings (DelistedAt). Merging takes the latest of each.
+//   - A registration is live if RegisteredAt is after DelistedAt. Since servers re-register periodically,
+//     a server delisted by one registrar is revived everywhere once it re-registers with any of them.
+//   - A live registration carries its Record (metadata, operator, verification and leases), so that only
+//     its registrant may register it again with any registrar. The metadata, operator and verification of
+//     the latest registration win; leases are merged, keeping the latest expiry of each. A Record also
+//     carries the leases its server released (or dropped otherwise) in the last tombstoneTTL, which are
+//     merged too, and dropped from the merged leases, so that a released lease isn't brought back by a peer
+//     that still has it.
+//   - A server that fails to be added to the Monitor (e.g. its host name didn't resolve) is retried on
+//     each Sync while its registration is live.
+//   - Delisted registrations are forgotten after tombstoneTTL.
+//   - The server list served by a registrar includes servers that are down locally but were seen up by a
+//     peer, as long as they are registered, and not flapping, locally (see monitor.SetRemoteServers).
+//
+// Peers authenticate every request with a key shared between each pair of registrars (see auth.go).
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/conwayste/registrar/monitor"
+
+	"go.uber.org/zap"
+)
+
+const (
+	syncInterval     = 30 * time.Second // How often the full state is pulled from each peer
+	tombstoneTTL     = 24 * time.Hour   // How long a delisted registration is remembered
+	maxStateBodySize = 50 * 1024 * 1024
+	peerTimeout      = 10 * time.Second
+)
+
+// PeerConfig describes another registrar.
+type PeerConfig struct {
+	// Name identifies the peer; it must match the name the peer was started with
+	Name string `json:"name"`
+	// URL is the base URL of the peer's HTTP API, e.g. "https://registry2.example.com"
+	URL string `json:"url"`
+	// Key is the secret shared by this registrar and the peer
+	Key string `json:"key"`
+}
+
+// LoadPeers reads a JSON array of PeerConfigs from a file.
+func LoadPeers(path string) ([]PeerConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var peers []PeerConfig
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse peers file: %w", err)
+	}
+	for _, p := range peers {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return peers, nil
+}
+
+// LoadPeer reads a single JSON PeerConfig from a file.
+func LoadPeer(path string) (PeerConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PeerConfig{}, err
+	}
+	var peer PeerConfig
+	if err := json.Unmarshal(b, &peer); err != nil {
+		return PeerConfig{}, fmt.Errorf("failed to parse peer file: %w", err)
+	}
+	return peer, peer.validate()
+}
+
+func (p PeerConfig) validate() error {
+	if p.Name == "" || p.URL == "" || p.Key == "" {
+		return fmt.Errorf("peer %q must have a name, url and key", p.Name)
+	}
+	return nil
+}
+
+type Registration struct {
+	Addr         string    `json:"addr"`
+	RegisteredAt time.Time `json:"registered_at"`
+	DelistedAt   time.Time `json:"delisted_at"`
+	// Record is the full registration as of RegisteredAt; nil if unknown, e.g. from an older peer
+	Record *Record `json:"record,omitempty"`
+}
+
+// Record is what the Monitor knows about a registration, besides its address.
+type Record struct {
+	Metadata    monitor.ServerMetadata `json:"metadata"`
+	Operator    string                 `json:"operator,omitempty"`
+	DNSVerified bool                   `json:"dns_verified,omitempty"`
+	Leases      []monitor.LeaseRecord  `json:"leases,omitempty"`
+	// ReleasedLeases are the leases the server dropped before they expired; nil from an older peer
+	ReleasedLeases []monitor.ReleasedLease `json:"released_leases,omitempty"`
+}
+
+// NewRecord returns the Record of a Monitor registration.
+func NewRecord(reg *monitor.Registration) *Record {
+	rec := &Record{Metadata: reg.Metadata, DNSVerified: reg.DNSVerified, Leases: reg.Leases,
+		ReleasedLeases: reg.ReleasedLeases}
+	if reg.Operator != nil {
+		rec.Operator = reg.Operator.Name
+	}
+	return rec
+}
+
+// Registration returns the Monitor registration of a server with this Record.
+func (rec *Record) Registration(serverAddr string) *monitor.Registration {
+	reg := &monitor.Registration{Addr: serverAddr, Metadata: rec.Metadata, DNSVerified: rec.DNSVerified,
+		Leases: rec.Leases, ReleasedLeases: rec.ReleasedLeases}
+	if rec.Operator != "" {
+		reg.Operator = &monitor.Operator{Name: rec.Operator}
+	}
+	return reg
+}
+
+// replicatedBy returns whether replicating rec over other would change nothing: they have the same metadata,
+// operator and verification, and the same leases, each claimed alike and expiring no earlier in other.
+func (rec *Record) replicatedBy(other *Record) bool {
+	if rec.Operator != other.Operator || rec.DNSVerified != other.DNSVerified ||
+		!reflect.DeepEqual(rec.Metadata, other.Metadata) || len(rec.Leases) != len(other.Leases) {
+		return false
+	}
+	otherLeases := make(map[string]monitor.LeaseRecord, len(other.Leases))
+	for _, o := range other.Leases {
+		otherLeases[o.ID] = o
+	}
+	for _, l := range rec.Leases {
+		o, ok := otherLeases[l.ID]
+		if !ok || o.Claimed != l.Claimed {
+			return false
+		}
+		if !o.ExpiresAt.IsZero() && (l.ExpiresAt.IsZero() || l.ExpiresAt.After(o.ExpiresAt)) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyRecord returns a copy of rec that shares nothing with it that merging changes.
+func copyRecord(rec *Record) *Record {
+	c := *rec
+	c.Leases = append([]monitor.LeaseRecord(nil), rec.Leases...)
+	c.ReleasedLeases = append([]monitor.ReleasedLease(nil), rec.ReleasedLeases...)
+	return &c
+}
+
+// mergeLeases merges the leases of other into those of rec, keeping the latest expiry of each, and the
+// released leases of other into those of rec, dropping the released leases from rec's leases. Released
+// leases are forgotten after tombstoneTTL. It returns whether any leases were added, extended or dropped.
+func (rec *Record) mergeLeases(other *Record) bool {
+	changed := false
+	released := make(map[string]bool)
+	kept := rec.ReleasedLeases[:0]
+	for _, r := range append(rec.ReleasedLeases, other.ReleasedLeases...) {
+		if released[r.ID] || time.Since(r.ReleasedAt) > tombstoneTTL {
+			continue
+		}
+		released[r.ID] = true
+		kept = append(kept, r)
+	}
+	rec.ReleasedLeases = kept
+	leases := rec.Leases[:0]
+	for _, l := range rec.Leases {
+		if released[l.ID] {
+			changed = true
+			continue
+		}
+		leases = append(leases, l)
+	}
+	rec.Leases = leases
+	for _, o := range other.Leases {
+		if released[o.ID] {
+			continue
+		}
+		i := 0
+		for i < len(rec.Leases) && rec.Leases[i].ID != o.ID {
+			i++
+		}
+		switch {
+		case i == len(rec.Leases):
+			rec.Leases = append(rec.Leases, o)
+			changed = true
+		case rec.Leases[i].ExpiresAt.IsZero():
+		case o.ExpiresAt.IsZero() || o.ExpiresAt.After(rec.Leases[i].ExpiresAt):
+			rec.Leases[i].ExpiresAt = o.ExpiresAt
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (r *Registration) Live() bool {
+	return r.RegisteredAt.After(r.DelistedAt)
+}
+
+// State is what a registrar shares with its peers.
+type State struct {
+	Registrations []Registration `json:"registrations"`
+	// Servers are the servers that are up, according to the sender's own pings
+	Servers []*monitor.PublicServerInfo `json:"servers"`
+}
+
+type Federation struct {
+	name   string
+	peers  map[string]PeerConfig // by name
+	m      *monitor.Monitor
+	log    *zap.Logger
+	client *http.Client
+
+	mu            sync.Mutex
+	registrations map[string]*Registration // guarded by mu
+	// unrestored are the live registrations that failed to be added to the Monitor; guarded by mu
+	unrestored map[string]struct{}
+}
+
+// New returns a Federation for the registrar with the given name, and makes it the Listener of m so that
+// local registrations and delistings are pushed to peers.
+func New(name string, peers []PeerConfig, m *monitor.Monitor, log *zap.Logger) *Federation {
+	f := &Federation{
+		name:          name,
+		peers:         make(map[string]PeerConfig),
+		m:             m,
+		log:           log.With(zap.String("federationName", name)),
+		client:        &http.Client{Timeout: peerTimeout},
+		registrations: make(map[string]*Registration),
+		unrestored:    make(map[string]struct{}),
+	}
+	for _, p := range peers {
+		f.peers[p.Name] = p
+	}
+	m.Listener = f
+	return f
+}
+
+// ServerRegistered satisfies monitor.RegistrationListener.
+func (f *Federation) ServerRegistered(serverAddr string) {
+	var rec *Record
+	if mreg, ok := f.m.LookupRegistration(serverAddr); ok {
+		rec = NewRecord(mreg)
+	}
+	f.mu.Lock()
+	reg := f.registrationLocked(serverAddr)
+	reg.RegisteredAt = time.Now()
+	reg.Record = rec
+	regCopy := *reg
+	f.mu.Unlock()
+	go f.push([]Registration{regCopy})
+}
+
+// ServersDelisted satisfies monitor.RegistrationListener.
+func (f *Federation) ServersDelisted(serverAddrs []string) {
+	regs := make([]Registration, 0, len(serverAddrs))
+	f.mu.Lock()
+	for _, serverAddr := range serverAddrs {
+		reg := f.registrationLocked(serverAddr)
+		reg.DelistedAt = time.Now()
+		regs = append(regs, *reg)
+	}
+	f.mu.Unlock()
+	go f.push(regs)
+}
+
+func (f *Federation) registrationLocked(serverAddr string) *Registration {
+	reg, ok := f.registrations[serverAddr]
+	if !ok {
+		reg = &Registration{Addr: serverAddr}
+		f.registrations[serverAddr] = reg
+	}
+	return reg
+}
+
+// Registrations returns a copy of all known registrations, including delisted ones. The Records of live
+// registrations are refreshed from the Monitor first, so that they have the latest lease expiries.
+func (f *Federation) Registrations() []Registration {
+	records := make(map[string]*Record)
+	for _, mreg := range f.m.ListRegistrations() {
+		records[mreg.Addr] = NewRecord(mreg)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	regs := make([]Registration, 0, len(f.registrations))
+	for serverAddr, reg := range f.registrations {
+		if rec := records[serverAddr]; rec != nil && reg.Live() {
+			if reg.Record != nil {
+				rec.mergeLeases(reg.Record)
+			}
+			reg.Record = rec
+		}
+		regCopy := *reg
+		if reg.Record != nil {
+			regCopy.Record = copyRecord(reg.Record)
+		}
+		regs = append(regs, regCopy)
+	}
+	return regs
+}
+
+// Merge merges registrations from a peer, then registers or delists servers in the Monitor whose
+// registrations became live or were delisted, or whose Records changed, as a result.
+func (f *Federation) Merge(regs []Registration) {
+	toAdd := make(map[string]*monitor.Registration)
+	var toRemove []string
+	f.mu.Lock()
+	for _, incoming := range regs {
+		reg, existed := f.registrations[incoming.Addr]
+		if !existed {
+			reg = &Registration{Addr: incoming.Addr}
+			f.registrations[incoming.Addr] = reg
+		}
+		wasLive := reg.Live()
+		recordChanged := false
+		if incoming.RegisteredAt.After(reg.RegisteredAt) {
+			reg.RegisteredAt = incoming.RegisteredAt
+			if incoming.Record != nil {
+				rec := copyRecord(incoming.Record)
+				if reg.Record != nil {
+					rec.mergeLeases(reg.Record)
+				}
+				reg.Record = rec
+				recordChanged = true
+			}
+		} else if incoming.Record != nil && reg.Record != nil {
+			recordChanged = reg.Record.mergeLeases(incoming.Record)
+		}
+		if incoming.DelistedAt.After(reg.DelistedAt) {
+			reg.DelistedAt = incoming.DelistedAt
+		}
+		switch {
+		case reg.Live() && (!existed || !wasLive || recordChanged):
+			toAdd[reg.Addr] = reg.monitorRegistration()
+		case !reg.Live() && (!existed || wasLive):
+			delete(f.unrestored, reg.Addr)
+			toRemove = append(toRemove, reg.Addr)
+		}
+	}
+	f.mu.Unlock()
+
+	f.restore(toAdd)
+	for _, serverAddr := range toRemove {
+		f.m.RemoveServer(serverAddr)
+	}
+}
+
+// monitorRegistration returns the Monitor registration to restore for a live registration.
+func (reg *Registration) monitorRegistration() *monitor.Registration {
+	if reg.Record == nil {
+		return &monitor.Registration{Addr: reg.Addr}
+	}
+	return reg.Record.Registration(reg.Addr)
+}
+
+// restore adds or updates servers in the Monitor, and remembers those that failed so that the next Sync
+// retries them. It must be called without mu held, since it resolves host names.
+func (f *Federation) restore(regs map[string]*monitor.Registration) {
+	for serverAddr, mreg := range regs {
+		err := f.m.Restore(mreg)
+		f.mu.Lock()
+		if err != nil {
+			f.unrestored[serverAddr] = struct{}{}
+		} else {
+			delete(f.unrestored, serverAddr)
+		}
+		f.mu.Unlock()
+		if err != nil {
+			f.log.Info("failed to add server registered by peer", zap.String("serverAddr", serverAddr), zap.Error(err))
+		}
+	}
+}
+
+// retryUnrestored tries again to add the live registrations that failed to be added to the Monitor.
+func (f *Federation) retryUnrestored() {
+	toAdd := make(map[string]*monitor.Registration)
+	f.mu.Lock()
+	for serverAddr := range f.unrestored {
+		if reg := f.registrations[serverAddr]; reg != nil && reg.Live() {
+			toAdd[serverAddr] = reg.monitorRegistration()
+		} else {
+			delete(f.unrestored, serverAddr)
+		}
+	}
+	f.mu.Unlock()
+	f.restore(toAdd)
+}
+
+// forgetOldTombstones deletes registrations that were delisted more than tombstoneTTL ago.
+func (f *Federation) forgetOldTombstones() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for serverAddr, reg := range f.registrations {
+		if !reg.Live() && time.Since(reg.DelistedAt) > tombstoneTTL {
+			delete(f.registrations, serverAddr)
+		}
+	}
+}
+
+// State returns the state to share with peers.
+func (f *Federation) State() *State {
+	return &State{
+		Registrations: f.Registrations(),
+		Servers:       f.m.ListLocalServers(false),
+	}
+}
+
+// Run pulls the state of every peer every syncInterval until the context is cancelled.
+func (f *Federation) Run(ctx context.Context) error {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		f.Sync(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync pulls and merges the state of every peer once.
+func (f *Federation) Sync(ctx context.Context) {
+	for _, peer := range f.peers {
+		log := f.log.With(zap.String("peer", peer.Name))
+		var state State
+		if err := f.do(ctx, peer, http.MethodGet, statePath, nil, &state); err != nil {
+			log.Warn("failed to get state from peer", zap.Error(err))
+			continue
+		}
+		f.Merge(state.Registrations)
+		f.m.SetRemoteServers(peer.Name, state.Servers)
+	}
+	f.retryUnrestored()
+	f.forgetOldTombstones()
+}
+
+// push sends registrations to every peer. Failures are only logged, since the next Sync fixes them.
+func (f *Federation) push(regs []Registration) {
+	ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+	defer cancel()
+	body := &State{Registrations: regs}
+	for _, peer := range f.peers {
+		if err := f.do(ctx, peer, http.MethodPost, registrationsPath, body, nil); err != nil {
+			f.log.Warn("failed to push registrations to peer", zap.String("peer", peer.Name), zap.Error(err))
+		}
+	}
+}
+
+// do sends a signed request to a peer, with reqBody (if not nil) as JSON, and unmarshals the response
+// into respBody (if not nil).
+func (f *Federation) do(ctx context.Context, peer PeerConfig, method, path string, reqBody, respBody interface{}) error {
+	var reqBytes []byte
+	if reqBody != nil {
+		var err error
+		if reqBytes, err = json.Marshal(reqBody); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, peer.URL+path, bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	signRequest(req, f.name, peer.Key, reqBytes, time.Now())
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStateBodySize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer responded with %d: %s", resp.StatusCode, respBytes)
+	}
+	if respBody != nil {
+		return json.Unmarshal(respBytes, respBody)
+	}
+	return nil
+}
+
+var _ monitor.RegistrationListener = (*Federation)(nil)
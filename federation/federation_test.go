@@ -0,0 +1,317 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/fakeserver"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+type testRegistrar struct {
+	m   *monitor.Monitor
+	f   *Federation
+	srv *httptest.Server
+}
+
+// startRegistrars starts registrars on localhost, each of which peers with all of the others.
+func startRegistrars(t *testing.T, names ...string) map[string]*testRegistrar {
+	t.Helper()
+	registrars := make(map[string]*testRegistrar)
+	routers := make(map[string]*mux.Router)
+	for _, name := range names {
+		router := mux.NewRouter()
+		srv := httptest.NewServer(router)
+		t.Cleanup(srv.Close)
+		routers[name] = router
+		registrars[name] = &testRegistrar{srv: srv}
+	}
+	for _, name := range names {
+		var peers []PeerConfig
+		for _, peerName := range names {
+			if peerName != name {
+				peers = append(peers, PeerConfig{Name: peerName, URL: registrars[peerName].srv.URL, Key: pairKey(name, peerName)})
+			}
+		}
+		r := registrars[name]
+		r.m = monitor.NewMonitor()
+		r.m.AllowSpecialIPs = true
+		r.f = New(name, peers, r.m, zap.NewNop())
+		r.f.AddRoutes(routers[name])
+	}
+	return registrars
+}
+
+func pairKey(a, b string) string {
+	pair := []string{a, b}
+	sort.Strings(pair)
+	return "key-" + strings.Join(pair, "-")
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func isRegistered(m *monitor.Monitor, serverAddr string) bool {
+	for _, addr := range m.ListServerAddresses() {
+		if addr == serverAddr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegistrationAndDelistingPropagate(t *testing.T) {
+	registrars := startRegistrars(t, "a", "b", "c")
+	const serverAddr = "127.0.0.1:2016"
+
+	if err := registrars["a"].m.AddServer(serverAddr); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	for _, name := range []string{"b", "c"} {
+		waitFor(t, "registration to reach "+name, func() bool { return isRegistered(registrars[name].m, serverAddr) })
+	}
+
+	// b delists it, which should delist it everywhere
+	registrars["b"].m.RemoveServer(serverAddr)
+	registrars["b"].f.ServersDelisted([]string{serverAddr})
+	for _, name := range []string{"a", "c"} {
+		waitFor(t, "delisting to reach "+name, func() bool { return !isRegistered(registrars[name].m, serverAddr) })
+	}
+
+	// Re-registering with c revives it everywhere
+	time.Sleep(time.Millisecond) // so that RegisteredAt is after DelistedAt even on coarse clocks
+	if err := registrars["c"].m.AddServer(serverAddr); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		waitFor(t, "re-registration to reach "+name, func() bool { return isRegistered(registrars[name].m, serverAddr) })
+	}
+}
+
+func TestMergeKeepsLatestTimestamps(t *testing.T) {
+	registrars := startRegistrars(t, "a")
+	f := registrars["a"].f
+	t0 := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	const serverAddr = "127.0.0.1:2016"
+
+	f.Merge([]Registration{{Addr: serverAddr, RegisteredAt: t0.Add(time.Minute)}})
+	f.Merge([]Registration{{Addr: serverAddr, RegisteredAt: t0, DelistedAt: t0.Add(30 * time.Second)}})
+	regs := f.Registrations()
+	expected := Registration{Addr: serverAddr, RegisteredAt: t0.Add(time.Minute), DelistedAt: t0.Add(30 * time.Second)}
+	if len(regs) == 1 {
+		regs[0].Record = nil // refreshed from the Monitor
+	}
+	if len(regs) != 1 || regs[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, regs)
+	}
+	if !isRegistered(registrars["a"].m, serverAddr) {
+		t.Error("expected live registration to be in the monitor")
+	}
+
+	// A stale tombstone must not delist; a newer one must
+	f.Merge([]Registration{{Addr: serverAddr, DelistedAt: t0.Add(45 * time.Second)}})
+	if !isRegistered(registrars["a"].m, serverAddr) {
+		t.Error("expected stale tombstone to be ignored")
+	}
+	f.Merge([]Registration{{Addr: serverAddr, DelistedAt: t0.Add(2 * time.Minute)}})
+	if isRegistered(registrars["a"].m, serverAddr) {
+		t.Error("expected newer tombstone to delist")
+	}
+}
+
+func TestSyncServesPeersView(t *testing.T) {
+	registrars := startRegistrars(t, "a", "b")
+
+	// Only a pings, so only a sees the server up
+	s, err := fakeserver.Listen("127.0.0.1:0", fakeserver.Config{Status: monitor.ServerStatus{ServerName: "fake"}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, zap.NewNop())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	a := registrars["a"]
+	a.m.PingInterval = 10 * time.Millisecond
+	go a.m.Send(ctx, zap.NewNop(), conn)
+	go a.m.Receive(ctx, zap.NewNop(), conn)
+
+	serverAddr := s.Addr().String()
+	if err := a.m.AddServer(serverAddr); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	waitFor(t, "server to be up at a", func() bool { return len(a.m.ListLocalServers(false)) == 1 })
+
+	b := registrars["b"]
+	waitFor(t, "registration to reach b", func() bool { return isRegistered(b.m, serverAddr) })
+	if len(b.m.ListServers(false)) != 0 {
+		t.Fatal("expected b not to list the server before syncing")
+	}
+	b.f.Sync(ctx)
+	servers := b.m.ListServers(false)
+	if len(servers) != 1 || servers[0].Name != "fake" {
+		t.Errorf("expected b to list a's view of the server, got %+v", servers)
+	}
+}
+
+func TestUnauthenticatedRequestsAreRejected(t *testing.T) {
+	registrars := startRegistrars(t, "a", "b")
+	a := registrars["a"]
+
+	resp, err := http.Get(a.srv.URL + statePath)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unsigned request, got %d", resp.StatusCode)
+	}
+
+	wrongKey := PeerConfig{Name: "a", URL: a.srv.URL, Key: "wrong"}
+	impostor := New("b", []PeerConfig{wrongKey}, monitor.NewMonitor(), zap.NewNop())
+	var state State
+	err = impostor.do(context.Background(), wrongKey, http.MethodGet, statePath, nil, &state)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 for wrong key, got %v", err)
+	}
+}
+
+func TestFullRegistrationPropagates(t *testing.T) {
+	registrars := startRegistrars(t, "a", "b")
+	const serverAddr = "127.0.0.1:2016"
+
+	md := monitor.ServerMetadata{Description: "replicated", Tags: []string{"eu"}}
+	lease, err := registrars["a"].m.Register(&monitor.Registration{Addr: serverAddr, Metadata: md})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	b := registrars["b"].m
+	waitFor(t, "registration to reach b", func() bool { return isRegistered(b, serverAddr) })
+	reg, _ := b.LookupRegistration(serverAddr)
+	if reg.Metadata.Description != "replicated" || len(reg.Leases) != 1 || reg.Leases[0].ID != lease.ID {
+		t.Errorf("expected the full registration to be replicated, got %+v", reg)
+	}
+
+	// Only the registrant may register the server again with the peer
+	if _, err := b.Register(&monitor.Registration{Addr: serverAddr}); !errors.Is(err, monitor.ErrAlreadyRegistered) {
+		t.Errorf("expected ErrAlreadyRegistered, got %v", err)
+	}
+	if _, err := b.RenewLease(lease.ID, lease.Secret); err != nil {
+		t.Errorf("failed to renew the lease with the peer: %v", err)
+	}
+}
+
+func TestFailedRestoreIsRetried(t *testing.T) {
+	registrars := startRegistrars(t, "a")
+	m, f := registrars["a"].m, registrars["a"].f
+	const serverAddr = "127.0.0.1:2016"
+
+	m.AllowSpecialIPs = false
+	f.Merge([]Registration{{Addr: serverAddr, RegisteredAt: time.Now(), Record: &Record{Operator: "alice"}}})
+	if isRegistered(m, serverAddr) {
+		t.Fatal("expected the server to fail to be added")
+	}
+	m.AllowSpecialIPs = true
+	f.Sync(context.Background())
+	reg, ok := m.LookupRegistration(serverAddr)
+	if !ok || reg.Operator == nil || reg.Operator.Name != "alice" {
+		t.Errorf("expected the server to be added on the next sync, got %+v", reg)
+	}
+}
+
+// A lease released without delisting the server must be dropped by peers, and not brought back by them.
+func TestReleasedLeasePropagates(t *testing.T) {
+	registrars := startRegistrars(t, "a", "b")
+	a, b := registrars["a"], registrars["b"]
+	const serverAddr = "127.0.0.1:2016"
+
+	released, err := a.m.Register(&monitor.Registration{Addr: serverAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	// A server only holds more than one lease if they were merged, e.g. from peers
+	kept := &monitor.Lease{ID: "kept", Secret: "kept secret"}
+	keptHash := sha256.Sum256([]byte(kept.Secret))
+	merged := &monitor.Registration{Addr: serverAddr,
+		Leases: []monitor.LeaseRecord{{ID: kept.ID, SecretHash: hex.EncodeToString(keptHash[:])}}}
+	if err := a.m.Restore(merged); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	waitFor(t, "registration to reach b", func() bool { return isRegistered(b.m, serverAddr) })
+	b.f.Sync(context.Background())
+	if reg, _ := b.m.LookupRegistration(serverAddr); len(reg.Leases) != 2 {
+		t.Fatalf("expected b to have both leases, got %+v", reg.Leases)
+	}
+
+	if _, err := a.m.ReleaseLease(released.ID, released.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	a.f.Sync(context.Background()) // b still has the released lease
+	if _, err := a.m.RenewLease(released.ID, released.Secret); !errors.Is(err, monitor.ErrUnknownLease) {
+		t.Errorf("expected b not to bring the released lease back to a, got %v", err)
+	}
+	b.f.Sync(context.Background())
+	if _, err := b.m.RenewLease(released.ID, released.Secret); !errors.Is(err, monitor.ErrUnknownLease) {
+		t.Errorf("expected the released lease to be dropped by b, got %v", err)
+	}
+	if _, err := b.m.RenewLease(kept.ID, kept.Secret); err != nil {
+		t.Errorf("expected the other lease to be kept by b, got %v", err)
+	}
+	for _, reg := range a.f.Registrations() {
+		if len(reg.Record.Leases) != 1 || reg.Record.Leases[0].ID != kept.ID {
+			t.Errorf("expected a to share only the lease it kept, got %+v", reg.Record.Leases)
+		}
+	}
+}
+
+type failingReader struct {
+	t *testing.T
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	r.t.Error("expected the body of a request from an unknown peer not to be read")
+	return 0, io.EOF
+}
+
+func TestUnknownPeersBodyIsNotRead(t *testing.T) {
+	registrars := startRegistrars(t, "a", "b")
+	req := httptest.NewRequest(http.MethodPost, registrationsPath, failingReader{t})
+	req.Header.Set(peerHeader, "c")
+	if _, _, err := registrars["a"].f.authenticate(req); err == nil {
+		t.Error("expected a request from an unknown peer to be refused")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, registrationsPath, strings.NewReader(strings.Repeat(" ", maxRequestBodySize+1)))
+	req.Header.Set(peerHeader, "b")
+	var apiErr api.ApiError
+	if _, _, err := registrars["a"].f.authenticate(req); !errors.As(err, &apiErr) || apiErr.ResponseCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a body that is too large to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	replicationInterval = 5 * time.Second // How often a follower pulls the primary's registrations
+	replicationPath     = "/replication/state"
+	promotePath         = "/admin/promote"
+)
+
+// ReplicationState is what a primary registrar sends to its followers.
+type ReplicationState struct {
+	// Addrs are all registered servers, whether up or down
+	Addrs []string `json:"addrs"`
+	// Records are the full registrations of Addrs, by address, so that their registrants keep them after
+	// the follower is promoted
+	Records map[string]*Record `json:"records,omitempty"`
+	// Servers are the servers that are up, according to the primary's pings
+	Servers []*monitor.PublicServerInfo `json:"servers"`
+}
+
+// AddReplicationRoutes adds the endpoint that followers pull from to a primary registrar. Followers are
+// authenticated the same way as peers; the URLs of followers are not used.
+func AddReplicationRoutes(router *mux.Router, followers []PeerConfig, m *monitor.Monitor, log *zap.Logger) {
+	followersByName := make(map[string]PeerConfig)
+	for _, fc := range followers {
+		followersByName[fc.Name] = fc
+	}
+	router.HandleFunc(replicationPath, api.WithMonitorAndLog(m, log,
+		func(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+			if r.Method != http.MethodGet {
+				return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+			}
+			if _, err := verifyRequest(r, followersByName, nil, time.Now()); err != nil {
+				return api.NewApiError(http.StatusUnauthorized, "unauthorized", err,
+					zap.String("follower", r.Header.Get(peerHeader)))
+			}
+			state := &ReplicationState{Records: make(map[string]*Record)}
+			for _, reg := range m.ListRegistrations() {
+				state.Addrs = append(state.Addrs, reg.Addr)
+				state.Records[reg.Addr] = NewRecord(reg)
+			}
+			state.Servers = m.ListLocalServers(false)
+			return writeJSON(w, state)
+		}))
+}
+
+// Follower keeps a standby registrar's server registrations identical to those of a primary registrar.
+// The standby is read-only until it is promoted, after which it stops following and accepts
+// registrations itself.
+type Follower struct {
+	name    string
+	primary PeerConfig
+	m       *monitor.Monitor
+	log     *zap.Logger
+	client  *http.Client
+	// useProbeResults makes the follower also list servers that the primary sees as up
+	useProbeResults bool
+
+	// mu is held while applying replicated state, so that promotion can't happen halfway through
+	mu          sync.Mutex
+	promoteOnce sync.Once
+	promoted    chan struct{}
+}
+
+// NewFollower returns a Follower of primary, and makes m read-only.
+func NewFollower(name string, primary PeerConfig, m *monitor.Monitor, log *zap.Logger, useProbeResults bool) *Follower {
+	m.SetReadOnly(true)
+	return &Follower{
+		name:            name,
+		primary:         primary,
+		m:               m,
+		log:             log.With(zap.String("primary", primary.Name)),
+		client:          &http.Client{Timeout: peerTimeout},
+		useProbeResults: useProbeResults,
+		promoted:        make(chan struct{}),
+	}
+}
+
+// Promote stops following, and makes the registrar accept registrations. It is safe to call more than once.
+func (fl *Follower) Promote() {
+	fl.promoteOnce.Do(func() {
+		fl.mu.Lock()
+		defer fl.mu.Unlock()
+		fl.log.Info("promoting follower to primary")
+		close(fl.promoted)
+		fl.m.SetReadOnly(false)
+	})
+}
+
+func (fl *Follower) Promoted() bool {
+	select {
+	case <-fl.promoted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run pulls from the primary every replicationInterval until promoted or the context is cancelled.
+func (fl *Follower) Run(ctx context.Context) error {
+	ticker := time.NewTicker(replicationInterval)
+	defer ticker.Stop()
+	for {
+		if err := fl.Replicate(ctx); err != nil {
+			fl.log.Warn("failed to replicate from primary", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-fl.promoted:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Replicate pulls the primary's state once, and adds, updates and removes servers to match it.
+func (fl *Follower) Replicate(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fl.primary.URL+replicationPath, nil)
+	if err != nil {
+		return err
+	}
+	signRequest(req, fl.name, fl.primary.Key, nil, time.Now())
+	resp, err := fl.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStateBodySize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded with %d: %s", resp.StatusCode, body)
+	}
+	var state ReplicationState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return err
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.Promoted() {
+		// Don't undo registrations accepted since the promotion
+		return nil
+	}
+
+	primaryAddrs := make(map[string]bool, len(state.Addrs))
+	for _, serverAddr := range state.Addrs {
+		primaryAddrs[serverAddr] = true
+	}
+	localAddrs := make(map[string]bool)
+	for _, serverAddr := range fl.m.ListServerAddresses() {
+		localAddrs[serverAddr] = true
+		if !primaryAddrs[serverAddr] {
+			fl.m.RemoveServer(serverAddr)
+		}
+	}
+	for serverAddr := range primaryAddrs {
+		rec := state.Records[serverAddr]
+		if localAddrs[serverAddr] {
+			if rec == nil {
+				continue
+			}
+			if local, ok := fl.m.LookupRegistration(serverAddr); ok && rec.replicatedBy(NewRecord(local)) {
+				continue
+			}
+		}
+		reg := &monitor.Registration{Addr: serverAddr}
+		if rec != nil {
+			reg = rec.Registration(serverAddr)
+		}
+		if err := fl.m.Replicate(reg); err != nil {
+			fl.log.Info("failed to add server registered with primary", zap.String("serverAddr", serverAddr), zap.Error(err))
+		}
+	}
+	if fl.useProbeResults {
+		fl.m.SetRemoteServers(fl.primary.Name, state.Servers)
+	}
+	return nil
+}
+
+// AddRoutes adds the admin endpoint for promoting the follower, which requires the admin key.
+func (fl *Follower) AddRoutes(router *mux.Router, adminKey string) {
+	router.HandleFunc(promotePath, api.RequireBearerToken(adminKey, fl.log, api.WithMonitorAndLog(fl.m, fl.log,
+		func(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+			if r.Method != http.MethodPost {
+				return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+			}
+			fl.Promote()
+			return writeJSON(w, struct {
+				Promoted bool `json:"promoted"`
+			}{true})
+		})))
+}
@@ -0,0 +1,179 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func TestFollowerReplicatesUntilPromoted(t *testing.T) {
+	primary := monitor.NewMonitor()
+	primary.AllowSpecialIPs = true
+	primaryRouter := mux.NewRouter()
+	AddReplicationRoutes(primaryRouter, []PeerConfig{{Name: "standby", Key: "k"}}, primary, zap.NewNop())
+	primarySrv := httptest.NewServer(primaryRouter)
+	defer primarySrv.Close()
+
+	standby := monitor.NewMonitor()
+	standby.AllowSpecialIPs = true
+	fl := NewFollower("standby", PeerConfig{Name: "primary", URL: primarySrv.URL, Key: "k"}, standby, zap.NewNop(), false)
+	standbyRouter := mux.NewRouter()
+	fl.AddRoutes(standbyRouter, "admin-key")
+	standbySrv := httptest.NewServer(standbyRouter)
+	defer standbySrv.Close()
+
+	if err := standby.AddServer("127.0.0.1:1"); err == nil {
+		t.Error("expected follower to refuse registrations")
+	}
+
+	ctx := context.Background()
+	primary.AddServer("127.0.0.1:2016")
+	primary.AddServer("127.0.0.1:2017")
+	if err := fl.Replicate(ctx); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	primary.RemoveServer("127.0.0.1:2017")
+	if err := fl.Replicate(ctx); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	addrs := standby.ListServerAddresses()
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1:2016" {
+		t.Fatalf("expected standby to have the primary's servers, got %v", addrs)
+	}
+
+	// Promote through the admin endpoint
+	req, _ := http.NewRequest(http.MethodPost, standbySrv.URL+promotePath, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without admin key, got %d", resp.StatusCode)
+	}
+	req.Header.Set("Authorization", "Bearer admin-key")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !fl.Promoted() {
+		t.Fatalf("expected promotion, got %d", resp.StatusCode)
+	}
+
+	if err := standby.AddServer("127.0.0.1:3000"); err != nil {
+		t.Errorf("expected promoted registrar to accept registrations, got %v", err)
+	}
+	if err := fl.Replicate(ctx); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	if len(standby.ListServerAddresses()) != 2 {
+		t.Errorf("expected replication to stop after promotion, got %v", standby.ListServerAddresses())
+	}
+}
+
+func TestPromotedFollowerKeepsOwnership(t *testing.T) {
+	primary := monitor.NewMonitor()
+	primary.AllowSpecialIPs = true
+	primaryRouter := mux.NewRouter()
+	AddReplicationRoutes(primaryRouter, []PeerConfig{{Name: "standby", Key: "k"}}, primary, zap.NewNop())
+	primarySrv := httptest.NewServer(primaryRouter)
+	defer primarySrv.Close()
+	standby := monitor.NewMonitor()
+	standby.AllowSpecialIPs = true
+	fl := NewFollower("standby", PeerConfig{Name: "primary", URL: primarySrv.URL, Key: "k"}, standby, zap.NewNop(), false)
+
+	md := monitor.ServerMetadata{Description: "mine"}
+	lease, err := primary.Register(&monitor.Registration{Addr: "127.0.0.1:2016", Metadata: md})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	operated := &monitor.Registration{Addr: "127.0.0.1:2017", Operator: &monitor.Operator{Name: "alice"}}
+	if _, err := primary.Register(operated); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if err := fl.Replicate(context.Background()); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	// Changes to registrations that the follower already has are replicated too
+	md.Description = "still mine"
+	reg := &monitor.Registration{Addr: "127.0.0.1:2016", Metadata: md, LeaseID: lease.ID, LeaseSecret: lease.Secret}
+	if _, err := primary.Register(reg); err != nil {
+		t.Fatalf("failed to register again: %v", err)
+	}
+	if err := fl.Replicate(context.Background()); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	fl.Promote()
+
+	if _, err := standby.Register(&monitor.Registration{Addr: "127.0.0.1:2016"}); !errors.Is(err, monitor.ErrAlreadyRegistered) {
+		t.Errorf("expected ErrAlreadyRegistered, got %v", err)
+	}
+	if _, err := standby.Register(&monitor.Registration{Addr: "127.0.0.1:2017"}); err == nil {
+		t.Error("expected the operator's server to be refused to anyone else")
+	}
+	if got, _ := standby.LookupRegistration("127.0.0.1:2016"); got.Metadata.Description != "still mine" {
+		t.Errorf("expected the metadata to survive promotion, got %+v", got.Metadata)
+	}
+	if _, err := standby.Register(reg); err != nil {
+		t.Errorf("expected the lease holder to register again after promotion, got %v", err)
+	}
+	operated = &monitor.Registration{Addr: "127.0.0.1:2017", Operator: &monitor.Operator{Name: "alice"}}
+	if _, err := standby.Register(operated); err != nil {
+		t.Errorf("expected the operator to register again after promotion, got %v", err)
+	}
+}
+
+func TestFollowerDropsReleasedLeases(t *testing.T) {
+	primary := monitor.NewMonitor()
+	primary.AllowSpecialIPs = true
+	primaryRouter := mux.NewRouter()
+	AddReplicationRoutes(primaryRouter, []PeerConfig{{Name: "standby", Key: "k"}}, primary, zap.NewNop())
+	primarySrv := httptest.NewServer(primaryRouter)
+	defer primarySrv.Close()
+	standby := monitor.NewMonitor()
+	standby.AllowSpecialIPs = true
+	fl := NewFollower("standby", PeerConfig{Name: "primary", URL: primarySrv.URL, Key: "k"}, standby, zap.NewNop(), false)
+
+	released, err := primary.Register(&monitor.Registration{Addr: "127.0.0.1:2016"})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	// A server only holds more than one lease if they were merged, e.g. from peers
+	kept := &monitor.Lease{ID: "kept", Secret: "kept secret"}
+	keptHash := sha256.Sum256([]byte(kept.Secret))
+	merged := &monitor.Registration{Addr: "127.0.0.1:2016",
+		Leases: []monitor.LeaseRecord{{ID: kept.ID, SecretHash: hex.EncodeToString(keptHash[:])}}}
+	if err := primary.Restore(merged); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if err := fl.Replicate(context.Background()); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	if _, err := primary.ReleaseLease(released.ID, released.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if err := fl.Replicate(context.Background()); err != nil {
+		t.Fatalf("failed to replicate: %v", err)
+	}
+	fl.Promote()
+
+	if _, err := standby.RenewLease(released.ID, released.Secret); !errors.Is(err, monitor.ErrUnknownLease) {
+		t.Errorf("expected the released lease to be unknown after promotion, got %v", err)
+	}
+	if _, err := standby.ReleaseLease(released.ID, released.Secret); !errors.Is(err, monitor.ErrUnknownLease) {
+		t.Errorf("expected the released lease not to delist the server, got %v", err)
+	}
+	if _, err := standby.RenewLease(kept.ID, kept.Secret); err != nil {
+		t.Errorf("expected the lease still held on the primary to be renewable, got %v", err)
+	}
+}
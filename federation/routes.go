@@ -0,0 +1,98 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	statePath         = "/federation/state"
+	registrationsPath = "/federation/registrations"
+	// maxRequestBodySize limits the registrations a peer pushes at once; bigger pushes are refused, and left
+	// for the next Sync
+	maxRequestBodySize = 1024 * 1024
+)
+
+// AddRoutes adds the endpoints that peers call.
+func (f *Federation) AddRoutes(router *mux.Router) {
+	router.HandleFunc(statePath, api.WithMonitorAndLog(f.m, f.log, f.getState))
+	router.HandleFunc(registrationsPath, api.WithMonitorAndLog(f.m, f.log, f.postRegistrations))
+}
+
+// authenticate checks that the request claims to be from a peer, then reads the request body and checks
+// that the request was signed by that peer.
+func (f *Federation) authenticate(r *http.Request) (PeerConfig, []byte, error) {
+	if _, ok := f.peers[r.Header.Get(peerHeader)]; !ok {
+		return PeerConfig{}, nil, api.NewApiError(http.StatusUnauthorized, "unauthorized", ErrUnknownPeer,
+			zap.String("peer", r.Header.Get(peerHeader)))
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize+1))
+		if err != nil {
+			return PeerConfig{}, nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		if len(body) > maxRequestBodySize {
+			return PeerConfig{}, nil, api.NewApiError(http.StatusRequestEntityTooLarge, "request body too large", nil,
+				zap.String("peer", r.Header.Get(peerHeader)))
+		}
+	}
+	peer, err := verifyRequest(r, f.peers, body, time.Now())
+	if err != nil {
+		return PeerConfig{}, nil, api.NewApiError(http.StatusUnauthorized, "unauthorized", err,
+			zap.String("peer", r.Header.Get(peerHeader)))
+	}
+	return peer, body, nil
+}
+
+func (f *Federation) getState(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodGet {
+		return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	if _, _, err := f.authenticate(r); err != nil {
+		return err
+	}
+	return writeJSON(w, f.State())
+}
+
+func (f *Federation) postRegistrations(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodPost {
+		return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	peer, body, err := f.authenticate(r)
+	if err != nil {
+		return err
+	}
+	var state State
+	if err := json.Unmarshal(body, &state); err != nil {
+		return api.NewApiError(http.StatusBadRequest, "invalid JSON", err)
+	}
+	log.Debug("merging registrations pushed by peer", zap.String("peer", peer.Name),
+		zap.Int("count", len(state.Registrations)))
+	f.Merge(state.Registrations)
+	return writeJSON(w, struct {
+		Merged int `json:"merged"`
+	}{len(state.Registrations)})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return nil
+}
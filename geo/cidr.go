@@ -0,0 +1,81 @@
+package geo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// CIDRMap is a Locator backed by a static list of networks. The most specific matching network wins.
+type CIDRMap struct {
+	entries []cidrEntry
+}
+
+type cidrEntry struct {
+	network *net.IPNet
+	loc     Location
+}
+
+// LoadCIDRMap reads a CIDR map file. Each line has a network in CIDR notation, a region name, and
+// optionally a country code, separated by whitespace. Blank lines and lines starting with # are ignored:
+//
+//	# network        region    country
+//	203.0.113.0/24   oceania   AU
+//	2001:db8::/32    eu-west
+func LoadCIDRMap(path string) (*CIDRMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseCIDRMap(f)
+}
+
+func ParseCIDRMap(r io.Reader) (*CIDRMap, error) {
+	c := &CIDRMap{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected network, region, and optional country", lineNo)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if _, ok := Regions[fields[1]]; !ok {
+			return nil, fmt.Errorf("line %d: unknown region %q", lineNo, fields[1])
+		}
+		loc := Location{Region: fields[1]}
+		if len(fields) == 3 {
+			loc.Country = strings.ToUpper(fields[2])
+		}
+		c.entries = append(c.entries, cidrEntry{network: network, loc: loc})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CIDRMap) Locate(ip net.IP) (Location, bool) {
+	bestOnes := -1
+	var best Location
+	for _, e := range c.entries {
+		if !e.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := e.network.Mask.Size(); ones > bestOnes {
+			bestOnes = ones
+			best = e.loc
+		}
+	}
+	return best, bestOnes >= 0
+}
@@ -0,0 +1,152 @@
+// Package geo maps IP addresses to coarse locations, so that players can find servers near them.
+package geo
+
+import (
+	"math"
+	"net"
+	"sort"
+)
+
+// Location is where an IP address is, as far as a Locator knows.
+type Location struct {
+	Country string // ISO 3166-1 alpha-2 code, e.g. "DE"; may be empty
+	Region  string // one of the names in Regions
+	// Latitude and Longitude are only meaningful if HasCoords is true
+	Latitude  float64
+	Longitude float64
+	HasCoords bool
+}
+
+// Locator looks up the location of an IP address.
+type Locator interface {
+	Locate(ip net.IP) (Location, bool)
+}
+
+type coords struct {
+	lat, lon float64
+}
+
+// Regions are the coarse areas that servers are grouped into, with rough centroids for estimating distance.
+var Regions = map[string]coords{
+	"na-west":     {40, -115},
+	"na-east":     {40, -80},
+	"sa":          {-15, -55},
+	"eu-west":     {48, 3},
+	"eu-east":     {52, 25},
+	"africa":      {5, 20},
+	"middle-east": {28, 45},
+	"asia-south":  {20, 78},
+	"asia-east":   {33, 120},
+	"oceania":     {-28, 140},
+}
+
+// middleEastCountries are countries on the Asian continent that are put in the "middle-east" region.
+var middleEastCountries = map[string]bool{
+	"AE": true, "BH": true, "IL": true, "IQ": true, "IR": true, "JO": true, "KW": true, "LB": true,
+	"OM": true, "PS": true, "QA": true, "SA": true, "SY": true, "TR": true, "YE": true,
+}
+
+// regionFor picks a region given a continent code (as in MaxMind databases), a country, and a longitude.
+func regionFor(continent, country string, lon float64, hasCoords bool) string {
+	switch continent {
+	case "NA":
+		if hasCoords && lon < -100 {
+			return "na-west"
+		}
+		return "na-east"
+	case "SA":
+		return "sa"
+	case "EU":
+		if hasCoords && lon > 15 {
+			return "eu-east"
+		}
+		return "eu-west"
+	case "AF":
+		return "africa"
+	case "AS":
+		if middleEastCountries[country] {
+			return "middle-east"
+		}
+		if hasCoords && lon < 90 {
+			return "asia-south"
+		}
+		return "asia-east"
+	case "OC", "AN":
+		return "oceania"
+	}
+	return ""
+}
+
+// RegionLocation returns a Location at the centroid of a region, or false if the region is unknown.
+func RegionLocation(region string) (Location, bool) {
+	c, ok := Regions[region]
+	if !ok {
+		return Location{}, false
+	}
+	return Location{Region: region, Latitude: c.lat, Longitude: c.lon, HasCoords: true}, true
+}
+
+// coordsOf returns the coordinates of a location, falling back to the centroid of its region.
+func coordsOf(loc Location) (coords, bool) {
+	if loc.HasCoords {
+		return coords{loc.Latitude, loc.Longitude}, true
+	}
+	c, ok := Regions[loc.Region]
+	return c, ok
+}
+
+// Distance estimates the distance in kilometers between two locations, or returns false if either is unknown.
+func Distance(a, b Location) (float64, bool) {
+	ca, okA := coordsOf(a)
+	cb, okB := coordsOf(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	const earthRadiusKm = 6371
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(cb.lat - ca.lat)
+	dLon := toRad(cb.lon - ca.lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(ca.lat))*math.Cos(toRad(cb.lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h)), true
+}
+
+// SortByDistance stably sorts n items by their distance from origin; items with unknown locations go last.
+func SortByDistance(origin Location, n int, locationOf func(i int) Location, swap func(i, j int)) {
+	dists := make([]float64, n)
+	for i := range dists {
+		d, ok := Distance(origin, locationOf(i))
+		if !ok {
+			d = math.Inf(1)
+		}
+		dists[i] = d
+	}
+	sort.Stable(&byDistance{dists: dists, swap: swap})
+}
+
+type byDistance struct {
+	dists []float64
+	swap  func(i, j int)
+}
+
+func (b *byDistance) Len() int           { return len(b.dists) }
+func (b *byDistance) Less(i, j int) bool { return b.dists[i] < b.dists[j] }
+func (b *byDistance) Swap(i, j int) {
+	b.dists[i], b.dists[j] = b.dists[j], b.dists[i]
+	b.swap(i, j)
+}
+
+// Chain is a Locator that tries each of its Locators in turn.
+type Chain []Locator
+
+func (c Chain) Locate(ip net.IP) (Location, bool) {
+	for _, l := range c {
+		if l == nil {
+			continue
+		}
+		if loc, ok := l.Locate(ip); ok {
+			return loc, true
+		}
+	}
+	return Location{}, false
+}
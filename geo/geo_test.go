@@ -0,0 +1,58 @@
+package geo
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCIDRMapPrefersMostSpecificNetwork(t *testing.T) {
+	c, err := ParseCIDRMap(strings.NewReader(`
+# network        region    country
+203.0.0.0/8      asia-east
+203.0.113.0/24   oceania   au
+2001:db8::/32    eu-west
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	tests := []struct {
+		ip       string
+		expected Location
+		found    bool
+	}{
+		{"203.0.113.5", Location{Region: "oceania", Country: "AU"}, true},
+		{"203.1.1.1", Location{Region: "asia-east"}, true},
+		{"2001:db8::1", Location{Region: "eu-west"}, true},
+		{"198.51.100.1", Location{}, false},
+	}
+	for _, test := range tests {
+		loc, found := c.Locate(net.ParseIP(test.ip))
+		if found != test.found || loc != test.expected {
+			t.Errorf("%s: expected %+v (%v), got %+v (%v)", test.ip, test.expected, test.found, loc, found)
+		}
+	}
+
+	if _, err := ParseCIDRMap(strings.NewReader("10.0.0.0/8 atlantis")); err == nil {
+		t.Error("expected error for unknown region")
+	}
+}
+
+func TestSortByDistance(t *testing.T) {
+	origin, _ := RegionLocation("eu-west")
+	locs := []Location{
+		{Region: "oceania"},
+		{},
+		{Region: "eu-east"},
+		{Latitude: 51.5, Longitude: -0.1, HasCoords: true}, // London
+	}
+	SortByDistance(origin, len(locs), func(i int) Location { return locs[i] },
+		func(i, j int) { locs[i], locs[j] = locs[j], locs[i] })
+	expected := []Location{{Latitude: 51.5, Longitude: -0.1, HasCoords: true}, {Region: "eu-east"}, {Region: "oceania"}, {}}
+	for i := range expected {
+		if locs[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected, locs)
+			break
+		}
+	}
+}
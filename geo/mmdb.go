@@ -0,0 +1,360 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// This is a minimal reader for the MaxMind DB format, as used by the GeoLite2 and GeoIP2 City and Country
+// databases. See https://maxmind.github.io/MaxMind-DB/ for the specification.
+
+var (
+	mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+	ErrInvalidMMDB     = errors.New("invalid MaxMind DB")
+)
+
+const mmdbDataSectionSeparatorSize = 16
+
+// MMDB is a Locator backed by a MaxMind DB file, which is read entirely into memory.
+type MMDB struct {
+	buf         []byte
+	nodeCount   uint
+	recordSize  uint
+	ipVersion   uint
+	treeSize    uint
+	dataSection []byte
+	ipv4Start   uint // node to start at for IPv4 lookups in an IPv6 tree
+}
+
+func OpenMMDB(path string) (*MMDB, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMMDB(buf)
+}
+
+func NewMMDB(buf []byte) (*MMDB, error) {
+	markerIdx := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if markerIdx < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidMMDB)
+	}
+	metaDecoder := &mmdbDecoder{buf: buf[markerIdx+len(mmdbMetadataMarker):]}
+	metaVal, _, err := metaDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad metadata: %v", ErrInvalidMMDB, err)
+	}
+	meta, ok := metaVal.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidMMDB)
+	}
+	db := &MMDB{
+		buf:        buf,
+		nodeCount:  uint(toUint(meta["node_count"])),
+		recordSize: uint(toUint(meta["record_size"])),
+		ipVersion:  uint(toUint(meta["ip_version"])),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidMMDB, db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrInvalidMMDB, db.ipVersion)
+	}
+	db.treeSize = db.nodeCount * db.recordSize / 4
+	dataStart := db.treeSize + mmdbDataSectionSeparatorSize
+	if dataStart > uint(markerIdx) {
+		return nil, fmt.Errorf("%w: search tree is larger than the file", ErrInvalidMMDB)
+	}
+	db.dataSection = buf[dataStart:markerIdx]
+
+	if db.ipVersion == 6 {
+		// IPv4 addresses are looked up as ::a.b.c.d, so skip the first 96 zero bits once
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			if node, err = db.readRecord(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func (db *MMDB) readRecord(node uint, bit uint) (uint, error) {
+	nodeBytes := db.recordSize / 4
+	offset := node * nodeBytes
+	if offset+nodeBytes > db.treeSize {
+		return 0, fmt.Errorf("%w: node %d out of range", ErrInvalidMMDB, node)
+	}
+	b := db.buf[offset : offset+nodeBytes]
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4])), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+}
+
+// lookup returns the data record for an IP, or nil if there is none.
+func (db *MMDB) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+		if addr == nil {
+			return nil, nil
+		}
+	}
+	for i := uint(0); i < uint(len(addr))*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		var err error
+		if node, err = db.readRecord(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node <= db.nodeCount {
+		// node == nodeCount means not found; node < nodeCount can only happen for a malformed tree
+		return nil, nil
+	}
+	offset := node - db.nodeCount - mmdbDataSectionSeparatorSize
+	d := &mmdbDecoder{buf: db.dataSection}
+	val, _, err := d.decode(offset, 0)
+	return val, err
+}
+
+// Locate satisfies Locator, using the country, continent, and location fields of City or Country databases.
+func (db *MMDB) Locate(ip net.IP) (Location, bool) {
+	val, err := db.lookup(ip)
+	if err != nil || val == nil {
+		return Location{}, false
+	}
+	record, ok := val.(map[string]interface{})
+	if !ok {
+		return Location{}, false
+	}
+	loc := Location{}
+	if country, ok := record["country"].(map[string]interface{}); ok {
+		loc.Country, _ = country["iso_code"].(string)
+	}
+	var continentCode string
+	if continent, ok := record["continent"].(map[string]interface{}); ok {
+		continentCode, _ = continent["code"].(string)
+	}
+	if location, ok := record["location"].(map[string]interface{}); ok {
+		lat, latOK := location["latitude"].(float64)
+		lon, lonOK := location["longitude"].(float64)
+		if latOK && lonOK {
+			loc.Latitude, loc.Longitude, loc.HasCoords = lat, lon, true
+		}
+	}
+	loc.Region = regionFor(continentCode, loc.Country, loc.Longitude, loc.HasCoords)
+	if loc.Region == "" && !loc.HasCoords {
+		return Location{}, false
+	}
+	return loc, true
+}
+
+const (
+	mmdbTypeExtended = 0
+	mmdbTypePointer  = 1
+	mmdbTypeString   = 2
+	mmdbTypeDouble   = 3
+	mmdbTypeBytes    = 4
+	mmdbTypeUint16   = 5
+	mmdbTypeUint32   = 6
+	mmdbTypeMap      = 7
+	mmdbTypeInt32    = 8
+	mmdbTypeUint64   = 9
+	mmdbTypeUint128  = 10
+	mmdbTypeArray    = 11
+	mmdbTypeBool     = 14
+	mmdbTypeFloat    = 15
+
+	mmdbMaxDepth = 32 // Guards against pointer loops and absurd nesting in malformed files
+)
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) bytesAt(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, fmt.Errorf("%w: data out of range", ErrInvalidMMDB)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// decode decodes the value at offset, returning it and the offset after it.
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("%w: data nested too deeply", ErrInvalidMMDB)
+	}
+	b, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbTypePointer {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		val, _, err := d.decode(ptr, depth+1)
+		return val, next, err
+	}
+	if typ == mmdbTypeExtended {
+		b, err := d.bytesAt(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		extra := size - 28
+		b, err := d.bytesAt(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		case 3:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", ErrInvalidMMDB)
+			}
+			val, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyStr] = val
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			val, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, val)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err = d.bytesAt(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case mmdbTypeString:
+		return string(b), offset, nil
+	case mmdbTypeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: bad double size", ErrInvalidMMDB)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: bad float size", ErrInvalidMMDB)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64, mmdbTypeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("%w: integer too long", ErrInvalidMMDB)
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c) // uint128 values over 2^64 are truncated; no location field uses them
+		}
+		return v, offset, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: integer too long", ErrInvalidMMDB)
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	}
+	// Data cache containers and end markers never appear in records
+	return nil, 0, fmt.Errorf("%w: unexpected type %d", ErrInvalidMMDB, typ)
+}
+
+// pointer decodes a pointer whose control byte is ctrl, returning the offset pointed to and the offset
+// after the pointer.
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 0x3
+	vvv := uint(ctrl & 0x7)
+	b, err := d.bytesAt(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	next := offset + ss + 1
+	switch ss {
+	case 0:
+		return vvv<<8 | uint(b[0]), next, nil
+	case 1:
+		return (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048, next, nil
+	case 2:
+		return (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336, next, nil
+	default:
+		return uint(binary.BigEndian.Uint32(b)), next, nil
+	}
+}
+
+func toUint(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
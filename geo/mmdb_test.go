@@ -0,0 +1,166 @@
+package geo
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"testing"
+)
+
+// The helpers below write just enough of the MaxMind DB format for the tests: an IPv4 tree with 24-bit
+// records, and maps, strings, doubles, unsigned integers, and pointers.
+
+func mmdbString(s string) []byte {
+	return append([]byte{mmdbTypeString<<5 | byte(len(s))}, s...)
+}
+
+func mmdbDouble(f float64) []byte {
+	b := []byte{mmdbTypeDouble<<5 | 8, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+	return b
+}
+
+func mmdbUint32(v uint32) []byte {
+	b := []byte{mmdbTypeUint32<<5 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], v)
+	return b
+}
+
+// mmdbMap encodes a map whose values are already encoded.
+func mmdbMap(m map[string][]byte) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := []byte{mmdbTypeMap<<5 | byte(len(m))}
+	for _, k := range keys {
+		b = append(b, mmdbString(k)...)
+		b = append(b, m[k]...)
+	}
+	return b
+}
+
+func mmdbPointer(offset uint) []byte {
+	return []byte{mmdbTypePointer<<5 | byte(offset>>8&0x7), byte(offset)}
+}
+
+type testNetwork struct {
+	cidr       string
+	dataOffset uint
+}
+
+// buildMMDB returns an IPv4 database mapping each network to the data at its offset in data.
+func buildMMDB(t *testing.T, networks []testNetwork, data []byte) []byte {
+	t.Helper()
+	type node struct {
+		id       uint
+		children [2]*node
+		data     [2]int // index into networks + 1; 0 if none
+	}
+	root := &node{}
+	nodes := []*node{root}
+	for i, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To4()
+		cur := root
+		for bitIdx := 0; bitIdx < ones; bitIdx++ {
+			bit := ip[bitIdx/8] >> (7 - bitIdx%8) & 1
+			if bitIdx == ones-1 {
+				cur.data[bit] = i + 1
+				break
+			}
+			if cur.children[bit] == nil {
+				cur.children[bit] = &node{id: uint(len(nodes))}
+				nodes = append(nodes, cur.children[bit])
+			}
+			cur = cur.children[bit]
+		}
+	}
+
+	nodeCount := uint(len(nodes))
+	var buf []byte
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := nodeCount // not found
+			if n.children[bit] != nil {
+				record = n.children[bit].id
+			} else if n.data[bit] != 0 {
+				record = nodeCount + mmdbDataSectionSeparatorSize + networks[n.data[bit]-1].dataOffset
+			}
+			buf = append(buf, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	buf = append(buf, make([]byte, mmdbDataSectionSeparatorSize)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, mmdbMap(map[string][]byte{
+		"node_count":  mmdbUint32(uint32(nodeCount)),
+		"record_size": mmdbUint32(24),
+		"ip_version":  mmdbUint32(4),
+	})...)
+	return buf
+}
+
+func cityRecord(continent, country string, lat, lon float64) []byte {
+	return mmdbMap(map[string][]byte{
+		"continent": mmdbMap(map[string][]byte{"code": mmdbString(continent)}),
+		"country":   mmdbMap(map[string][]byte{"iso_code": mmdbString(country)}),
+		"location": mmdbMap(map[string][]byte{
+			"latitude":  mmdbDouble(lat),
+			"longitude": mmdbDouble(lon),
+		}),
+	})
+}
+
+func TestMMDBLocate(t *testing.T) {
+	berlin := cityRecord("EU", "DE", 52.52, 13.40)
+	sydney := cityRecord("OC", "AU", -33.87, 151.21)
+	data := append(append([]byte{}, berlin...), sydney...)
+	pointerOffset := uint(len(data))
+	data = append(data, mmdbPointer(0)...) // another network with the same record as Berlin
+
+	db, err := NewMMDB(buildMMDB(t, []testNetwork{
+		{"198.51.100.0/24", 0},
+		{"203.0.113.0/25", uint(len(berlin))},
+		{"192.0.2.0/24", pointerOffset},
+	}, data))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected Location
+		found    bool
+	}{
+		{"198.51.100.7", Location{Country: "DE", Region: "eu-west", Latitude: 52.52, Longitude: 13.40, HasCoords: true}, true},
+		{"203.0.113.1", Location{Country: "AU", Region: "oceania", Latitude: -33.87, Longitude: 151.21, HasCoords: true}, true},
+		{"203.0.113.200", Location{}, false},
+		{"192.0.2.1", Location{Country: "DE", Region: "eu-west", Latitude: 52.52, Longitude: 13.40, HasCoords: true}, true},
+		{"10.0.0.1", Location{}, false},
+		{"2001:db8::1", Location{}, false},
+	}
+	for _, test := range tests {
+		loc, found := db.Locate(net.ParseIP(test.ip))
+		if found != test.found || loc != test.expected {
+			t.Errorf("%s: expected %+v (%v), got %+v (%v)", test.ip, test.expected, test.found, loc, found)
+		}
+	}
+}
+
+func TestNewMMDBRejectsGarbage(t *testing.T) {
+	if _, err := NewMMDB([]byte("not a database")); err == nil {
+		t.Error("expected error")
+	}
+	truncated := append([]byte{}, mmdbMetadataMarker...)
+	truncated = append(truncated, mmdbTypeMap<<5|1)
+	if _, err := NewMMDB(truncated); err == nil {
+		t.Error("expected error")
+	}
+}
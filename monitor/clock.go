@@ -0,0 +1,36 @@
+package monitor
+
+import (
+	"time"
+)
+
+// Clock is the source of time used by a Monitor for pinging and timing out servers. Tests replace it
+// with a fake so that timeouts can be exercised without waiting.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the subset of time.Ticker used by a Monitor.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,211 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Diagnosis explains why a server isn't listed, from what the Monitor has seen of it and from a probe.
+type Diagnosis struct {
+	Addr  string      `json:"addr"`
+	State ServerState `json:"state"`
+	// RegisteredAddr is what the server's address resolved to when it was registered, and is pinged at
+	RegisteredAddr string `json:"registered_addr"`
+	// ResolvedAddr is what the server's address resolves to now; DNSError is set instead if it doesn't
+	ResolvedAddr string `json:"resolved_addr,omitempty"`
+	DNSError     string `json:"dns_error,omitempty"`
+	PingsSent    uint64 `json:"pings_sent"`
+	// PacketsReceived counts packets from the address the server is pinged at, valid or not
+	PacketsReceived uint64 `json:"packets_received"`
+	// PacketsFromOtherPorts counts packets from the server's IP on ports no server is registered at
+	PacketsFromOtherPorts uint64 `json:"packets_from_other_ports"`
+	Replies               uint64 `json:"replies"`      // Status replies with a recognized nonce
+	WrongNonces           uint64 `json:"wrong_nonces"` // Status replies to no ping in flight, e.g. late ones
+	DecodeFailures        uint64 `json:"decode_failures"`
+	LastDecodeError       string `json:"last_decode_error,omitempty"`
+	// Probe is the result of a GetStatus sent from a socket of its own; nil if it wasn't probed
+	Probe *ProbeResult `json:"probe,omitempty"`
+	// Problem is the most likely reason the server isn't listed; empty if it is
+	Problem string `json:"problem"`
+}
+
+// ProbeResult is the outcome of a probe sent by Diagnose.
+type ProbeResult struct {
+	Replied bool `json:"replied"`
+	// PortUnreachable is whether an ICMP port unreachable was received, i.e. nothing listens at the port
+	PortUnreachable bool   `json:"port_unreachable"`
+	Error           string `json:"error,omitempty"` // why a reply was rejected, or the probe failed
+}
+
+// diagCounters count what has been received from a server, for Diagnosis.
+type diagCounters struct {
+	pingsSent       uint64
+	packets         uint64
+	replies         uint64
+	wrongNonces     uint64
+	decodeFailures  uint64
+	lastDecodeError string
+}
+
+// Diagnosis explains why a registered server isn't listed, only from what the Monitor has seen of it while
+// pinging it. Since it sends nothing, it may be served to anyone.
+func (m *Monitor) Diagnosis(serverAddr string) (*Diagnosis, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	status, ok := m.statuses[serverAddr]
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	return m.diagnosisLocked(serverAddr, status), nil
+}
+
+// Diagnose explains why a registered server isn't listed. Besides reporting what the Monitor has seen, it
+// resolves the server's address again and probes it from a connected socket, since only those are told of
+// ICMP errors. The probe waits for a reply until ctx is done, or for pingTimeout if ctx has no deadline.
+// Since the probe is sent on demand, callers should check that whoever asks for it may (see CheckHolder).
+func (m *Monitor) Diagnose(ctx context.Context, serverAddr string) (*Diagnosis, error) {
+	m.m.RLock()
+	status, ok := m.statuses[serverAddr]
+	if !ok {
+		m.m.RUnlock()
+		return nil, ErrNotRegistered
+	}
+	d := m.diagnosisLocked(serverAddr, status)
+	probeAddr := status.pingAddr()
+	m.m.RUnlock()
+
+	if addr, err := m.resolveUDPAddr(serverAddr); err != nil {
+		d.DNSError = err.Error()
+	} else {
+		d.ResolvedAddr = addr.String()
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+	}
+	d.Probe = m.probe(ctx, probeAddr)
+	d.Problem = d.findProblem()
+	return d, nil
+}
+
+// diagnosisLocked returns what the Monitor has seen of a server, without probing it.
+func (m *Monitor) diagnosisLocked(serverAddr string, status *Status) *Diagnosis {
+	d := &Diagnosis{
+		Addr:            serverAddr,
+		State:           status.State,
+		RegisteredAddr:  status.ResolvedAddr.String(),
+		PingsSent:       status.diag.pingsSent,
+		PacketsReceived: status.diag.packets,
+		Replies:         status.diag.replies,
+		WrongNonces:     status.diag.wrongNonces,
+		DecodeFailures:  status.diag.decodeFailures,
+		LastDecodeError: status.diag.lastDecodeError,
+	}
+	if count, ok := m.knownIPs.Load(status.ResolvedAddr.IP.String()); ok {
+		d.PacketsFromOtherPorts = atomic.LoadUint64(count.(*uint64))
+	}
+	d.Problem = d.findProblem()
+	return d
+}
+
+// probe sends a GetStatus to dst from a connected socket, and waits for the reply until ctx is done.
+func (m *Monitor) probe(ctx context.Context, dst *net.UDPAddr) *ProbeResult {
+	result := &ProbeResult{}
+	fail := func(err error) *ProbeResult {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			result.PortUnreachable = true
+		} else {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	nonce := m.NewNonce()
+	packetBytes, err := Marshal(&ServerGetStatus{Nonce: nonce})
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := conn.Write(packetBytes); err != nil {
+		return fail(err)
+	}
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Timeout() {
+				return result // No reply
+			}
+			return fail(err)
+		}
+		var reply ServerStatus
+		if err := UnmarshalStrict(buf[:n], &reply); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		if reply.Nonce != nonce {
+			result.Error = "reply has the wrong nonce"
+			continue
+		}
+		result.Replied = true
+		result.Error = ""
+		return result
+	}
+}
+
+// findProblem returns the most likely reason the server isn't listed, or "" if it is.
+func (d *Diagnosis) findProblem() string {
+	switch {
+	case d.DNSError != "":
+		return "the host name no longer resolves"
+	case d.ResolvedAddr != "" && d.ResolvedAddr != d.RegisteredAddr:
+		return "the host name resolves to another address than when it was registered; register it again"
+	case d.State.Listed():
+		return ""
+	case d.Probe != nil && d.Probe.PortUnreachable:
+		return "nothing is listening at the port (ICMP port unreachable)"
+	case d.DecodeFailures > 0:
+		return "replies can't be decoded; the server may speak an incompatible protocol"
+	case d.WrongNonces > 0:
+		return "replies don't answer a ping in flight; the server may echo the wrong nonce, or reply too late"
+	case d.Probe != nil && d.Probe.Replied:
+		return "the server answers probes, but not pings; a firewall may block the registrar's port"
+	case d.PacketsFromOtherPorts > 0:
+		return "packets arrive from the server's IP, but from another port; the server may be behind NAT"
+	case d.PingsSent == 0 && d.Probe == nil:
+		return "the server hasn't been pinged yet"
+	default:
+		return "nothing arrives from the server's IP; it may not be running, or a firewall may block UDP"
+	}
+}
+
+// countUnknownSender counts a packet dropped because its sender isn't a registered server, and, if the
+// sender's IP is that of one, counts it for Diagnosis.
+func (m *Monitor) countUnknownSender(addr *net.UDPAddr) {
+	atomic.AddUint64(&m.droppedUnknownSender, 1)
+	if count, ok := m.knownIPs.Load(addr.IP.String()); ok {
+		atomic.AddUint64(count.(*uint64), 1)
+	}
+}
+
+// forgetIPLocked stops counting packets from the IP of a removed server, unless another server has it.
+func (m *Monitor) forgetIPLocked(addr *net.UDPAddr) {
+	for _, status := range m.statuses {
+		if status.ResolvedAddr != nil && status.ResolvedAddr.IP.Equal(addr.IP) {
+			return
+		}
+	}
+	m.knownIPs.Delete(addr.IP.String())
+}
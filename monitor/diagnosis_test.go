@@ -0,0 +1,165 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// closedUDPAddr returns a loopback address nothing listens at.
+func closedUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestDiagnoseCountsWhatArrives(t *testing.T) {
+	m, _, conn := newTestMonitor(t)
+	diagnose := func() *Diagnosis {
+		m.m.RLock()
+		defer m.m.RUnlock()
+		return m.diagnosisLocked(testServerAddr, m.statuses[testServerAddr])
+	}
+	if d := diagnose(); d.Problem != "the server hasn't been pinged yet" {
+		t.Errorf("unexpected problem before pinging: %q", d.Problem)
+	}
+
+	m.sendPings(zap.NewNop(), conn)
+	if d := diagnose(); d.PingsSent != 1 || d.PacketsReceived != 0 {
+		t.Errorf("expected one ping and no packets, got %+v", d)
+	}
+	m.countUnknownSender(&net.UDPAddr{IP: testServerUDPAddr.IP, Port: 40000})
+	m.countUnknownSender(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2016})
+	if d := diagnose(); d.PacketsFromOtherPorts != 1 || d.Problem == "" {
+		t.Errorf("expected a packet from another port, got %+v", d)
+	}
+
+	wrongNonce, err := Marshal(&ServerStatus{Nonce: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, wrongNonce)
+	if d := diagnose(); d.WrongNonces != 1 || d.PacketsReceived != 1 {
+		t.Errorf("expected a reply with the wrong nonce, got %+v", d)
+	}
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, []byte{5, 0, 0})
+	d := diagnose()
+	if d.DecodeFailures != 1 || d.LastDecodeError == "" {
+		t.Errorf("expected a decode failure, got %+v", d)
+	}
+	if d.Problem != "replies can't be decoded; the server may speak an incompatible protocol" {
+		t.Errorf("unexpected problem: %q", d.Problem)
+	}
+
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, statusReplyBytes(t, conn))
+	if d := diagnose(); d.Replies != 1 || d.Problem != "" {
+		t.Errorf("expected no problem once the server answered, got %+v", d)
+	}
+}
+
+func TestDiagnoseProbesClosedPort(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	addr := closedUDPAddr(t)
+	if err := m.AddServer(addr); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	if _, err := m.Diagnose(context.Background(), "127.0.0.1:1"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("expected ErrNotRegistered, got %v", err)
+	}
+	d, err := m.Diagnose(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to diagnose: %v", err)
+	}
+	if d.ResolvedAddr != addr || d.DNSError != "" {
+		t.Errorf("expected %s to resolve, got %+v", addr, d)
+	}
+	if d.Probe == nil || !d.Probe.PortUnreachable || d.Probe.Replied {
+		t.Fatalf("expected the port to be unreachable, got %+v", d.Probe)
+	}
+	if d.Problem != "nothing is listening at the port (ICMP port unreachable)" {
+		t.Errorf("unexpected problem: %q", d.Problem)
+	}
+}
+
+func TestDiagnoseProbesServer(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var getStatus ServerGetStatus
+			if err := UnmarshalStrict(buf[:n], &getStatus); err != nil {
+				continue
+			}
+			reply, _ := Marshal(&ServerStatus{Nonce: getStatus.Nonce})
+			server.WriteTo(reply, addr)
+		}
+	}()
+
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	addr := server.LocalAddr().String()
+	if err := m.AddServer(addr); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	d, err := m.Diagnose(ctx, addr)
+	if err != nil {
+		t.Fatalf("failed to diagnose: %v", err)
+	}
+	if d.Probe == nil || !d.Probe.Replied || d.Probe.PortUnreachable || d.Probe.Error != "" {
+		t.Fatalf("expected the probe to be answered, got %+v", d.Probe)
+	}
+	if d.Problem != "the server answers probes, but not pings; a firewall may block the registrar's port" {
+		t.Errorf("unexpected problem: %q", d.Problem)
+	}
+}
+
+func TestCheckHolder(t *testing.T) {
+	m, _, _, lease := newLeaseTestMonitor(t)
+	operated := &Registration{Addr: "127.0.0.1:2017", Operator: &Operator{Name: "alice"}}
+	if _, err := m.Register(operated); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	for _, tc := range []struct {
+		desc       string
+		serverAddr string
+		leaseID    string
+		secret     string
+		operator   *Operator
+		expected   error
+	}{
+		{"holder", testServerAddr, lease.ID, lease.Secret, nil, nil},
+		{"wrong secret", testServerAddr, lease.ID, "nope", nil, ErrWrongLeaseSecret},
+		{"nothing", testServerAddr, "", "", nil, ErrNotHolder},
+		{"lease of another server", "127.0.0.1:2017", lease.ID, lease.Secret, nil, ErrUnknownLease},
+		{"operator", "127.0.0.1:2017", "", "", &Operator{Name: "alice"}, nil},
+		{"another operator", "127.0.0.1:2017", "", "", &Operator{Name: "bob"}, ErrNotHolder},
+		{"unregistered", "127.0.0.1:1", lease.ID, lease.Secret, nil, ErrNotRegistered},
+	} {
+		if err := m.CheckHolder(tc.serverAddr, tc.leaseID, tc.secret, tc.operator); !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.desc, tc.expected, err)
+		}
+	}
+	if d, err := m.Diagnosis(testServerAddr); err != nil || d.Probe != nil {
+		t.Errorf("expected a diagnosis without a probe, got %+v %v", d, err)
+	}
+}
@@ -0,0 +1,116 @@
+package monitor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTimeout = 5 * time.Second
+
+	// DNSVerificationLabel is prepended to a host name to get the name of its verification TXT record
+	DNSVerificationLabel = "_conwayste-registrar"
+	dnsTokenPrefix       = "conwayste-registrar-verification="
+)
+
+var ErrNoAddresses = errors.New("host name has no addresses")
+
+// Resolver looks up the IPs of servers registered by host name, and TXT records for DNS verification.
+// *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// resolveUDPAddr is like net.ResolveUDPAddr, but uses m.Resolver. Like net.ResolveUDPAddr, it prefers IPv4
+// addresses.
+func (m *Monitor) resolveUDPAddr(serverAddr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := m.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoAddresses
+	}
+	chosen := addrs[0]
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			chosen = addr
+			break
+		}
+	}
+	return &net.UDPAddr{IP: chosen.IP, Port: int(port), Zone: chosen.Zone}, nil
+}
+
+// DNSVerifier issues the tokens that operators publish in TXT records to prove that they control a host
+// name. A server registered by host name is listed as verified if the TXT record named by
+// DNSVerificationRecord contains the token for the host name. Tokens are derived from the key, so they
+// don't need to be stored, and stay the same across restarts as long as the key does.
+type DNSVerifier struct {
+	key []byte
+}
+
+func NewDNSVerifier(key []byte) *DNSVerifier {
+	return &DNSVerifier{key: key}
+}
+
+// Token returns the TXT record value that verifies host.
+func (v *DNSVerifier) Token(host string) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(normalizeHost(host)))
+	return dnsTokenPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DNSVerificationRecord returns the name of the TXT record that verifies host.
+func DNSVerificationRecord(host string) string {
+	return DNSVerificationLabel + "." + normalizeHost(host)
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// verifyDNS returns whether the server's host name has a TXT record with its token. Servers registered by IP
+// can't be verified this way.
+func (m *Monitor) verifyDNS(serverAddr string) bool {
+	if m.DNSVerifier == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	records, err := m.Resolver.LookupTXT(ctx, DNSVerificationRecord(host))
+	if err != nil {
+		return false
+	}
+	token := m.DNSVerifier.Token(host)
+	for _, record := range records {
+		if hmac.Equal([]byte(strings.TrimSpace(record)), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package monitor
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDNSVerification(t *testing.T) {
+	dns := newFakeDNSServer(t)
+	dns.SetA("verified.example.com", net.IPv4(127, 0, 0, 1))
+	dns.SetA("unverified.example.com", net.IPv4(127, 0, 0, 2))
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Resolver = dns.Resolver()
+	m.DNSVerifier = NewDNSVerifier([]byte("secret"))
+	dns.SetTXT(DNSVerificationRecord("Verified.Example.com."), "unrelated", m.DNSVerifier.Token("verified.example.com"))
+	dns.SetTXT(DNSVerificationRecord("unverified.example.com"), NewDNSVerifier([]byte("other")).Token("unverified.example.com"))
+
+	var verifiedLease *Lease
+	for _, addr := range []string{"verified.example.com:2016", "unverified.example.com:2016", "127.0.0.3:2016"} {
+		reg := &Registration{Addr: addr}
+		lease, err := m.Register(reg)
+		if err != nil {
+			t.Fatalf("failed to register %s: %v", addr, err)
+		}
+		if addr == "verified.example.com:2016" {
+			verifiedLease = lease
+		}
+		if expected := addr == "verified.example.com:2016"; reg.DNSVerified != expected {
+			t.Errorf("%s: expected DNSVerified %v, got %v", addr, expected, reg.DNSVerified)
+		}
+	}
+	for _, info := range m.ListServers(true) {
+		if expected := info.Addr == "verified.example.com:2016"; info.Verified != expected {
+			t.Errorf("%s: expected Verified %v, got %v", info.Addr, expected, info.Verified)
+		}
+	}
+
+	// Removing the record unverifies the server when it registers again
+	dns.SetTXT(DNSVerificationRecord("verified.example.com"))
+	reg := &Registration{Addr: "verified.example.com:2016", LeaseID: verifiedLease.ID, LeaseSecret: verifiedLease.Secret}
+	if _, err := m.Register(reg); err != nil {
+		t.Fatalf("failed to register again: %v", err)
+	}
+	for _, reg := range m.ListRegistrations() {
+		if reg.DNSVerified {
+			t.Errorf("expected %s to no longer be verified", reg.Addr)
+		}
+	}
+}
+
+func TestDNSVerifiedClaimantMayChangeMetadata(t *testing.T) {
+	dns := newFakeDNSServer(t)
+	dns.SetA("verified.example.com", net.IPv4(127, 0, 0, 1))
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Resolver = dns.Resolver()
+	m.DNSVerifier = NewDNSVerifier([]byte("secret"))
+	restored := &Registration{Addr: "verified.example.com:2016", Metadata: ServerMetadata{Description: "restored"}}
+	if err := m.Restore(restored); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	// Once the claimant proves it owns the host name, its lease is as good as the first registrant's
+	lease, err := m.Register(&Registration{Addr: restored.Addr, Metadata: ServerMetadata{Description: "claimed"}})
+	if err != nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	dns.SetTXT(DNSVerificationRecord("verified.example.com"), m.DNSVerifier.Token("verified.example.com"))
+	reg := &Registration{Addr: restored.Addr, Metadata: ServerMetadata{Description: "verified"}, LeaseID: lease.ID,
+		LeaseSecret: lease.Secret}
+	if _, err := m.Register(reg); err != nil {
+		t.Fatalf("failed to register again: %v", err)
+	}
+	regs := m.ListRegistrations()
+	if len(regs) != 1 || regs[0].Metadata.Description != "verified" || !regs[0].DNSVerified {
+		t.Errorf("expected the verified claimant's metadata, got %+v", regs)
+	}
+	if _, err := m.ReleaseLease(lease.ID, lease.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if len(m.ListRegistrations()) != 0 {
+		t.Error("expected releasing the verified claimant's lease to delist the server")
+	}
+}
+
+func TestResolveWithInjectedResolver(t *testing.T) {
+	dns := newFakeDNSServer(t)
+	dns.SetA("myserver.example.com", net.IPv4(127, 0, 0, 5))
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Resolver = dns.Resolver()
+
+	dst, err := m.resolveUDPAddr("myserver.example.com:2016")
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if dst.String() != "127.0.0.5:2016" {
+		t.Errorf("expected 127.0.0.5:2016, got %s", dst)
+	}
+	if err := m.AddServer("nowhere.example.com:2016"); err == nil {
+		t.Error("expected unknown host to fail to resolve")
+	}
+}
+
+// Registering a server before its owner mustn't keep the owner from registering it once they prove by DNS
+// that they own it.
+func TestDNSVerifiedRegistrantTakesOverServer(t *testing.T) {
+	dns := newFakeDNSServer(t)
+	dns.SetA("verified.example.com", net.IPv4(127, 0, 0, 1))
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Resolver = dns.Resolver()
+	m.DNSVerifier = NewDNSVerifier([]byte("secret"))
+	const addr = "verified.example.com:2016"
+	squatter, err := m.Register(&Registration{Addr: addr, Metadata: ServerMetadata{Description: "spam"}})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	dns.SetTXT(DNSVerificationRecord("verified.example.com"), m.DNSVerifier.Token("verified.example.com"))
+	owner, err := m.Register(&Registration{Addr: addr, Metadata: ServerMetadata{Description: "real"}})
+	if err != nil || owner == nil {
+		t.Fatalf("expected the verified owner to take the server over, got %+v %v", owner, err)
+	}
+	regs := m.ListRegistrations()
+	if len(regs) != 1 || regs[0].Metadata.Description != "real" || !regs[0].DNSVerified || len(regs[0].Leases) != 1 {
+		t.Errorf("expected the owner's metadata and lease only, got %+v", regs)
+	}
+	if _, err := m.RenewLease(squatter.ID, squatter.Secret); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected the squatter's lease to be dropped, got %v", err)
+	}
+
+	// Once the owner holds a lease, nobody else can take the server over, verified or not
+	if _, err := m.Register(&Registration{Addr: addr, Metadata: ServerMetadata{Description: "spam"}}); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("expected ErrAlreadyRegistered, got %v", err)
+	}
+	if _, err := m.RenewLease(owner.ID, owner.Secret); err != nil {
+		t.Errorf("expected the owner's lease to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package monitor
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeTXT = 16
+)
+
+// fakeDNSServer is a DNS server on loopback that answers A and TXT queries from its maps, for testing the
+// Monitor with a real *net.Resolver. Names are lowercase and have no trailing dot.
+type fakeDNSServer struct {
+	conn net.PacketConn
+	mu   sync.Mutex
+	a    map[string][]net.IP
+	txt  map[string][]string
+}
+
+func newFakeDNSServer(t *testing.T) *fakeDNSServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &fakeDNSServer{conn: conn, a: make(map[string][]net.IP), txt: make(map[string][]string)}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func (s *fakeDNSServer) SetA(name string, ips ...net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.a[name] = ips
+}
+
+func (s *fakeDNSServer) SetTXT(name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txt[name] = values
+}
+
+// Resolver returns a resolver that sends all queries to this server.
+func (s *fakeDNSServer) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *fakeDNSServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer returns the response to a query, or nil if the query can't be parsed.
+func (s *fakeDNSServer) answer(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil
+	}
+	// Parse the question, which starts after the 12-byte header
+	var labels []string
+	i := 12
+	for {
+		if i >= len(query) {
+			return nil
+		}
+		l := int(query[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if i+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i:i+l]))
+		i += l
+	}
+	if i+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i:])
+	question := query[12 : i+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	s.mu.Lock()
+	var rdatas [][]byte
+	_, hasA := s.a[name]
+	_, hasTXT := s.txt[name]
+	switch qtype {
+	case dnsTypeA:
+		for _, ip := range s.a[name] {
+			if ip4 := ip.To4(); ip4 != nil {
+				rdatas = append(rdatas, ip4)
+			}
+		}
+	case dnsTypeTXT:
+		for _, value := range s.txt[name] {
+			rdatas = append(rdatas, append([]byte{byte(len(value))}, value...))
+		}
+	}
+	s.mu.Unlock()
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])                        // ID
+	binary.BigEndian.PutUint16(resp[2:], 0x8580) // response, authoritative, recursion desired and available
+	if !hasA && !hasTXT {
+		resp[3] |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[4:], 1)                   // questions
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(rdatas))) // answers
+	resp = append(resp, question...)
+	for _, rdata := range rdatas {
+		record := make([]byte, 12, 12+len(rdata))
+		record[0], record[1] = 0xc0, 12 // pointer to the name in the question
+		binary.BigEndian.PutUint16(record[2:], qtype)
+		binary.BigEndian.PutUint16(record[4:], 1)  // class IN
+		binary.BigEndian.PutUint32(record[6:], 60) // TTL
+		binary.BigEndian.PutUint16(record[10:], uint16(len(rdata)))
+		resp = append(resp, append(record, rdata...)...)
+	}
+	return resp
+}
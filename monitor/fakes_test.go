@@ -0,0 +1,157 @@
+package monitor
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// fakeClock only moves when Advance is called. Tickers fire (without blocking) as Advance passes them.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped {
+			continue
+		}
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool // guarded by the clock's mutex
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+// sequentialNonces returns a nonce source producing 1, 2, 3...
+func sequentialNonces() func() uint64 {
+	var mu sync.Mutex
+	var n uint64
+	return func() uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return n
+	}
+}
+
+type fakePacket struct {
+	buf  []byte
+	addr net.Addr
+}
+
+// fakePacketConn records written packets, and returns packets passed to Deliver from ReadFrom. When
+// there is nothing to read, ReadFrom returns a timeout error shortly, like a socket with a deadline.
+type fakePacketConn struct {
+	mu       sync.Mutex
+	written  []fakePacket
+	incoming chan fakePacket
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{
+		incoming: make(chan fakePacket, 100),
+		closed:   make(chan struct{}),
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.incoming:
+		return copy(p, pkt.buf), pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+	case <-time.After(time.Millisecond):
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: fakeTimeoutError{}}
+	}
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, fakePacket{buf: append([]byte(nil), p...), addr: addr})
+	return len(p), nil
+}
+
+// Written returns the packets written so far and forgets them.
+func (c *fakePacketConn) Written() []fakePacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := c.written
+	c.written = nil
+	return written
+}
+
+func (c *fakePacketConn) Deliver(buf []byte, addr net.Addr) {
+	c.incoming <- fakePacket{buf: buf, addr: addr}
+}
+
+// Pending returns how many delivered packets haven't been read yet.
+func (c *fakePacketConn) Pending() int {
+	return len(c.incoming)
+}
+
+func (c *fakePacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}
+}
+
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
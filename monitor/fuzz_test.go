@@ -0,0 +1,99 @@
+//go:build go1.18
+// +build go1.18
+
+package monitor
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add(expectedGetStatusBytes)
+	f.Add(inputStatusBytes)
+	f.Add(inputStatusBytes[:len(inputStatusBytes)-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var status ServerStatus
+		if err := UnmarshalStrict(data, &status); err == nil {
+			b, err := Marshal(&status)
+			if err != nil || string(b) != string(data) {
+				t.Fatalf("decoded %x but encoded %x %v", data, b, err)
+			}
+		}
+		_ = Unmarshal(data, &status)
+		var getStatus ServerGetStatus
+		_ = Unmarshal(data, &getStatus)
+	})
+}
+
+// FuzzReceive delivers a packet from the test server through a fake PacketConn to Receive. If useNonce is
+// set, the packet's nonce (if it is long enough to have one) is replaced by the one in flight, so that
+// fuzzing reaches the code after the nonce check.
+func FuzzReceive(f *testing.F) {
+	f.Add(inputStatusBytes, true)
+	f.Add(inputStatusBytes, false)
+	f.Add(expectedGetStatusBytes, true)
+	f.Add(append(append([]byte(nil), inputStatusBytes...), 0), true)
+	f.Fuzz(func(t *testing.T, data []byte, useNonce bool) {
+		core, logs := observer.New(zapcore.ErrorLevel)
+		log := zap.New(core)
+		m, _, conn := newTestMonitor(t)
+		m.sendPings(zap.NewNop(), conn)
+		written := conn.Written()
+		if len(written) != 1 {
+			t.Fatalf("expected 1 GetStatus, got %d", len(written))
+		}
+		if useNonce && len(data) >= 12 {
+			data = append([]byte(nil), data...)
+			copy(data[4:12], written[0].buf[4:12])
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- m.Receive(ctx, log, conn) }()
+		conn.Deliver(data, testServerUDPAddr)
+		for conn.Pending() > 0 {
+			time.Sleep(50 * time.Microsecond)
+		}
+		// Receive has queued the packet once it is read, and processes the queue before returning
+		cancel()
+		<-done
+
+		if panics := logs.FilterMessage("recovered from panic while processing packet"); panics.Len() > 0 {
+			t.Fatalf("panic processing %x: %v", data, panics.All()[0].ContextMap())
+		}
+		for _, info := range m.ListServers(true) {
+			for _, s := range []string{info.Name, info.Version} {
+				if !isText(s) {
+					t.Fatalf("listed server has junk %q", s)
+				}
+			}
+			if info.Players > 100000 || info.Rooms > 10000 {
+				t.Fatalf("listed server has %d players and %d rooms", info.Players, info.Rooms)
+			}
+		}
+		if stats := m.Stats(); stats.RepliesReceived == 1 && binary.LittleEndian.Uint32(data) != 5 {
+			t.Fatalf("accepted %x, which is not a Status packet", data)
+		}
+	})
+}
+
+func isText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,269 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	historyMinutes = 24 * 60 // a day of minute buckets
+	historyHours   = 30 * 24 // a month of hour buckets
+	// maxDelistedHistories is how many delisted servers' histories are kept; beyond this, those that were
+	// last sampled longest ago are dropped
+	maxDelistedHistories = 1000
+)
+
+var ErrNoHistory = errors.New("no history for server")
+
+// Resolution is the length of the buckets of a history.
+type Resolution time.Duration
+
+const (
+	Minutely = Resolution(time.Minute)
+	Hourly   = Resolution(time.Hour)
+)
+
+// HistoryBucket sums up the pings sent to a server during one minute or hour. It is kept small, since each
+// server has a month of them.
+type HistoryBucket struct {
+	Start      int64  `json:"t"`    // Unix time
+	Samples    uint32 `json:"n"`    // how many times the server was pinged
+	Up         uint32 `json:"up"`   // how many of those times it was up
+	Players    uint64 `json:"p"`    // sum of the player counts while up
+	MaxPlayers uint32 `json:"pmax"` // most players while up
+	Rooms      uint64 `json:"r"`    // sum of the room counts while up
+	RTTMillis  uint64 `json:"rtt"`  // sum of the latest round trip times while up
+	RTTSamples uint32 `json:"nrtt"` // how many round trip times were summed
+}
+
+// serverHistory is the history of one server. It is only recorded once the server has answered a ping. It is
+// kept after the server is delisted, if the server was ever up, until it is a month old (or until there are
+// more than maxDelistedHistories), so that it isn't lost if the server registers again.
+type serverHistory struct {
+	Minutes []HistoryBucket `json:"minutes"`
+	Hours   []HistoryBucket `json:"hours"`
+}
+
+// recordHistoryLocked adds a sample of the current status of each server that has answered a ping to its
+// history, and drops the histories of delisted servers that are no longer kept. It is called each time the
+// servers are pinged.
+func (m *Monitor) recordHistoryLocked() {
+	now := m.Clock.Now()
+	for serverAddr, status := range m.statuses {
+		if status.diag.replies == 0 {
+			continue
+		}
+		h := m.history[serverAddr]
+		if h == nil {
+			h = &serverHistory{}
+			m.history[serverAddr] = h
+		}
+		h.Minutes = addHistorySample(h.Minutes, Minutely, historyMinutes, now, status)
+		h.Hours = addHistorySample(h.Hours, Hourly, historyHours, now, status)
+	}
+	cutoff := now.Add(-historyHours * time.Hour).Unix()
+	var delisted []string
+	for serverAddr, h := range m.history {
+		if _, ok := m.statuses[serverAddr]; ok {
+			continue
+		}
+		if len(h.Hours) == 0 || h.Hours[len(h.Hours)-1].Start <= cutoff || !h.everUp() {
+			delete(m.history, serverAddr)
+			continue
+		}
+		delisted = append(delisted, serverAddr)
+	}
+	if len(delisted) > maxDelistedHistories {
+		sort.Slice(delisted, func(i, j int) bool {
+			return m.history[delisted[i]].lastSampled() < m.history[delisted[j]].lastSampled()
+		})
+		for _, serverAddr := range delisted[:len(delisted)-maxDelistedHistories] {
+			delete(m.history, serverAddr)
+		}
+	}
+}
+
+func (h *serverHistory) everUp() bool {
+	for _, b := range h.Hours {
+		if b.Up > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSampled returns the start of the latest hour bucket, or 0 if there are none.
+func (h *serverHistory) lastSampled() int64 {
+	if len(h.Hours) == 0 {
+		return 0
+	}
+	return h.Hours[len(h.Hours)-1].Start
+}
+
+// addHistorySample adds a sample to the bucket for now, and drops buckets more than max buckets old.
+func addHistorySample(buckets []HistoryBucket, res Resolution, max int, now time.Time, status *Status) []HistoryBucket {
+	start := now.Truncate(time.Duration(res)).Unix()
+	cutoff := start - int64(max)*int64(time.Duration(res)/time.Second)
+	drop := 0
+	for drop < len(buckets) && buckets[drop].Start <= cutoff {
+		drop++
+	}
+	if drop > 0 {
+		buckets = append(buckets[:0], buckets[drop:]...)
+	}
+	if n := len(buckets); n == 0 || buckets[n-1].Start != start {
+		buckets = append(buckets, HistoryBucket{Start: start})
+	}
+	b := &buckets[len(buckets)-1]
+	b.Samples++
+	if !status.State.Listed() {
+		return buckets
+	}
+	b.Up++
+	b.Players += status.PlayerCount
+	if uint64(b.MaxPlayers) < status.PlayerCount {
+		b.MaxPlayers = uint32(status.PlayerCount)
+	}
+	b.Rooms += status.RoomCount
+	if len(status.rtts) > 0 {
+		b.RTTMillis += uint64(status.rtts[len(status.rtts)-1] / time.Millisecond)
+		b.RTTSamples++
+	}
+	return buckets
+}
+
+// HistoryPoint is a HistoryBucket as shown in the API.
+type HistoryPoint struct {
+	Start        time.Time `json:"start"`
+	Uptime       float64   `json:"uptime"` // fraction of pings for which the server was up
+	AvgPlayers   float64   `json:"avg_players"`
+	MaxPlayers   int       `json:"max_players"`
+	AvgRooms     float64   `json:"avg_rooms"`
+	AvgRTTMillis float64   `json:"avg_rtt_ms,omitempty"`
+}
+
+// ServerHistory is the history of a server at one resolution, oldest first.
+type ServerHistory struct {
+	Addr        string         `json:"addr"`
+	UptimeDay   float64        `json:"uptime_day"`   // fraction of the last day for which the server was up
+	UptimeMonth float64        `json:"uptime_month"` // fraction of the last month for which the server was up
+	Points      []HistoryPoint `json:"points"`
+}
+
+// History returns the history of a server, which may have been delisted.
+func (m *Monitor) History(serverAddr string, res Resolution) (*ServerHistory, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	h := m.history[serverAddr]
+	if h == nil {
+		return nil, ErrNoHistory
+	}
+	buckets := h.Minutes
+	if res == Hourly {
+		buckets = h.Hours
+	}
+	sh := &ServerHistory{
+		Addr:        serverAddr,
+		UptimeDay:   uptime(h.Minutes),
+		UptimeMonth: uptime(h.Hours),
+		Points:      make([]HistoryPoint, 0, len(buckets)),
+	}
+	for _, b := range buckets {
+		p := HistoryPoint{
+			Start:      time.Unix(b.Start, 0).UTC(),
+			Uptime:     ratio(uint64(b.Up), uint64(b.Samples)),
+			AvgPlayers: ratio(b.Players, uint64(b.Up)),
+			MaxPlayers: int(b.MaxPlayers),
+			AvgRooms:   ratio(b.Rooms, uint64(b.Up)),
+		}
+		p.AvgRTTMillis = ratio(b.RTTMillis, uint64(b.RTTSamples))
+		sh.Points = append(sh.Points, p)
+	}
+	return sh, nil
+}
+
+func uptime(buckets []HistoryBucket) float64 {
+	var up, samples uint64
+	for _, b := range buckets {
+		up += uint64(b.Up)
+		samples += uint64(b.Samples)
+	}
+	return ratio(up, samples)
+}
+
+func ratio(n, d uint64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// AggregatePoint sums up all servers during one minute or hour. The values are averages over the pings sent
+// during that time.
+type AggregatePoint struct {
+	Start     time.Time `json:"start"`
+	Servers   float64   `json:"servers"`    // registered servers
+	ServersUp float64   `json:"servers_up"` // servers that were up
+	Players   float64   `json:"players"`    // players on all servers
+	Rooms     float64   `json:"rooms"`      // rooms on all servers
+}
+
+// AggregateHistory returns the history of all servers together, oldest first.
+func (m *Monitor) AggregateHistory(res Resolution) []AggregatePoint {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	byStart := make(map[int64]*AggregatePoint)
+	for _, h := range m.history {
+		buckets := h.Minutes
+		if res == Hourly {
+			buckets = h.Hours
+		}
+		for _, b := range buckets {
+			if b.Samples == 0 {
+				continue
+			}
+			p := byStart[b.Start]
+			if p == nil {
+				p = &AggregatePoint{Start: time.Unix(b.Start, 0).UTC()}
+				byStart[b.Start] = p
+			}
+			p.Servers++
+			p.ServersUp += ratio(uint64(b.Up), uint64(b.Samples))
+			p.Players += ratio(b.Players, uint64(b.Samples))
+			p.Rooms += ratio(b.Rooms, uint64(b.Samples))
+		}
+	}
+	points := make([]AggregatePoint, 0, len(byStart))
+	for _, p := range byStart {
+		points = append(points, *p)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Start.Before(points[j].Start) })
+	return points
+}
+
+// SaveHistory writes the history of all servers, so that it can be restored with LoadHistory, e.g. after a
+// restart.
+func (m *Monitor) SaveHistory(w io.Writer) error {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return json.NewEncoder(w).Encode(m.history)
+}
+
+// LoadHistory restores history written by SaveHistory, replacing the history of those servers.
+func (m *Monitor) LoadHistory(r io.Reader) error {
+	var history map[string]*serverHistory
+	if err := json.NewDecoder(r).Decode(&history); err != nil {
+		return err
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	for serverAddr, h := range history {
+		if h != nil {
+			m.history[serverAddr] = h
+		}
+	}
+	return nil
+}
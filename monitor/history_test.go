@@ -0,0 +1,110 @@
+package monitor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestHistory(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	// No sample is taken before the server has first answered
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	clock.Advance(30 * time.Second)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	clock.Advance(30 * time.Second)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+
+	h, err := m.History(testServerAddr, Minutely)
+	if err != nil {
+		t.Fatalf("failed to get history: %v", err)
+	}
+	if len(h.Points) != 2 {
+		t.Fatalf("expected 2 minutes, got %+v", h.Points)
+	}
+	expected := HistoryPoint{Start: clock.Now().Truncate(time.Hour), Uptime: 1, AvgPlayers: 3, MaxPlayers: 3, AvgRooms: 1,
+		AvgRTTMillis: 10}
+	if h.Points[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, h.Points[0])
+	}
+	if h.UptimeDay != 1 || h.UptimeMonth != 1 {
+		t.Errorf("expected uptime 1, got %v and %v", h.UptimeDay, h.UptimeMonth)
+	}
+	hourly, _ := m.History(testServerAddr, Hourly)
+	if len(hourly.Points) != 1 || hourly.Points[0].Uptime != 1 || hourly.Points[0].AvgPlayers != 3 {
+		t.Errorf("expected 1 hour with uptime 1, got %+v", hourly.Points)
+	}
+
+	agg := m.AggregateHistory(Minutely)
+	if len(agg) != 2 || agg[1].Servers != 1 || agg[1].ServersUp != 1 || agg[1].Players != 3 {
+		t.Errorf("unexpected aggregate history %+v", agg)
+	}
+
+	// A day later, the minute buckets are gone but the hour buckets are not
+	clock.Advance(24 * time.Hour)
+	m.sendPings(zap.NewNop(), conn)
+	h, _ = m.History(testServerAddr, Minutely)
+	if len(h.Points) != 1 {
+		t.Errorf("expected old minutes to be dropped, got %+v", h.Points)
+	}
+	hourly, _ = m.History(testServerAddr, Hourly)
+	if len(hourly.Points) != 2 {
+		t.Errorf("expected 2 hours, got %+v", hourly.Points)
+	}
+
+	var buf bytes.Buffer
+	if err := m.SaveHistory(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	restored := NewMonitor()
+	if err := restored.LoadHistory(&buf); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	restoredHourly, err := restored.History(testServerAddr, Hourly)
+	if err != nil || len(restoredHourly.Points) != 2 || restoredHourly.Points[0] != hourly.Points[0] {
+		t.Errorf("expected restored history to match, got %+v %v", restoredHourly, err)
+	}
+	if _, err := restored.History("127.0.0.1:1", Hourly); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("expected ErrNoHistory, got %v", err)
+	}
+}
+
+func TestHistoryOfServersThatNeverCameUpIsDropped(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.sendPings(zap.NewNop(), conn)
+	if _, err := m.History(testServerAddr, Hourly); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("expected no history before the server answers, got %v", err)
+	}
+
+	// Nor is the history of a delisted server that was never up kept, e.g. if it was loaded
+	start := clock.Now().Truncate(time.Hour).Unix()
+	m.history["127.0.0.1:3000"] = &serverHistory{Hours: []HistoryBucket{{Start: start, Samples: 5}}}
+	m.sendPings(zap.NewNop(), conn)
+	if _, err := m.History("127.0.0.1:3000", Hourly); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("expected the history to be dropped, got %v", err)
+	}
+}
+
+func TestDelistedHistoriesAreCapped(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.RemoveServer(testServerAddr)
+	now := clock.Now().Truncate(time.Hour).Unix()
+	for i := 0; i < maxDelistedHistories+10; i++ {
+		start := now - int64(i)*60
+		m.history[fmt.Sprintf("127.0.0.1:%d", 3000+i)] = &serverHistory{Hours: []HistoryBucket{{Start: start, Samples: 1, Up: 1}}}
+	}
+	m.sendPings(zap.NewNop(), conn)
+	if len(m.history) != maxDelistedHistories {
+		t.Errorf("expected %d histories, got %d", maxDelistedHistories, len(m.history))
+	}
+	if _, err := m.History("127.0.0.1:3000", Hourly); err != nil {
+		t.Errorf("expected the latest history to be kept, got %v", err)
+	}
+	if _, err := m.History(fmt.Sprintf("127.0.0.1:%d", 3000+maxDelistedHistories), Hourly); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("expected the oldest histories to be dropped, got %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+package monitor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLeaseTTL    = 0 // leases never expire, so servers that never renew them stay listed
+	maxLeasesPerServer = 8 // beyond this, registering again fails until a lease expires or is released
+
+	releasedLeaseTTL           = 24 * time.Hour // how long a lease that was dropped before it expired is remembered
+	maxReleasedLeasesPerServer = 64             // beyond this, the lease dropped longest ago is forgotten
+)
+
+var (
+	ErrUnknownLease     = errors.New("unknown or expired lease")
+	ErrWrongLeaseSecret = errors.New("wrong lease secret")
+	// ErrAlreadyRegistered is returned by Register when the server is registered by someone else, in which
+	// case the registration is left as it is
+	ErrAlreadyRegistered = errors.New("server is already registered by someone else")
+	// ErrNotHolder is returned by CheckHolder when no lease of the server was given and the caller is not its
+	// operator
+	ErrNotHolder = errors.New("a lease of the server or its operator's API key is required")
+)
+
+// Lease is granted to the first registration of a server made with Register. Only the holder of a lease (or
+// the server's operator) may register the server again, which renews the lease rather than granting another;
+// an operator registering again without its lease is granted a new one in place of the one it held. If nobody
+// who holds a lease of a server proved they own it by DNS, a registration that does replaces all its leases,
+// as does one by an operator if no operator owns the server, so that whoever registered it first can't keep
+// it from its owner.
+// A server with leases is delisted once they have all been released, or, if the Monitor's LeaseTTL is set,
+// have expired, regardless of whether it answers pings. Leases are restored along with the rest of a
+// Registration, so they can be renewed after a restart. Servers restored without leases (e.g. from an older
+// backup) are only delisted for missing pings. Anyone may claim a lease of such a server, but unless they
+// prove they own it by DNS or as its operator, the claimed lease neither changes its metadata nor delists it.
+type Lease struct {
+	ID        string
+	Secret    string    // only known to the holder; the Monitor keeps a hash of it
+	ExpiresAt time.Time // zero if the lease never expires
+}
+
+type lease struct {
+	serverAddr string
+	secretHash [sha256.Size]byte
+	expiresAt  time.Time // zero if the lease never expires
+	// claimed is set if the lease was granted for a server that was already registered, with no leases and no
+	// operator, to someone who didn't prove they own it, so the holder may not be the server's registrant
+	claimed bool
+	// operator is the operator the lease was granted to, if it was granted for a registration with an API key
+	operator string
+}
+
+// LeaseRecord is a lease as backed up or replicated with a Registration. It holds the hash of the secret,
+// not the secret itself.
+type LeaseRecord struct {
+	ID         string    `json:"id"`
+	SecretHash string    `json:"secret_hash"` // hex
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	Claimed    bool      `json:"claimed,omitempty"`
+	Operator   string    `json:"operator,omitempty"`
+}
+
+// ReleasedLease is a lease that was released, or dropped for another reason, before it expired. A
+// Registration carries the leases its server dropped recently, so that restoring an older copy of it, e.g.
+// from a peer, drops them too rather than bringing them back.
+type ReleasedLease struct {
+	ID         string    `json:"id"`
+	ReleasedAt time.Time `json:"released_at"`
+}
+
+func (l *lease) expired(now time.Time) bool {
+	return !l.expiresAt.IsZero() && !now.Before(l.expiresAt)
+}
+
+// leaseExpiry returns when a lease granted or renewed now expires; zero if LeaseTTL is not set.
+func (m *Monitor) leaseExpiry() time.Time {
+	if m.LeaseTTL <= 0 {
+		return time.Time{}
+	}
+	return m.Clock.Now().Add(m.LeaseTTL)
+}
+
+// newLease returns a new Lease, and the lease to keep in the Monitor. The serverAddr is not set.
+func (m *Monitor) newLease() (*Lease, *lease, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	expiresAt := m.leaseExpiry()
+	return &Lease{ID: id, Secret: secret, ExpiresAt: expiresAt},
+		&lease{secretHash: sha256.Sum256([]byte(secret)), expiresAt: expiresAt}, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkHolderLocked checks whether reg may register an existing server again, which only its first
+// registrant may do: the holder of one of its leases, or its operator. A server with neither leases nor an
+// operator may be claimed by anyone, though see Lease for what a claimed lease allows, and one that no
+// operator owns may be taken over by an operator, or by a registrant verified by DNS unless a lease holder was
+// verified too. It returns the lease
+// reg proved it holds, if any, or else the IDs of the leases that the lease granted to reg replaces.
+func (m *Monitor) checkHolderLocked(reg *Registration, status *Status) (held *lease, replaced []string, err error) {
+	if reg.LeaseID != "" {
+		l, err := m.findLeaseLocked(reg.LeaseID, reg.LeaseSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+		if l.serverAddr != reg.Addr {
+			return nil, nil, ErrUnknownLease
+		}
+		return l, nil, nil
+	}
+	if status.Operator != "" {
+		if err := m.checkOwnershipLocked(reg, status); err != nil {
+			return nil, nil, err
+		}
+		return nil, operatorLeasesLocked(status, reg.Operator.Name), nil
+	}
+	if reg.Operator != nil {
+		// An operator takes over a server that no operator owns, e.g. one registered anonymously first
+		return nil, leaseIDsLocked(status), nil
+	}
+	if len(status.leases) > 0 {
+		if reg.DNSVerified && (!status.DNSVerified || !hasRegistrantLeaseLocked(status)) {
+			// Nobody who holds a lease proved they own the server, so whoever does takes it over
+			return nil, leaseIDsLocked(status), nil
+		}
+		return nil, nil, ErrAlreadyRegistered
+	}
+	return nil, nil, nil
+}
+
+// leaseIDsLocked returns the IDs of all leases of a server.
+func leaseIDsLocked(status *Status) []string {
+	ids := make([]string, 0, len(status.leases))
+	for id := range status.leases {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// operatorLeasesLocked returns the IDs of the leases of a server that were granted to an operator.
+func operatorLeasesLocked(status *Status, operator string) []string {
+	var ids []string
+	for id, l := range status.leases {
+		if l.operator == operator {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkLeaseCapLocked drops the expired leases of a server, and fails if it would still have as many as it
+// may once the replaced leases are dropped. Leases that haven't expired are never dropped, since they may be
+// held by the server's owner.
+func (m *Monitor) checkLeaseCapLocked(serverAddr string, status *Status, replaced int) error {
+	if len(status.leases)-replaced < maxLeasesPerServer {
+		return nil
+	}
+	now := m.Clock.Now()
+	var nextExpiry time.Time
+	for id, l := range status.leases {
+		switch {
+		case l.expired(now):
+			delete(status.leases, id)
+			delete(m.leases, id)
+		case !l.expiresAt.IsZero() && (nextExpiry.IsZero() || l.expiresAt.Before(nextExpiry)):
+			nextExpiry = l.expiresAt
+		}
+	}
+	if len(status.leases)-replaced >= maxLeasesPerServer {
+		err := NewServerAddError(ServerAddErrTooManyLeases, "server has too many leases; renew or release one",
+			zap.String("serverAddr", serverAddr))
+		if !nextExpiry.IsZero() {
+			// Otherwise no lease will ever expire, so retrying later won't help
+			err.RetryAfter = nextExpiry.Sub(now)
+		}
+		return err
+	}
+	return nil
+}
+
+// addLeaseLocked attaches a lease to a registered server.
+func (m *Monitor) addLeaseLocked(serverAddr string, status *Status, id string, l *lease) {
+	if status.leases == nil {
+		status.leases = make(map[string]*lease)
+	}
+	l.serverAddr = serverAddr
+	status.leases[id] = l
+	m.leases[id] = l
+}
+
+// findLeaseLocked returns the lease with the given ID if it has not expired and the secret matches.
+func (m *Monitor) findLeaseLocked(id, secret string) (*lease, error) {
+	l := m.leases[id]
+	if l == nil || l.expired(m.Clock.Now()) {
+		return nil, ErrUnknownLease
+	}
+	secretHash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(secretHash[:], l.secretHash[:]) != 1 {
+		return nil, ErrWrongLeaseSecret
+	}
+	return l, nil
+}
+
+// CheckHolder checks that the caller holds a lease of a registered server, or is its operator, e.g. before
+// doing something for the caller that costs the registrar or the server more than a lookup.
+func (m *Monitor) CheckHolder(serverAddr, leaseID, leaseSecret string, operator *Operator) error {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	status, ok := m.statuses[serverAddr]
+	if !ok {
+		return ErrNotRegistered
+	}
+	if operator != nil && operator.Name == status.Operator {
+		return nil
+	}
+	if leaseID == "" {
+		return ErrNotHolder
+	}
+	l, err := m.findLeaseLocked(leaseID, leaseSecret)
+	if err != nil {
+		return err
+	}
+	if l.serverAddr != serverAddr {
+		return ErrUnknownLease
+	}
+	return nil
+}
+
+// RenewLease extends a lease by LeaseTTL from now, and returns its new expiry time, which is zero if leases
+// don't expire.
+func (m *Monitor) RenewLease(id, secret string) (time.Time, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	l, err := m.findLeaseLocked(id, secret)
+	if err != nil {
+		return time.Time{}, err
+	}
+	l.expiresAt = m.leaseExpiry()
+	return l.expiresAt, nil
+}
+
+// ReleaseLease ends a lease right away, e.g. because the server is shutting down. If it was the last lease
+// the server's registrant held, the server is delisted and the Listener is notified; releasing a claimed
+// lease never delists it. It returns the address of the server.
+func (m *Monitor) ReleaseLease(id, secret string) (serverAddr string, err error) {
+	m.m.Lock()
+	l, err := m.findLeaseLocked(id, secret)
+	if err != nil {
+		m.m.Unlock()
+		return "", err
+	}
+	serverAddr = l.serverAddr
+	status := m.statuses[serverAddr]
+	delisted := false
+	if status == nil {
+		delete(m.leases, id)
+	} else {
+		m.dropLeaseLocked(status, id)
+		if !l.claimed && !hasRegistrantLeaseLocked(status) {
+			delisted = m.removeServerLocked(serverAddr)
+		}
+	}
+	m.m.Unlock()
+
+	if delisted && m.Listener != nil {
+		m.Listener.ServersDelisted([]string{serverAddr})
+	}
+	return serverAddr, nil
+}
+
+// dropLeaseLocked drops a lease of a server before it expires, and remembers that it was dropped.
+func (m *Monitor) dropLeaseLocked(status *Status, id string) {
+	delete(status.leases, id)
+	delete(m.leases, id)
+	m.rememberReleasedLeaseLocked(status, id, m.Clock.Now())
+}
+
+// rememberReleasedLeaseLocked remembers that a lease of a server was dropped at the given time, and forgets
+// the leases dropped more than releasedLeaseTTL ago, or longest ago if there are too many.
+func (m *Monitor) rememberReleasedLeaseLocked(status *Status, id string, releasedAt time.Time) {
+	if _, ok := status.releasedLeases[id]; ok {
+		return
+	}
+	if status.releasedLeases == nil {
+		status.releasedLeases = make(map[string]time.Time)
+	}
+	status.releasedLeases[id] = releasedAt
+	now := m.Clock.Now()
+	oldestID := ""
+	for id, releasedAt := range status.releasedLeases {
+		if now.Sub(releasedAt) >= releasedLeaseTTL {
+			delete(status.releasedLeases, id)
+		} else if oldestID == "" || releasedAt.Before(status.releasedLeases[oldestID]) {
+			oldestID = id
+		}
+	}
+	if len(status.releasedLeases) > maxReleasedLeasesPerServer {
+		delete(status.releasedLeases, oldestID)
+	}
+}
+
+// hasRegistrantLeaseLocked returns whether the server has a lease that wasn't claimed.
+func hasRegistrantLeaseLocked(status *Status) bool {
+	for _, l := range status.leases {
+		if !l.claimed {
+			return true
+		}
+	}
+	return false
+}
+
+// expireLeasesLocked removes expired leases, and returns the servers whose registrant no longer holds any.
+func (m *Monitor) expireLeasesLocked(log *zap.Logger) (expiredServerAddrs []string) {
+	now := m.Clock.Now()
+	for id, l := range m.leases {
+		if !l.expired(now) {
+			continue
+		}
+		delete(m.leases, id)
+		status := m.statuses[l.serverAddr]
+		if status == nil {
+			continue
+		}
+		delete(status.leases, id)
+		if !l.claimed && !hasRegistrantLeaseLocked(status) {
+			log.Info("lease expired", zap.String("serverAddr", l.serverAddr))
+			expiredServerAddrs = append(expiredServerAddrs, l.serverAddr)
+		}
+	}
+	return expiredServerAddrs
+}
+
+// leaseRecordsLocked returns the leases of a server for a Registration.
+func leaseRecordsLocked(status *Status) []LeaseRecord {
+	var records []LeaseRecord
+	for id, l := range status.leases {
+		records = append(records, LeaseRecord{ID: id, SecretHash: hex.EncodeToString(l.secretHash[:]),
+			ExpiresAt: l.expiresAt, Claimed: l.claimed, Operator: l.operator})
+	}
+	return records
+}
+
+// releasedLeaseRecordsLocked returns the leases a server dropped recently, for a Registration.
+func releasedLeaseRecordsLocked(status *Status) []ReleasedLease {
+	var released []ReleasedLease
+	for id, releasedAt := range status.releasedLeases {
+		released = append(released, ReleasedLease{ID: id, ReleasedAt: releasedAt})
+	}
+	return released
+}
+
+// restoreLeasesLocked drops the released leases of a server, then adds restored leases to it, skipping those
+// that have expired, are malformed, or were dropped recently. A lease the server already has keeps whichever
+// expiry is later, so restoring a stale copy never shortens it.
+func (m *Monitor) restoreLeasesLocked(serverAddr string, status *Status, records []LeaseRecord, released []ReleasedLease) {
+	for _, r := range released {
+		if _, ok := status.leases[r.ID]; ok {
+			delete(status.leases, r.ID)
+			delete(m.leases, r.ID)
+		}
+		m.rememberReleasedLeaseLocked(status, r.ID, r.ReleasedAt)
+	}
+	now := m.Clock.Now()
+	for _, r := range records {
+		l := &lease{expiresAt: r.ExpiresAt, claimed: r.Claimed, operator: r.Operator}
+		if r.ID == "" || len(r.SecretHash) != hex.EncodedLen(sha256.Size) {
+			continue
+		}
+		if _, ok := status.releasedLeases[r.ID]; ok {
+			continue
+		}
+		if _, err := hex.Decode(l.secretHash[:], []byte(r.SecretHash)); err != nil || l.expired(now) {
+			continue
+		}
+		if existing := m.leases[r.ID]; existing != nil {
+			if existing.serverAddr == serverAddr && !existing.expiresAt.IsZero() &&
+				(l.expiresAt.IsZero() || l.expiresAt.After(existing.expiresAt)) {
+				existing.expiresAt = l.expiresAt
+			}
+			continue
+		}
+		m.addLeaseLocked(serverAddr, status, r.ID, l)
+	}
+}
+
+// replaceLeasesLocked drops the leases of a server that are not among records, after restoreLeasesLocked has
+// added those that are, and makes whether each lease is claimed, and who it was granted to, as in records.
+func (m *Monitor) replaceLeasesLocked(status *Status, records []LeaseRecord) {
+	byID := make(map[string]LeaseRecord, len(records))
+	for _, r := range records {
+		byID[r.ID] = r
+	}
+	for id, l := range status.leases {
+		r, ok := byID[id]
+		if !ok {
+			m.dropLeaseLocked(status, id)
+			continue
+		}
+		l.claimed = r.Claimed
+		l.operator = r.Operator
+	}
+}
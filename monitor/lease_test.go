@@ -0,0 +1,355 @@
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type delistRecorder struct {
+	delisted []string
+}
+
+func (r *delistRecorder) ServerRegistered(serverAddr string) {}
+
+func (r *delistRecorder) ServersDelisted(serverAddrs []string) {
+	r.delisted = append(r.delisted, serverAddrs...)
+}
+
+func newLeaseTestMonitor(t *testing.T) (*Monitor, *fakeClock, *fakePacketConn, *Lease) {
+	t.Helper()
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	clock := newFakeClock()
+	m.Clock = clock
+	m.NewNonce = sequentialNonces()
+	m.LeaseTTL = time.Minute
+	lease, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	return m, clock, newFakePacketConn(), lease
+}
+
+func TestExpiredLeaseDelistsServerThatAnswersPings(t *testing.T) {
+	m, clock, conn, lease := newLeaseTestMonitor(t)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+
+	clock.Advance(50 * time.Second)
+	if _, err := m.RenewLease(lease.ID, lease.Secret); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	clock.Advance(50 * time.Second)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if len(m.ListServers(false)) != 1 {
+		t.Fatal("expected renewed server to be listed")
+	}
+
+	clock.Advance(time.Minute)
+	core, logs := observer.New(zapcore.InfoLevel)
+	delisted := m.sendPings(zap.New(core), conn)
+	if len(delisted) != 1 || delisted[0] != testServerAddr {
+		t.Errorf("expected server to be delisted, got %v", delisted)
+	}
+	if n := logs.FilterMessage("delisting servers").Len(); n != 0 {
+		t.Errorf("expected the server to be delisted only for its lease, got %d delistings for missed pings", n)
+	}
+	if len(m.ListServers(true)) != 0 || len(m.leases) != 0 {
+		t.Error("expected server and lease to be removed")
+	}
+	if _, err := m.RenewLease(lease.ID, lease.Secret); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected ErrUnknownLease, got %v", err)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	m, _, _, lease := newLeaseTestMonitor(t)
+	recorder := &delistRecorder{}
+	m.Listener = recorder
+	// A server only holds more than one lease if they were merged, e.g. from peers
+	other := &Lease{ID: "other", Secret: "other secret"}
+	if err := m.Restore(&Registration{Addr: testServerAddr, Leases: []LeaseRecord{leaseRecord(other)}}); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	if _, err := m.ReleaseLease(lease.ID, other.Secret); !errors.Is(err, ErrWrongLeaseSecret) {
+		t.Errorf("expected ErrWrongLeaseSecret, got %v", err)
+	}
+	if _, err := m.ReleaseLease(lease.ID, lease.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if len(m.ListServers(true)) != 1 || len(recorder.delisted) != 0 {
+		t.Fatal("expected server to stay registered while it has another lease")
+	}
+
+	serverAddr, err := m.ReleaseLease(other.ID, other.Secret)
+	if err != nil || serverAddr != testServerAddr {
+		t.Fatalf("failed to release: %q %v", serverAddr, err)
+	}
+	if len(m.ListServers(true)) != 0 {
+		t.Error("expected server to be removed after releasing its last lease")
+	}
+	if len(recorder.delisted) != 1 || recorder.delisted[0] != testServerAddr {
+		t.Errorf("expected listener to be notified, got %v", recorder.delisted)
+	}
+}
+
+// leaseRecord returns the record of a lease that never expires, for restoring it.
+func leaseRecord(l *Lease) LeaseRecord {
+	secretHash := sha256.Sum256([]byte(l.Secret))
+	return LeaseRecord{ID: l.ID, SecretHash: hex.EncodeToString(secretHash[:])}
+}
+
+func TestRegisteringAgainRenewsHeldLease(t *testing.T) {
+	m, clock, _, lease := newLeaseTestMonitor(t)
+	clock.Advance(50 * time.Second)
+	renewed, err := m.Register(&Registration{Addr: testServerAddr, LeaseID: lease.ID, LeaseSecret: lease.Secret})
+	if err != nil {
+		t.Fatalf("failed to register again: %v", err)
+	}
+	if renewed.ID != lease.ID || !renewed.ExpiresAt.Equal(clock.Now().Add(m.LeaseTTL)) || len(m.leases) != 1 {
+		t.Errorf("expected the lease to be renewed, got %+v and %d leases", renewed, len(m.leases))
+	}
+	if _, err := m.Register(&Registration{Addr: testServerAddr, LeaseID: lease.ID, LeaseSecret: "nope"}); !errors.Is(err, ErrWrongLeaseSecret) {
+		t.Errorf("expected ErrWrongLeaseSecret, got %v", err)
+	}
+	if err := m.AddServer("127.0.0.1:2017"); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	reg := &Registration{Addr: "127.0.0.1:2017", LeaseID: lease.ID, LeaseSecret: lease.Secret}
+	if _, err := m.Register(reg); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected a lease of another server to be refused, got %v", err)
+	}
+}
+
+// Registering a server repeatedly must not let anyone take it from the holder of its lease, e.g. by
+// crowding out the lease and then releasing their own.
+func TestLeaseCantBeTakenOver(t *testing.T) {
+	m, clock, _, owner := newLeaseTestMonitor(t)
+	md := ServerMetadata{Description: "the real one"}
+	if _, err := m.Register(&Registration{Addr: testServerAddr, Metadata: md, LeaseID: owner.ID,
+		LeaseSecret: owner.Secret}); err != nil {
+		t.Fatalf("failed to register again: %v", err)
+	}
+	for i := 0; i < 2*maxLeasesPerServer; i++ {
+		clock.Advance(time.Second)
+		lease, err := m.Register(&Registration{Addr: testServerAddr, Metadata: ServerMetadata{Description: "fake"}})
+		if !errors.Is(err, ErrAlreadyRegistered) || lease != nil {
+			t.Fatalf("expected ErrAlreadyRegistered, got %+v %v", lease, err)
+		}
+	}
+	if _, err := m.RenewLease(owner.ID, owner.Secret); err != nil {
+		t.Errorf("expected the owner's lease to survive, got %v", err)
+	}
+	servers := m.ListServers(true)
+	if len(servers) != 1 || servers[0].Description != "the real one" {
+		t.Errorf("expected the server to be left as it was, got %+v", servers)
+	}
+}
+
+func TestLeasesPerServerAreCapped(t *testing.T) {
+	m, clock, _, _ := newLeaseTestMonitor(t)
+	m.RemoveServer(testServerAddr)
+	alice := &Operator{Name: "alice"}
+	restored := &Registration{Addr: testServerAddr, Operator: alice}
+	for i := 0; i < maxLeasesPerServer; i++ {
+		r := leaseRecord(&Lease{ID: fmt.Sprint("restored", i), Secret: fmt.Sprint("secret", i)})
+		r.ExpiresAt = clock.Now().Add(time.Duration(i+1) * time.Second)
+		restored.Leases = append(restored.Leases, r)
+	}
+	if err := m.Restore(restored); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	var addErr ServerAddError
+	_, err := m.Register(&Registration{Addr: testServerAddr, Operator: alice})
+	if !errors.As(err, &addErr) || addErr.Code != ServerAddErrTooManyLeases {
+		t.Errorf("expected ServerAddErrTooManyLeases, got %v", err)
+	} else if addErr.RetryAfter != time.Second {
+		t.Errorf("expected RetryAfter until the first lease expires, got %v", addErr.RetryAfter)
+	}
+
+	// Once a lease expires, there is room for another, which the operator renews by registering again
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if _, err := m.Register(&Registration{Addr: testServerAddr, Operator: alice}); err != nil {
+			t.Errorf("expected an expired lease to make room: %v", err)
+		}
+		if len(m.leases) != maxLeasesPerServer {
+			t.Errorf("expected %d leases, got %d", maxLeasesPerServer, len(m.leases))
+		}
+	}
+}
+
+// Leases that never expire make no room, so there is no point in retrying.
+func TestLeaseCapHasNoRetryAfterWithoutLeaseTTL(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	alice := &Operator{Name: "alice"}
+	restored := &Registration{Addr: testServerAddr, Operator: alice}
+	for i := 0; i < maxLeasesPerServer; i++ {
+		restored.Leases = append(restored.Leases, leaseRecord(&Lease{ID: fmt.Sprint("restored", i), Secret: "secret"}))
+	}
+	if err := m.Restore(restored); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	var addErr ServerAddError
+	_, err := m.Register(&Registration{Addr: testServerAddr, Operator: alice})
+	if !errors.As(err, &addErr) || addErr.Code != ServerAddErrTooManyLeases {
+		t.Errorf("expected ServerAddErrTooManyLeases, got %v", err)
+	} else if addErr.RetryAfter != 0 {
+		t.Errorf("expected no RetryAfter, got %v", addErr.RetryAfter)
+	}
+}
+
+func TestOperatorRegisteringAgainReplacesItsLease(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	alice := &Operator{Name: "alice"}
+	var previous *Lease
+	for i := 0; i < 2*maxLeasesPerServer; i++ {
+		lease, err := m.Register(&Registration{Addr: testServerAddr, Operator: alice})
+		if err != nil {
+			t.Fatalf("registration %d failed: %v", i+1, err)
+		}
+		if len(m.leases) != 1 {
+			t.Fatalf("expected 1 lease after registration %d, got %d", i+1, len(m.leases))
+		}
+		if previous != nil {
+			if _, err := m.RenewLease(previous.ID, previous.Secret); !errors.Is(err, ErrUnknownLease) {
+				t.Errorf("expected the replaced lease to be gone, got %v", err)
+			}
+		}
+		previous = lease
+	}
+	if _, err := m.RenewLease(previous.ID, previous.Secret); err != nil {
+		t.Errorf("failed to renew the latest lease: %v", err)
+	}
+}
+
+func TestRestoredServerHasNoLease(t *testing.T) {
+	m, clock, conn, _ := newLeaseTestMonitor(t)
+	m.RemoveServer(testServerAddr)
+	if err := m.RestoreServer(testServerAddr); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if delisted := m.sendPings(zap.NewNop(), conn); len(delisted) != 0 {
+		t.Errorf("expected server without leases not to expire, got %v", delisted)
+	}
+}
+
+// Claiming a restored server mustn't let anyone delist it, by releasing the claimed lease or letting it expire.
+func TestClaimedLeaseDoesntDelistServer(t *testing.T) {
+	m, clock, conn, _ := newLeaseTestMonitor(t)
+	m.RemoveServer(testServerAddr)
+	if err := m.RestoreServer(testServerAddr); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	claimed, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	clock.Advance(2 * m.LeaseTTL)
+	if delisted := m.sendPings(zap.NewNop(), conn); len(delisted) != 0 {
+		t.Errorf("expected an expired claimed lease not to delist the server, got %v", delisted)
+	}
+
+	if claimed, err = m.Register(&Registration{Addr: testServerAddr}); err != nil {
+		t.Fatalf("failed to claim again: %v", err)
+	}
+	if _, err := m.ReleaseLease(claimed.ID, claimed.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if _, ok := m.LookupRegistration(testServerAddr); !ok {
+		t.Error("expected releasing a claimed lease to leave the server registered")
+	}
+}
+
+func TestLeasesDontExpireByDefault(t *testing.T) {
+	m, clock, conn, lease := newLeaseTestMonitor(t)
+	m.LeaseTTL = NewMonitor().LeaseTTL
+	if _, err := m.RenewLease(lease.ID, lease.Secret); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	clock.Advance(30 * 24 * time.Hour)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if servers := m.ListServers(false); len(servers) != 1 {
+		t.Errorf("expected a server that never renews its lease to stay listed, got %+v", servers)
+	}
+}
+
+func TestRestoredLeaseCanBeRenewed(t *testing.T) {
+	m, clock, _, lease := newLeaseTestMonitor(t)
+	regs := m.ListRegistrations()
+	if len(regs) != 1 || len(regs[0].Leases) != 1 || regs[0].Leases[0].SecretHash == lease.Secret {
+		t.Fatalf("expected one lease without its secret, got %+v", regs)
+	}
+
+	restored := NewMonitor()
+	restored.AllowSpecialIPs = true
+	restored.Clock = clock
+	restored.LeaseTTL = m.LeaseTTL
+	if err := restored.Restore(regs[0]); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if _, err := restored.RenewLease(lease.ID, lease.Secret); err != nil {
+		t.Errorf("failed to renew a restored lease: %v", err)
+	}
+	if _, err := restored.Register(&Registration{Addr: testServerAddr}); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("expected the restored server to stay bound to its registrant, got %v", err)
+	}
+
+	// Expired leases are not restored
+	clock.Advance(2 * m.LeaseTTL)
+	restored.RemoveServer(testServerAddr)
+	if err := restored.Restore(regs[0]); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if _, err := restored.RenewLease(lease.ID, lease.Secret); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected ErrUnknownLease, got %v", err)
+	}
+}
+
+// Restoring a copy of a registration made before a lease was dropped, e.g. from a peer, mustn't bring the lease
+// back, and restoring a copy made after must drop it.
+func TestRestoreKeepsReleasedLeasesDropped(t *testing.T) {
+	m, _, _, lease := newLeaseTestMonitor(t)
+	other := &Lease{ID: "other", Secret: "other secret"}
+	if err := m.Restore(&Registration{Addr: testServerAddr, Leases: []LeaseRecord{leaseRecord(other)}}); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	stale, _ := m.LookupRegistration(testServerAddr)
+	if _, err := m.ReleaseLease(other.ID, other.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if err := m.Restore(stale); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if _, err := m.RenewLease(other.ID, other.Secret); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected the released lease to stay dropped, got %v", err)
+	}
+
+	peer := NewMonitor()
+	peer.AllowSpecialIPs = true
+	peer.Clock = m.Clock
+	if err := peer.Restore(stale); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	current, _ := m.LookupRegistration(testServerAddr)
+	if err := peer.Restore(current); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if _, err := peer.RenewLease(other.ID, other.Secret); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected the released lease to be dropped by the peer, got %v", err)
+	}
+	if _, err := peer.RenewLease(lease.ID, lease.Secret); err != nil {
+		t.Errorf("expected the other lease to be kept by the peer, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDescriptionLen = 200
+	maxTags           = 10
+	maxTagLen         = 24
+	maxGameModeLen    = 32
+	maxWebsiteLen     = 200
+	maxMaxPlayers     = 10000
+)
+
+var (
+	tagRE      = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	gameModeRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _-]*$`)
+)
+
+// ServerMetadata is optional information that a server operator provides when registering.
+type ServerMetadata struct {
+	Description       string   `json:"description,omitempty"`
+	Tags              []string `json:"tags,omitempty"`
+	MaxPlayers        int      `json:"max_players,omitempty"`
+	GameMode          string   `json:"game_mode,omitempty"`
+	PasswordProtected bool     `json:"password_protected,omitempty"`
+	Website           string   `json:"website,omitempty"`
+}
+
+// Validate checks the lengths and character sets of the fields. Tags are lowercased first.
+func (md *ServerMetadata) Validate() error {
+	if len(md.Description) > maxDescriptionLen || utf8.RuneCountInString(md.Description) > maxDescriptionLen {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLen)
+	}
+	if !utf8.ValidString(md.Description) || strings.IndexFunc(md.Description, unicode.IsControl) >= 0 {
+		return fmt.Errorf("description must be valid UTF-8 without control characters")
+	}
+	if len(md.Tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	for i, tag := range md.Tags {
+		tag = strings.ToLower(tag)
+		if len(tag) > maxTagLen || !tagRE.MatchString(tag) {
+			return fmt.Errorf("tags must be at most %d letters, digits, and hyphens", maxTagLen)
+		}
+		md.Tags[i] = tag
+	}
+	if md.MaxPlayers < 0 || md.MaxPlayers > maxMaxPlayers {
+		return fmt.Errorf("max_players must be between 0 and %d", maxMaxPlayers)
+	}
+	if md.GameMode != "" && (len(md.GameMode) > maxGameModeLen || !gameModeRE.MatchString(md.GameMode)) {
+		return fmt.Errorf("game_mode must be at most %d letters, digits, spaces, underscores, and hyphens", maxGameModeLen)
+	}
+	if md.Website != "" {
+		u, err := url.Parse(md.Website)
+		if len(md.Website) > maxWebsiteLen || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("website must be an http or https URL of at most %d characters", maxWebsiteLen)
+		}
+	}
+	return nil
+}
+
+// HasTag returns whether the metadata has the given tag (case insensitive).
+func (md *ServerMetadata) HasTag(tag string) bool {
+	for _, t := range md.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentFilter checks free-form text provided by server operators before it is shown to players.
+type ContentFilter interface {
+	// Check returns an error if the value of the field (e.g. "description") is not acceptable
+	Check(field, value string) error
+}
+
+// check runs the filter over all free-form fields.
+func (md *ServerMetadata) check(filter ContentFilter) error {
+	fields := []struct{ name, value string }{
+		{"description", md.Description},
+		{"game_mode", md.GameMode},
+		{"website", md.Website},
+	}
+	for _, tag := range md.Tags {
+		fields = append(fields, struct{ name, value string }{"tags", tag})
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		if err := filter.Check(f.name, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WordFilter is a ContentFilter that rejects values containing any of a list of words (case insensitive).
+type WordFilter struct {
+	words []string
+}
+
+// LoadWordFilter reads a WordFilter from a file with one word or phrase per line. Blank lines and lines
+// starting with # are ignored.
+func LoadWordFilter(path string) (*WordFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	wf := &WordFilter{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		wf.words = append(wf.words, strings.ToLower(line))
+	}
+	return wf, scanner.Err()
+}
+
+func NewWordFilter(words ...string) *WordFilter {
+	wf := &WordFilter{}
+	for _, w := range words {
+		wf.words = append(wf.words, strings.ToLower(w))
+	}
+	return wf
+}
+
+func (wf *WordFilter) Check(field, value string) error {
+	lower := strings.ToLower(value)
+	for _, w := range wf.words {
+		if strings.Contains(lower, w) {
+			return fmt.Errorf("%s contains a disallowed word", field)
+		}
+	}
+	return nil
+}
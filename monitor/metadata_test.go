@@ -0,0 +1,113 @@
+package monitor
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestServerMetadataValidate(t *testing.T) {
+	valid := ServerMetadata{
+		Description:       "Friendly games, all welcome ☺",
+		Tags:              []string{"Casual", "eu"},
+		MaxPlayers:        16,
+		GameMode:          "HighLife",
+		PasswordProtected: true,
+		Website:           "https://example.com/conwayste",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected valid metadata, got %v", err)
+	}
+	if valid.Tags[0] != "casual" {
+		t.Errorf("expected tags to be lowercased, got %v", valid.Tags)
+	}
+
+	invalid := []ServerMetadata{
+		{Description: strings.Repeat("x", maxDescriptionLen+1)},
+		{Description: "line\nbreak"},
+		{Description: "bad \xff utf-8"},
+		{Tags: []string{"has space"}},
+		{Tags: make([]string, maxTags+1)},
+		{MaxPlayers: -1},
+		{GameMode: "<script>"},
+		{Website: "javascript:alert(1)"},
+		{Website: "https://"},
+	}
+	for _, md := range invalid {
+		if err := md.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", md)
+		}
+	}
+}
+
+func TestRegisterChecksMetadata(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.ContentFilter = NewWordFilter("badword")
+
+	_, err := m.Register(&Registration{Addr: testServerAddr, Metadata: ServerMetadata{MaxPlayers: -5}})
+	var addErr ServerAddError
+	if !errors.As(err, &addErr) || addErr.Code != ServerAddErrInvalid {
+		t.Errorf("expected ServerAddErrInvalid, got %v", err)
+	}
+	_, err = m.Register(&Registration{Addr: testServerAddr, Metadata: ServerMetadata{Tags: []string{"BadWord"}}})
+	if !errors.As(err, &addErr) || addErr.Code != ServerAddErrContentRejected {
+		t.Errorf("expected ServerAddErrContentRejected, got %v", err)
+	}
+
+	md := ServerMetadata{Description: "first", Tags: []string{"a"}}
+	lease, err := m.Register(&Registration{Addr: testServerAddr, Metadata: md})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	md = ServerMetadata{Description: "second"}
+	reg := &Registration{Addr: testServerAddr, Metadata: md, LeaseID: lease.ID, LeaseSecret: lease.Secret}
+	if _, err := m.Register(reg); err != nil {
+		t.Fatalf("failed to re-register: %v", err)
+	}
+	servers := m.ListServers(true)
+	if len(servers) != 1 || servers[0].Description != "second" || servers[0].HasTag("a") {
+		t.Errorf("expected re-registration to replace metadata, got %+v", servers[0])
+	}
+}
+
+func TestClaimingServerKeepsMetadata(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	restored := &Registration{Addr: testServerAddr, Metadata: ServerMetadata{Description: "restored"}, DNSVerified: true}
+	if err := m.Restore(restored); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	keptRestored := func(when string) {
+		t.Helper()
+		regs := m.ListRegistrations()
+		if len(regs) != 1 || regs[0].Metadata.Description != "restored" || !regs[0].DNSVerified {
+			t.Errorf("%s: expected the restored metadata and verification to be kept, got %+v", when, regs)
+		}
+	}
+
+	// A restored server has no leases, so anyone may claim it, but not change what is known about it
+	lease, err := m.Register(&Registration{Addr: testServerAddr, Metadata: ServerMetadata{Description: "claimed"}})
+	if err != nil || lease == nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	_, err = m.Register(&Registration{Addr: testServerAddr, Metadata: ServerMetadata{Description: "hijacked"}})
+	if !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("expected ErrAlreadyRegistered, got %v", err)
+	}
+	keptRestored("after claiming")
+
+	// Nor by registering again with the claimed lease
+	reg := &Registration{Addr: testServerAddr, Metadata: ServerMetadata{Description: "claimed"}, LeaseID: lease.ID,
+		LeaseSecret: lease.Secret}
+	if _, err := m.Register(reg); err != nil {
+		t.Fatalf("failed to register again: %v", err)
+	}
+	keptRestored("after renewing the claimed lease")
+
+	// Nor delist it by releasing the claimed lease
+	if _, err := m.ReleaseLease(lease.ID, lease.Secret); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	keptRestored("after releasing the claimed lease")
+}
@@ -6,8 +6,12 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/conwayste/registrar/geo"
+	"github.com/conwayste/registrar/version"
+
 	"go.uber.org/zap"
 )
 
@@ -20,45 +24,179 @@ const (
 	maxMissedPings      = 4    // How many missed pings in a row does it take before a server counts as down
 	maxRtts             = 30   // How many of the most recent ping round trip times to use for avg. ping calculation
 	missedPingsToDelist = 3000 // How many missed pings in a row causes delisting, requiring server to re-register
+
+	numPacketWorkers = 8    // How many goroutines process received packets
+	packetQueueSize  = 1024 // How many received packets can wait for a worker before further packets are dropped
 )
 
 type Monitor struct {
-	statuses        map[string]*Status
-	ipToName        map[string]string
-	m               sync.RWMutex // guards statuses and ipToName
+	// Counters for Stats; accessed atomically, so keep them first for alignment
+	pingsSent            uint64
+	pingsTimedOut        uint64
+	repliesReceived      uint64
+	replyRTTTotal        int64 // nanoseconds
+	droppedQueueFull     uint64
+	droppedUnknownSender uint64
+	droppedInvalid       uint64
+	readOnly             int32 // 1 if AddServer is refused; accessed atomically
+
+	statuses map[string]*Status
+	ipToName map[string]string
+	m        sync.RWMutex // guards statuses and ipToName
+	// knownAddrs mirrors the keys of ipToName so that Receive can filter packets without taking m
+	knownAddrs sync.Map
+	// knownIPs maps the IPs of registered servers to counts of packets dropped from unknown ports of them
+	// (*uint64, accessed atomically), for Diagnosis
+	knownIPs        sync.Map
 	AllowSpecialIPs bool
+	// remoteViews are the servers other registrars see as up, keyed by registrar name
+	remoteViews map[string]*remoteView // guarded by m
+	// leases are the leases of all servers, keyed by lease ID
+	leases map[string]*lease // guarded by m
+	// callerUsage counts the servers registered by each caller IP and prefix, for Quotas
+	callerUsage map[string]*quotaUsage // guarded by m
+	// rendezvousRates count rendezvous requests per source IP and introductions per server
+	rendezvousRates map[string]*rateWindow // guarded by m
+	// cookieKey is the secret that ConnectChallenge cookies are keyed with; generated when first needed
+	cookieKey []byte // guarded by m
+	// history is the history of each server, keyed by server address
+	history map[string]*serverHistory // guarded by m
+	// conn is the socket Receive is reading, if it is running; ProbeNow sends on it
+	conn net.PacketConn // guarded by m
+	// stateChanges are waiting to be passed to the StateListener
+	stateChanges []StateChange // guarded by m
+	// Listener, if not nil, is notified of registrations and delistings
+	Listener RegistrationListener
+	// StateListener, if not nil, is notified of every change of a server's state
+	StateListener StateListener
+	// StateThresholds decide when servers change state; they may be replaced before Send and Receive are
+	// started
+	StateThresholds StateThresholds
+	// Locator, if not nil, is used to find the location of each server when it is registered
+	Locator geo.Locator
+	// ContentFilter, if not nil, checks the free-form metadata of each registration
+	ContentFilter ContentFilter
+	// Operators, if not nil, authenticates the API keys of server operators
+	Operators OperatorAuthenticator
+	// Compatibility decides which server versions are deprecated; nil means none are
+	Compatibility *version.Matrix
+	// Quotas limit registrations; the zero value means no limits
+	Quotas Quotas
+	// Resolver looks up the host names of servers
+	Resolver Resolver
+	// DNSVerifier, if not nil, lets servers registered by host name be verified with a TXT record
+	DNSVerifier *DNSVerifier
+	// Clock, NewNonce, PingInterval and LeaseTTL may be replaced before Send and Receive are started, e.g.
+	// for testing
+	Clock        Clock
+	NewNonce     func() uint64
+	PingInterval time.Duration
+	LeaseTTL     time.Duration
+	// RoomListInterval is how often listed servers are asked for their rooms; 0 means never
+	RoomListInterval time.Duration
+	// Rendezvous lets servers behind NAT be pinged at the address they send RendezvousRegister from, and
+	// clients be introduced to them with ConnectRequest. Since those packets come from addresses that aren't
+	// registered, packets from unknown senders are then queued if they look like rendezvous requests, and
+	// dropped by the workers if they turn out not to be. It may be set before Receive is started.
+	Rendezvous bool
 }
 
 func NewMonitor() *Monitor {
 	return &Monitor{
-		statuses: make(map[string]*Status),
-		ipToName: make(map[string]string),
+		statuses:        make(map[string]*Status),
+		ipToName:        make(map[string]string),
+		remoteViews:     make(map[string]*remoteView),
+		leases:          make(map[string]*lease),
+		callerUsage:     make(map[string]*quotaUsage),
+		rendezvousRates: make(map[string]*rateWindow),
+		history:         make(map[string]*serverHistory),
+		Resolver:        net.DefaultResolver,
+		Clock:           realClock{},
+		NewNonce:        rand.Uint64,
+		PingInterval:    delayInterval,
+		LeaseTTL:        defaultLeaseTTL,
+
+		RoomListInterval: defaultRoomListInterval,
+
+		StateThresholds: DefaultStateThresholds(),
 	}
 }
 
 type PublicServerInfo struct {
-	Addr        string `json:"addr"`
-	Name        string `json:"name"`
-	Players     int    `json:"players"`
-	Rooms       int    `json:"rooms"`
-	Version     string `json:"version"`
-	MissedPings int    `json:"missed_pings"`
+	Addr        string      `json:"addr"`
+	Name        string      `json:"name"`
+	Players     int         `json:"players"`
+	Rooms       int         `json:"rooms"`
+	Version     string      `json:"version"`
+	MissedPings int         `json:"missed_pings"`
+	State       ServerState `json:"state"`
+	StateSince  time.Time   `json:"state_since"`
+	// StateSeconds is how long the server has been in its state, as of when it was listed
+	StateSeconds int    `json:"state_seconds"`
+	Region       string `json:"region,omitempty"`
+	Country      string `json:"country,omitempty"`
+	Deprecated   bool   `json:"deprecated,omitempty"`
+	Verified     bool   `json:"verified,omitempty"` // registered by an operator with an API key, or verified by DNS
+	// Reliability is a score from 0 to 100, from the server's uptime over the last day, packet loss, ping
+	// variation, and how often it has gone down and up in the last hour
+	Reliability float64 `json:"reliability"`
+	// Flapping servers go down and up too often; they are only listed with showAll
+	Flapping bool `json:"flapping,omitempty"`
+	// NAT is set if the server is behind NAT, so clients must connect to it with a ConnectRequest
+	NAT bool `json:"nat,omitempty"`
+	// Location is used for sorting by distance; it is not public since it may be fairly precise
+	Location *geo.Location `json:"-"`
+	ServerMetadata
 }
 
+// ListServers lists the servers registered here, merged with the views of other registrars (see
+// SetRemoteServers). If showAll is false, only servers that are up or degraded, and not flapping, are listed.
 func (m *Monitor) ListServers(showAll bool) []*PublicServerInfo {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	infos := m.mergeRemoteServersLocked(m.listLocalServersLocked(showAll))
+	for _, info := range infos {
+		info.Deprecated = m.Compatibility.IsDeprecated(info.Version)
+	}
+	return infos
+}
+
+// ListLocalServers is like ListServers, but only considers the pings sent by this registrar.
+func (m *Monitor) ListLocalServers(showAll bool) []*PublicServerInfo {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return m.listLocalServersLocked(showAll)
+}
+
+func (m *Monitor) listLocalServersLocked(showAll bool) []*PublicServerInfo {
 	infos := []*PublicServerInfo{}
+	now := m.Clock.Now()
 	for serverAddr, status := range m.statuses {
-		if !showAll && status.missedPings > maxMissedPings {
-			// Don't list server that is down
+		if !showAll && (!status.State.Listed() || status.rel.flapping) {
+			// Don't list server that is down, or keeps going down
 			continue
 		}
 		info := &PublicServerInfo{
-			Addr:        serverAddr,
-			Name:        status.ServerName,
-			Players:     int(status.PlayerCount),
-			Rooms:       int(status.RoomCount),
-			Version:     status.ServerVersion,
-			MissedPings: status.missedPings,
+			Addr:         serverAddr,
+			Name:         status.ServerName,
+			Players:      int(status.PlayerCount),
+			Rooms:        int(status.RoomCount),
+			Version:      status.ServerVersion,
+			MissedPings:  status.missedPings,
+			State:        status.State,
+			StateSince:   status.StateSince,
+			StateSeconds: int(now.Sub(status.StateSince) / time.Second),
+			NAT:          status.behindNAT(),
+			Verified:     status.Operator != "" || status.DNSVerified,
+			Reliability:  status.rel.score,
+			Flapping:     status.rel.flapping,
+		}
+		info.ServerMetadata = status.Metadata
+		info.Tags = append([]string(nil), status.Metadata.Tags...)
+		if status.Location != nil {
+			info.Region = status.Location.Region
+			info.Country = status.Location.Country
+			info.Location = status.Location
 		}
 		infos = append(infos, info)
 	}
@@ -66,6 +204,8 @@ func (m *Monitor) ListServers(showAll bool) []*PublicServerInfo {
 }
 
 func (m *Monitor) ListServerAddresses() []string {
+	m.m.RLock()
+	defer m.m.RUnlock()
 	addrs := []string{}
 	for serverAddr := range m.statuses {
 		addrs = append(addrs, serverAddr)
@@ -79,12 +219,22 @@ const (
 	ServerAddErrInvalid ServerAddErrorCode = iota
 	ServerAddErrResolve
 	ServerAddErrIsSpecialIP
+	ServerAddErrReadOnly
+	ServerAddErrContentRejected
+	ServerAddErrOwned         // registered by another operator
+	ServerAddErrOperatorQuota // the operator has registered too many servers
+	ServerAddErrCallerQuota   // the caller's IP or network has registered too many servers today
+	ServerAddErrTargetQuota   // too many servers are registered at the target IP or network
+	ServerAddErrTotalQuota    // too many servers are registered in total
+	ServerAddErrTooManyLeases // the server has as many leases as it may
 )
 
 type ServerAddError struct {
 	Code    ServerAddErrorCode
 	Err     error
 	LogData []zap.Field
+	// RetryAfter, if not zero, is how long to wait before the registration might succeed
+	RetryAfter time.Duration
 }
 
 func NewServerAddError(code ServerAddErrorCode, msg string, logData ...zap.Field) ServerAddError {
@@ -104,36 +254,309 @@ func (a ServerAddError) Unwrap() error {
 	return a.Err
 }
 
+// RegistrationListener is notified when the set of registered servers changes. Its methods are called
+// without any Monitor locks held.
+type RegistrationListener interface {
+	// ServerRegistered is called each time AddServer succeeds, including re-registrations
+	ServerRegistered(serverAddr string)
+	// ServersDelisted is called when servers are delisted for missing too many pings, or because their leases
+	// expired or were released
+	ServersDelisted(serverAddrs []string)
+}
+
+// Registration is a request to register a server.
+type Registration struct {
+	Addr     string // "host:port"
+	Metadata ServerMetadata
+	Operator *Operator // nil if anonymous
+	CallerIP net.IP    // the IP that sent the registration, for Quotas; nil if unknown
+	// DNSVerified is set by Register if the host name has a TXT record with its DNSVerifier token
+	DNSVerified bool
+	// LeaseID and LeaseSecret prove that the registrant holds a lease of the server, when registering it again
+	LeaseID     string
+	LeaseSecret string
+	// Leases are the server's leases, when restoring it or listing registrations; ignored by Register
+	Leases []LeaseRecord
+	// ReleasedLeases are the leases the server dropped recently, which restoring it drops too; ignored by
+	// Register
+	ReleasedLeases []ReleasedLease
+}
+
+// AddServer registers a server without metadata. A server that is already registered is left as it is.
 func (m *Monitor) AddServer(serverAddr string) error {
-	if m == nil {
+	_, err := m.Register(&Registration{Addr: serverAddr})
+	if errors.Is(err, ErrAlreadyRegistered) {
 		return nil
 	}
+	return err
+}
 
-	dst, err := net.ResolveUDPAddr("udp", serverAddr)
+// Register registers a server, and grants the registrant a Lease, which must be renewed to keep the server
+// listed. Only the registrant may register the server again, replacing its metadata: by proving it holds the
+// lease, which is then renewed and returned, or by being the server's operator, which is granted a new lease
+// in place of the one it was granted before. An operator takes over a server no operator owns, and a
+// registrant who proves by DNS that it owns the server takes it over unless a lease holder did too. Anyone
+// else gets ErrAlreadyRegistered.
+func (m *Monitor) Register(reg *Registration) (*Lease, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.ReadOnly() {
+		return nil, NewServerAddError(ServerAddErrReadOnly, "registrar is read-only", zap.String("serverAddr", reg.Addr))
+	}
+	if err := reg.Metadata.Validate(); err != nil {
+		return nil, NewServerAddError(ServerAddErrInvalid, "invalid metadata: "+err.Error(), zap.String("serverAddr", reg.Addr))
+	}
+	if m.ContentFilter != nil {
+		if err := reg.Metadata.check(m.ContentFilter); err != nil {
+			return nil, NewServerAddError(ServerAddErrContentRejected, err.Error(), zap.String("serverAddr", reg.Addr))
+		}
+	}
+	reg.DNSVerified = m.verifyDNS(reg.Addr)
+	grant, l, err := m.newLease()
 	if err != nil {
-		return NewServerAddError(ServerAddErrResolve, "failed to resolve server address",
+		return nil, err
+	}
+	if grant, err = m.addServer(reg, grant, l); err != nil {
+		return nil, err
+	}
+	if m.Listener != nil {
+		m.Listener.ServerRegistered(reg.Addr)
+	}
+	return grant, nil
+}
+
+// SetReadOnly sets whether AddServer refuses all registrations, e.g. on a follower registrar. Other ways of
+// adding and removing servers still work.
+func (m *Monitor) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&m.readOnly, v)
+}
+
+func (m *Monitor) ReadOnly() bool {
+	return atomic.LoadInt32(&m.readOnly) == 1
+}
+
+// RestoreServer is like AddServer, except that the Listener is not notified and the read-only setting is
+// ignored. It is for servers that were registered previously or elsewhere, e.g. by a peer. A new server is
+// left without leases, so whoever registers it next is granted one.
+func (m *Monitor) RestoreServer(serverAddr string) error {
+	_, err := m.addServer(&Registration{Addr: serverAddr}, nil, nil)
+	return err
+}
+
+// Restore is like RestoreServer, but also restores metadata and leases, e.g. when loading a backup. The
+// registration is trusted, so it is not validated or filtered. The leases in reg that haven't expired are
+// added to those the server already has, and a lease it already has keeps whichever expiry is later. The
+// ReleasedLeases of reg are dropped, and so never restored later, nor are those the server dropped itself.
+func (m *Monitor) Restore(reg *Registration) error {
+	_, err := m.addServer(reg, nil, nil)
+	return err
+}
+
+// Replicate is like Restore, but makes the server's leases and operator exactly those of reg, e.g. on a
+// follower copying its primary, so that leases the primary has released or expired can't be used after the
+// follower is promoted. A lease the server already has still keeps whichever expiry is later.
+func (m *Monitor) Replicate(reg *Registration) error {
+	if _, err := m.addServer(reg, nil, nil); err != nil {
+		return err
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	status := m.statuses[reg.Addr]
+	if status == nil {
+		return nil // removed since it was added
+	}
+	if reg.Operator == nil {
+		status.Operator = ""
+	}
+	m.replaceLeasesLocked(status, reg.Leases)
+	return nil
+}
+
+// ListRegistrations returns the registrations of all servers, e.g. for making a backup.
+func (m *Monitor) ListRegistrations() []*Registration {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	regs := make([]*Registration, 0, len(m.statuses))
+	for serverAddr, status := range m.statuses {
+		regs = append(regs, registrationLocked(serverAddr, status))
+	}
+	return regs
+}
+
+// LookupRegistration returns the registration of a server, or false if it is not registered.
+func (m *Monitor) LookupRegistration(serverAddr string) (*Registration, bool) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	status, ok := m.statuses[serverAddr]
+	if !ok {
+		return nil, false
+	}
+	return registrationLocked(serverAddr, status), true
+}
+
+func registrationLocked(serverAddr string, status *Status) *Registration {
+	md := status.Metadata
+	md.Tags = append([]string(nil), md.Tags...)
+	reg := &Registration{Addr: serverAddr, Metadata: md, DNSVerified: status.DNSVerified,
+		Leases: leaseRecordsLocked(status), ReleasedLeases: releasedLeaseRecordsLocked(status)}
+	if status.Operator != "" {
+		reg.Operator = &Operator{Name: status.Operator}
+	}
+	return reg
+}
+
+// addServer adds or updates a server, and returns the lease the registrant holds: grant (attaching l) if the
+// server is new, reg is from its operator or reg takes it over, replacing the leases checkHolderLocked
+// returns, or the lease reg proved it holds, renewed. Registrations without
+// a lease are restored ones, which are trusted, so they are not checked against the owner of the server or
+// Quotas.
+func (m *Monitor) addServer(reg *Registration, grant *Lease, l *lease) (*Lease, error) {
+	serverAddr := reg.Addr
+	dst, err := m.resolveUDPAddr(serverAddr)
+	if err != nil {
+		return nil, NewServerAddError(ServerAddErrResolve, "failed to resolve server address",
 			zap.Error(err), zap.String("serverAddr", serverAddr))
 	}
 	if !m.AllowSpecialIPs && !dst.IP.IsGlobalUnicast() {
-		return NewServerAddError(ServerAddErrIsSpecialIP, "cannot register special IP", zap.String("ip", dst.IP.String()))
+		return nil, NewServerAddError(ServerAddErrIsSpecialIP, "cannot register special IP", zap.String("ip", dst.IP.String()))
+	}
+	var location *geo.Location
+	if m.Locator != nil {
+		if loc, ok := m.Locator.Locate(dst.IP); ok {
+			location = &loc
+		}
 	}
 
 	m.m.Lock()
 	defer m.m.Unlock()
-	if _, ok := m.statuses[serverAddr]; ok {
-		// Already present
-		return nil
+	status := m.statuses[serverAddr]
+	var held *lease
+	var replaced []string
+	if l != nil {
+		if status != nil {
+			if held, replaced, err = m.checkHolderLocked(reg, status); err != nil {
+				return nil, err
+			}
+		}
+		// A lease holder registering anonymously may not own the server, but is trusted with it
+		if held == nil || reg.Operator != nil {
+			if err := m.checkOwnershipLocked(reg, status); err != nil {
+				return nil, err
+			}
+		}
+		if held == nil {
+			if status != nil {
+				if err := m.checkLeaseCapLocked(serverAddr, status, len(replaced)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := m.checkQuotasLocked(reg, dst, status); err != nil {
+			return nil, err
+		}
+	}
+	isNew := status == nil
+	if isNew {
+		status = &Status{
+			inFlight:   make(map[uint64]time.Time),
+			State:      StatePending, // It's not listed until it answers a ping
+			StateSince: m.Clock.Now(),
+		}
+		m.statuses[serverAddr] = status
+
+		status.ResolvedAddr = dst
+		status.Location = location
+		ipStr := dst.String()
+		m.ipToName[ipStr] = serverAddr
+		m.knownAddrs.Store(ipStr, struct{}{})
+		m.knownIPs.LoadOrStore(dst.IP.String(), new(uint64))
 	}
-	status := &Status{
-		inFlight:    make(map[uint64]time.Time),
-		missedPings: maxMissedPings + 1, // It's down until we ping it
+	// Whoever claims a server that has neither leases nor an operator (e.g. one restored from an old backup)
+	// is granted a lease, but unless they prove they own the server by DNS or as its operator, that lease
+	// doesn't let them change what is known about it, even when renewed
+	claimed := l != nil && !isNew && reg.Operator == nil && !reg.DNSVerified && (held == nil || held.claimed)
+	if !claimed {
+		status.Metadata = reg.Metadata
+		status.DNSVerified = reg.DNSVerified
 	}
-	m.statuses[serverAddr] = status
+	if reg.Operator != nil {
+		status.Operator = reg.Operator.Name
+	}
+	switch {
+	case l == nil:
+		m.restoreLeasesLocked(serverAddr, status, reg.Leases, reg.ReleasedLeases)
+	case held != nil:
+		held.expiresAt = m.leaseExpiry()
+		held.claimed = claimed
+		return &Lease{ID: reg.LeaseID, Secret: reg.LeaseSecret, ExpiresAt: held.expiresAt}, nil
+	case l != nil:
+		for _, id := range replaced {
+			m.dropLeaseLocked(status, id)
+		}
+		l.claimed = claimed
+		if reg.Operator != nil {
+			l.operator = reg.Operator.Name
+		}
+		m.addLeaseLocked(serverAddr, status, grant.ID, l)
+	}
+	return grant, nil
+}
 
-	status.ResolvedAddr = dst
-	ipStr := dst.String()
-	m.ipToName[ipStr] = serverAddr
-	return nil
+// RemoveServer delists a server right away, without notifying the Listener. It returns false if the
+// server was not registered.
+func (m *Monitor) RemoveServer(serverAddr string) bool {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.removeServerLocked(serverAddr)
+}
+
+func (m *Monitor) removeServerLocked(serverAddr string) bool {
+	status := m.statuses[serverAddr]
+	if status == nil {
+		return false
+	}
+	m.setStateLocked(serverAddr, status, StateDelisted)
+	m.clearRendezvousLocked(status)
+	delete(m.statuses, serverAddr)
+	for id := range status.leases {
+		delete(m.leases, id)
+	}
+	if status.ResolvedAddr != nil {
+		ipStr := (*status.ResolvedAddr).String()
+		delete(m.ipToName, ipStr)
+		m.knownAddrs.Delete(ipStr)
+		m.forgetIPLocked(status.ResolvedAddr)
+	}
+	return true
+}
+
+// Stats holds counters of the packets the Monitor has sent and received since it was created.
+type Stats struct {
+	PingsSent       uint64
+	PingsTimedOut   uint64
+	RepliesReceived uint64        // Status replies with a recognized nonce
+	ReplyRTTTotal   time.Duration // sum of the round trip times of RepliesReceived
+	// Received packets that were discarded without being processed
+	DroppedQueueFull     uint64 // all packet workers were busy and the queue was full
+	DroppedUnknownSender uint64 // the packet did not come from the address of a registered server
+	DroppedInvalid       uint64 // the packet was not a valid Status packet
+}
+
+func (m *Monitor) Stats() Stats {
+	return Stats{
+		PingsSent:            atomic.LoadUint64(&m.pingsSent),
+		PingsTimedOut:        atomic.LoadUint64(&m.pingsTimedOut),
+		RepliesReceived:      atomic.LoadUint64(&m.repliesReceived),
+		ReplyRTTTotal:        time.Duration(atomic.LoadInt64(&m.replyRTTTotal)),
+		DroppedQueueFull:     atomic.LoadUint64(&m.droppedQueueFull),
+		DroppedUnknownSender: atomic.LoadUint64(&m.droppedUnknownSender),
+		DroppedInvalid:       atomic.LoadUint64(&m.droppedInvalid),
+	}
 }
 
 type Status struct {
@@ -142,11 +565,32 @@ type Status struct {
 	// rtts is a slice of ping round trip times. The newest has the highest index
 	rtts          []time.Duration
 	ResolvedAddr  *net.UDPAddr
+	Location      *geo.Location // nil if unknown
 	ServerVersion string
 	PlayerCount   uint64
 	RoomCount     uint64
 	ServerName    string
-	missedPings   int
+	Metadata      ServerMetadata
+	Operator      string // name of the operator that registered the server; empty if anonymous
+	State         ServerState
+	StateSince    time.Time // when the server entered its State
+	DNSVerified   bool      // whether the host name was verified by DNS when the server was last registered
+	missedPings   int       // in a row
+	answeredPings int       // in a row
+	// leases are keyed by lease ID; empty if the server was not added by Register
+	leases map[string]*lease
+	// releasedLeases are when leases of the server were dropped before they expired, keyed by lease ID
+	releasedLeases map[string]time.Time
+	rel            reliability
+	// rooms is the latest room list, if any; roomQuery is the GetRoomList waiting for an answer, if any
+	rooms          *RoomListing
+	roomQuery      *roomQuery
+	roomsQueriedAt time.Time
+	// rendezvous is where the server was seen by RendezvousRegister, if it was
+	rendezvous *rendezvous
+	diag       diagCounters
+	// probeWaiters are the ProbeNow calls waiting for a reply, keyed by nonce
+	probeWaiters map[uint64]*probeWaiter
 }
 
 // Ping returns the average ping, or nil if unknown.
@@ -174,81 +618,130 @@ func (m *Monitor) Send(ctx context.Context, log *zap.Logger, conn net.PacketConn
 			log.Error("Recovered from panic :-(", zap.Reflect("panicValue", r))
 		}
 	}()
-	ticker := time.NewTicker(delayInterval)
+	ticker := m.Clock.NewTicker(m.PingInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-ticker.C:
+		case <-ticker.C():
 		}
 
-		delistedServerAddrs := []string{}
-		m.m.Lock()
-		func() {
-			defer m.m.Unlock()
-			defer func() {
-				if r := recover(); r != nil {
-					log.Error("Recovered from panic :-( but the show will go on", zap.Reflect("panicValue", r))
-				}
-			}()
-			for serverAddr := range m.statuses {
-				log := log.With(zap.String("serverAddr", serverAddr))
-				log.Debug("sending server ping")
+		delistedServerAddrs := m.sendPings(log, conn)
+		if len(delistedServerAddrs) > 0 && m.Listener != nil {
+			m.Listener.ServersDelisted(delistedServerAddrs)
+		}
+		m.notifyStateChanges()
+	}
+}
 
-				packet := &ServerGetStatus{
-					Nonce: rand.Uint64(),
-				}
-				packetBytes, err := Marshal(packet)
-				if err != nil {
-					log.Error("failed to marshal GetStatus", zap.Error(err))
-					continue
-				}
-				status, ok := m.statuses[serverAddr]
-				if !ok {
-					log.Error("status not found in map for server name")
-					continue
-				}
-				dst := status.ResolvedAddr
-				_, err = conn.WriteTo(packetBytes, dst)
-				if err != nil {
-					log.Error("failed to send GetStatus", zap.Error(err))
-					continue
-				}
-				log.Debug("sent successfully")
-
-				// Keep track of the nonce and send time for later
-				status.inFlight[packet.Nonce] = time.Now()
-				for nonce, sendTime := range status.inFlight {
-					if sendTime.Add(pingTimeout).Before(time.Now()) {
-						// timed out; delete
-						delete(status.inFlight, nonce)
-						status.missedPings += 1
-						if status.missedPings > missedPingsToDelist {
-							delistedServerAddrs = append(delistedServerAddrs, serverAddr)
-						}
-					}
-				}
-			}
+// sendPings sends a GetStatus to every server, times out pings that have gone unanswered for too
+// long, and delists servers that have been unreachable for too long. It returns the delisted servers.
+func (m *Monitor) sendPings(log *zap.Logger, conn net.PacketConn) (delistedServerAddrs []string) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Recovered from panic :-( but the show will go on", zap.Reflect("panicValue", r))
+		}
+	}()
+	// Servers whose leases have expired are not pinged again
+	expiredServerAddrs := m.expireLeasesLocked(log)
+	m.expireCallerUsageLocked()
+	m.expireRendezvousLocked()
+	m.recordHistoryLocked()
+	m.updateReliabilityLocked()
+	for _, serverAddr := range expiredServerAddrs {
+		m.removeServerLocked(serverAddr)
+	}
+	var missedServerAddrs []string // delisted for missing too many pings
+	for serverAddr := range m.statuses {
+		log := log.With(zap.String("serverAddr", serverAddr))
+		log.Debug("sending server ping")
+
+		status, ok := m.statuses[serverAddr]
+		if !ok {
+			log.Error("status not found in map for server name")
+			continue
+		}
+		if err := m.sendGetStatusLocked(log, conn, status, m.NewNonce()); err != nil {
+			continue
+		}
 
-			if len(delistedServerAddrs) > 0 {
-				log.Info("delisting servers", zap.Strings("delistedAddrs", delistedServerAddrs))
-				for _, serverAddr := range delistedServerAddrs {
-					status := m.statuses[serverAddr]
-					if status != nil {
-						delete(m.statuses, serverAddr)
-						if status.ResolvedAddr != nil {
-							delete(m.ipToName, (*status.ResolvedAddr).String())
-						}
+		now := m.Clock.Now()
+		for nonce, sendTime := range status.inFlight {
+			if status.State == StateDelisted {
+				break // by an earlier ping that timed out
+			}
+			if sendTime.Add(pingTimeout).Before(now) {
+				// timed out; delete
+				delete(status.inFlight, nonce)
+				atomic.AddUint64(&m.pingsTimedOut, 1)
+				status.rel.pingTimedOut()
+				neverAnswered := status.State == StatePending
+				switch m.pingMissedLocked(serverAddr, status) {
+				case StateDelisted:
+					missedServerAddrs = append(missedServerAddrs, serverAddr)
+				case StateDown:
+					if neverAnswered {
+						log.Info("server never answered",
+							zap.String("problem", m.diagnosisLocked(serverAddr, status).Problem))
 					}
 				}
 			}
-		}()
+		}
+		m.queryRoomsLocked(log, conn, status, now)
+	}
+
+	if len(missedServerAddrs) > 0 {
+		log.Info("delisting servers", zap.Strings("delistedAddrs", missedServerAddrs))
+		for _, serverAddr := range missedServerAddrs {
+			m.removeServerLocked(serverAddr)
+		}
 	}
+	return append(expiredServerAddrs, missedServerAddrs...)
+}
+
+// packetBufPool holds buffers for received packets, to avoid an allocation per packet
+var packetBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxPacketSize)
+		return &buf
+	},
+}
+
+type receivedPacket struct {
+	remoteAddr *net.UDPAddr
+	bufPtr     *[]byte // from packetBufPool; returned to it after processing
+	n          int
 }
 
 func (m *Monitor) Receive(ctx context.Context, log *zap.Logger, conn net.PacketConn) error {
 	defer func() { log.Debug("Receive exited") }()
-	packetBuf := make([]byte, maxPacketSize)
+
+	m.m.Lock()
+	m.conn = conn // for ProbeNow
+	m.m.Unlock()
+	defer func() {
+		m.m.Lock()
+		m.conn = nil
+		m.m.Unlock()
+	}()
+
+	queue := make(chan *receivedPacket, packetQueueSize)
+	var wg sync.WaitGroup
+	for i := 0; i < numPacketWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.processPackets(ctx, log, conn, queue)
+		}()
+	}
+	defer func() {
+		close(queue)
+		wg.Wait()
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -256,20 +749,22 @@ func (m *Monitor) Receive(ctx context.Context, log *zap.Logger, conn net.PacketC
 		default:
 		}
 
+		// The deadline is for the socket, so it uses the wall clock rather than m.Clock
 		if err := conn.SetReadDeadline(time.Now().Add(packetReadTimeout)); err != nil {
 			log.Error("failed to set read timeout", zap.Error(err))
 		}
-		n, addr, err := conn.ReadFrom(packetBuf)
+		bufPtr := packetBufPool.Get().(*[]byte)
+		n, addr, err := conn.ReadFrom(*bufPtr)
 		if n > 0 {
 			remoteAddr, ok := addr.(*net.UDPAddr)
 			if !ok {
+				packetBufPool.Put(bufPtr)
 				log.Error("unexpected type for address") // Probably can't happen
 				continue
 			}
-
-			pLog := log.With(zap.String("remoteAddr", remoteAddr.String()))
-			go processPacket(ctx, pLog, m, remoteAddr, packetBuf[:n])
-			packetBuf = make([]byte, maxPacketSize)
+			m.enqueuePacket(queue, &receivedPacket{remoteAddr: remoteAddr, bufPtr: bufPtr, n: n})
+		} else {
+			packetBufPool.Put(bufPtr)
 		}
 		if err != nil {
 			var opErr *net.OpError
@@ -281,6 +776,49 @@ func (m *Monitor) Receive(ctx context.Context, log *zap.Logger, conn net.PacketC
 	}
 }
 
+// enqueuePacket hands the packet to a worker, unless the sender is not a registered server (and the packet
+// doesn't look like a rendezvous request, if Rendezvous is set) or the queue is full, in which case the
+// packet is counted and dropped. This must not block, and must not log, since it runs once per received
+// packet.
+func (m *Monitor) enqueuePacket(queue chan<- *receivedPacket, pkt *receivedPacket) {
+	if !m.isKnownAddr(pkt.remoteAddr) &&
+		!(m.Rendezvous && looksLikeRendezvousRequest((*pkt.bufPtr)[:pkt.n])) {
+		m.countUnknownSender(pkt.remoteAddr)
+		packetBufPool.Put(pkt.bufPtr)
+		return
+	}
+	select {
+	case queue <- pkt:
+	default:
+		atomic.AddUint64(&m.droppedQueueFull, 1)
+		packetBufPool.Put(pkt.bufPtr)
+	}
+}
+
+func (m *Monitor) isKnownAddr(addr *net.UDPAddr) bool {
+	_, ok := m.knownAddrs.Load(addr.String())
+	return ok
+}
+
+// processPackets is run by each packet worker until the queue is closed.
+func (m *Monitor) processPackets(ctx context.Context, log *zap.Logger, conn net.PacketConn,
+	queue <-chan *receivedPacket) {
+	for pkt := range queue {
+		pLog := log.With(zap.String("remoteAddr", pkt.remoteAddr.String()))
+		buf := (*pkt.bufPtr)[:pkt.n]
+		switch {
+		case m.Rendezvous && m.processRendezvousPacket(pLog, conn, pkt.remoteAddr, buf):
+		case m.Rendezvous && !m.isKnownAddr(pkt.remoteAddr):
+			// Not filtered out by enqueuePacket
+			m.countUnknownSender(pkt.remoteAddr)
+		default:
+			processPacket(ctx, pLog, m, pkt.remoteAddr, buf)
+		}
+		packetBufPool.Put(pkt.bufPtr)
+		m.notifyStateChanges()
+	}
+}
+
 func processPacket(ctx context.Context, log *zap.Logger, m *Monitor, remoteAddr *net.UDPAddr, buf []byte) {
 	log.Debug("started processing packet")
 	defer func() {
@@ -304,23 +842,41 @@ func processPacket(ctx context.Context, log *zap.Logger, m *Monitor, remoteAddr
 		log.Error("could not find Status by server name")
 		return
 	}
-	status.missedPings = 0
 
-	packetStatus := ServerStatus{}
-	if err := Unmarshal(buf, &packetStatus); err != nil {
+	status.diag.packets++
+
+	var reply serverReply
+	if err := UnmarshalStrict(buf, &reply); err != nil {
+		atomic.AddUint64(&m.droppedInvalid, 1)
+		status.diag.decodeFailures++
+		status.diag.lastDecodeError = err.Error()
+		status.probeDecodeFailedLocked(err)
 		log.Error("failed to unmarshal packet", zap.Error(err))
 		return
 	}
+	if roomList, ok := reply.(ServerRoomList); ok {
+		m.roomListReceivedLocked(log, status, &roomList)
+		return
+	}
+	packetStatus := reply.(ServerStatus)
 
 	log.Debug("received Status packet", zap.Any("packetStatus", packetStatus))
 	nonce := packetStatus.Nonce
 	sentTime, ok := status.inFlight[nonce]
 	if !ok {
+		status.diag.wrongNonces++
 		log.Error("unrecognized nonce from received packet", zap.Uint64("nonce", nonce))
 		return
 	}
 	delete(status.inFlight, nonce)
-	rtt := time.Since(sentTime)
+	// Only valid replies count, so that junk sent from the server's address can't bring it up
+	m.pingAnsweredLocked(serverAddr, status)
+	rtt := m.Clock.Now().Sub(sentTime)
+	atomic.AddUint64(&m.repliesReceived, 1)
+	status.diag.replies++
+	status.probeRepliedLocked(nonce, &packetStatus, rtt)
+	status.rel.pingAnswered()
+	atomic.AddInt64(&m.replyRTTTotal, int64(rtt))
 
 	status.rtts = append(status.rtts, rtt)
 	if len(status.rtts) > maxRtts {
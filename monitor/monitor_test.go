@@ -0,0 +1,264 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestEnqueuePacketDropsUnknownSenderAndFullQueue(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	if err := m.AddServer("127.0.0.1:2016"); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	known := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2016}
+	unknown := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2017}
+
+	queue := make(chan *receivedPacket, 1)
+	newPacket := func(addr *net.UDPAddr) *receivedPacket {
+		return &receivedPacket{remoteAddr: addr, bufPtr: packetBufPool.Get().(*[]byte), n: 1}
+	}
+
+	m.enqueuePacket(queue, newPacket(unknown))
+	m.enqueuePacket(queue, newPacket(known))
+	m.enqueuePacket(queue, newPacket(known)) // queue is full now
+
+	if len(queue) != 1 {
+		t.Errorf("expected 1 queued packet, got %d", len(queue))
+	}
+	expected := Stats{DroppedQueueFull: 1, DroppedUnknownSender: 1}
+	if got := m.Stats(); got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+const testServerAddr = "127.0.0.1:2016"
+
+var testServerUDPAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2016}
+
+func newTestMonitor(t *testing.T) (*Monitor, *fakeClock, *fakePacketConn) {
+	t.Helper()
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	clock := newFakeClock()
+	m.Clock = clock
+	m.NewNonce = sequentialNonces()
+	m.LeaseTTL = 24 * time.Hour // so that leases only expire in tests about them
+	m.RoomListInterval = 0      // so that room lists are only requested in tests about them
+	if err := m.AddServer(testServerAddr); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	return m, clock, newFakePacketConn()
+}
+
+// pingAndReply sends pings, waits rtt, then answers the ping sent to the test server.
+func pingAndReply(t *testing.T, m *Monitor, clock *fakeClock, conn *fakePacketConn, rtt time.Duration) {
+	t.Helper()
+	m.sendPings(zap.NewNop(), conn)
+	clock.Advance(rtt)
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, statusReplyBytes(t, conn))
+}
+
+// statusReplyBytes returns a Status packet answering the last GetStatus written to conn.
+func statusReplyBytes(t *testing.T, conn *fakePacketConn) []byte {
+	t.Helper()
+	written := conn.Written()
+	if len(written) == 0 {
+		t.Fatal("expected a GetStatus to have been sent")
+	}
+	return statusReplyTo(t, written[len(written)-1].buf)
+}
+
+// statusReplyTo returns a Status packet answering the given GetStatus packet.
+func statusReplyTo(t *testing.T, getStatusBytes []byte) []byte {
+	t.Helper()
+	var getStatus ServerGetStatus
+	if err := Unmarshal(getStatusBytes, &getStatus); err != nil {
+		t.Fatalf("failed to unmarshal GetStatus: %v", err)
+	}
+	reply, err := Marshal(&ServerStatus{
+		Nonce:         getStatus.Nonce,
+		ServerVersion: "0.3.2",
+		PlayerCount:   3,
+		RoomCount:     1,
+		ServerName:    "test server",
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal Status: %v", err)
+	}
+	return reply
+}
+
+// missPings sends n pings, each of which times out before the next is sent.
+func missPings(m *Monitor, clock *fakeClock, conn *fakePacketConn, n int) {
+	for i := 0; i < n; i++ {
+		m.sendPings(zap.NewNop(), conn)
+		clock.Advance(delayInterval)
+	}
+	m.sendPings(zap.NewNop(), conn) // times out the last one
+	conn.Written()
+}
+
+func TestServerIsDownUntilReplyReceived(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	if len(m.ListServers(false)) != 0 {
+		t.Fatal("expected server to be unlisted before it replies")
+	}
+
+	pingAndReply(t, m, clock, conn, 100*time.Millisecond)
+
+	servers := m.ListServers(false)
+	if len(servers) != 1 {
+		t.Fatalf("expected 1 listed server, got %d", len(servers))
+	}
+	expected := PublicServerInfo{
+		Addr:       testServerAddr,
+		Name:       "test server",
+		Players:    3,
+		Rooms:      1,
+		Version:    "0.3.2",
+		State:      StateUp,
+		StateSince: clock.Now(),
+	}
+	if !reflect.DeepEqual(*servers[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, *servers[0])
+	}
+	if ping := m.statuses[testServerAddr].CalcPing(); ping == nil || *ping != 100*time.Millisecond {
+		t.Errorf("expected ping of 100ms, got %v", ping)
+	}
+}
+
+func TestServerGoesDownAfterMaxMissedPings(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+
+	missPings(m, clock, conn, maxMissedPings)
+	if len(m.ListServers(false)) != 1 {
+		t.Fatalf("expected server to still be listed after %d missed pings", maxMissedPings)
+	}
+
+	missPings(m, clock, conn, 1)
+	if len(m.ListServers(false)) != 0 {
+		t.Errorf("expected server to be unlisted after %d missed pings", maxMissedPings+1)
+	}
+	if len(m.ListServers(true)) != 1 {
+		t.Errorf("expected down server to still be registered")
+	}
+
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if len(m.ListServers(false)) != 0 {
+		t.Errorf("expected server to stay down until it has answered %d pings", m.StateThresholds.UpAfter)
+	}
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if len(m.ListServers(false)) != 1 {
+		t.Errorf("expected server to be listed again after %d replies", m.StateThresholds.UpAfter)
+	}
+}
+
+func TestLatePingReplyIsNotCounted(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.sendPings(zap.NewNop(), conn)
+	reply := statusReplyBytes(t, conn)
+	clock.Advance(pingTimeout + time.Millisecond)
+	m.sendPings(zap.NewNop(), conn) // times out the first ping
+
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, reply)
+	if ping := m.statuses[testServerAddr].CalcPing(); ping != nil {
+		t.Errorf("expected no ping from a timed out reply, got %v", *ping)
+	}
+}
+
+func TestServerIsDelistedAfterMissedPingsToDelist(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+
+	missPings(m, clock, conn, missedPingsToDelist)
+	if len(m.ListServers(true)) != 1 {
+		t.Fatalf("expected server to still be registered after %d missed pings", missedPingsToDelist)
+	}
+
+	missPings(m, clock, conn, 1)
+	if len(m.ListServers(true)) != 0 {
+		t.Errorf("expected server to be delisted after %d missed pings", missedPingsToDelist+1)
+	}
+	if len(m.ipToName) != 0 {
+		t.Errorf("expected ipToName to be cleaned up, got %v", m.ipToName)
+	}
+	if _, ok := m.knownAddrs.Load(testServerUDPAddr.String()); ok {
+		t.Errorf("expected knownAddrs to be cleaned up")
+	}
+}
+
+func TestPingIsAveragedOverRecentRtts(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	for i := 1; i <= maxRtts+10; i++ {
+		pingAndReply(t, m, clock, conn, time.Duration(i)*time.Millisecond)
+		clock.Advance(delayInterval)
+	}
+
+	status := m.statuses[testServerAddr]
+	if len(status.rtts) != maxRtts {
+		t.Fatalf("expected %d rtts, got %d", maxRtts, len(status.rtts))
+	}
+	// Average of 11ms through 40ms
+	expected := 25500 * time.Microsecond
+	if ping := status.CalcPing(); ping == nil || *ping != expected {
+		t.Errorf("expected ping of %v, got %v", expected, ping)
+	}
+}
+
+func TestSendAndReceiveThroughPacketConn(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 2)
+	go func() { done <- m.Send(ctx, zap.NewNop(), conn) }()
+	go func() { done <- m.Receive(ctx, zap.NewNop(), conn) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.ListServers(false)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for server to be listed")
+		}
+		clock.Advance(delayInterval)
+		time.Sleep(time.Millisecond)
+		for _, pkt := range conn.Written() {
+			conn.Deliver(statusReplyTo(t, pkt.buf), testServerUDPAddr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	}
+}
+
+func TestInvalidReplyIsDropped(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.sendPings(zap.NewNop(), conn)
+	reply := statusReplyBytes(t, conn)
+	clock.Advance(100 * time.Millisecond)
+
+	junk := append(append([]byte(nil), reply...), 0) // trailing byte
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, junk)
+	if len(m.ListServers(false)) != 0 {
+		t.Fatal("expected an invalid reply not to list the server")
+	}
+	if got := m.Stats(); got.DroppedInvalid != 1 || got.RepliesReceived != 0 {
+		t.Errorf("expected 1 invalid and 0 received replies, got %+v", got)
+	}
+
+	// The nonce is still in flight, so a valid reply is accepted
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, reply)
+	if len(m.ListServers(false)) != 1 {
+		t.Error("expected a valid reply to list the server")
+	}
+}
@@ -0,0 +1,110 @@
+package monitor
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNotRegistered = errors.New("server is not registered")
+	ErrNotOwner      = errors.New("server is registered by another operator")
+)
+
+// Operator identifies who registered a server, when they authenticated with an API key. Servers registered
+// by an operator are listed as verified, and only that operator can register them again.
+type Operator struct {
+	Name       string
+	MaxServers int // the most servers the operator may have registered at once; 0 means no limit
+}
+
+// OperatorAuthenticator looks up the operator an API key belongs to.
+type OperatorAuthenticator interface {
+	Authenticate(apiKey string) (*Operator, bool)
+}
+
+// checkOwnershipLocked checks whether reg may register (or re-register) a server, which is existing if it
+// is already registered.
+func (m *Monitor) checkOwnershipLocked(reg *Registration, existing *Status) error {
+	owner := ""
+	if existing != nil {
+		owner = existing.Operator
+	}
+	if reg.Operator == nil {
+		if owner != "" {
+			return NewServerAddError(ServerAddErrOwned, ErrNotOwner.Error(), zap.String("serverAddr", reg.Addr))
+		}
+		return nil
+	}
+	if owner != "" && owner != reg.Operator.Name {
+		return NewServerAddError(ServerAddErrOwned, ErrNotOwner.Error(), zap.String("serverAddr", reg.Addr),
+			zap.String("operator", reg.Operator.Name))
+	}
+	if owner == reg.Operator.Name || reg.Operator.MaxServers == 0 {
+		return nil
+	}
+	owned := 0
+	for _, status := range m.statuses {
+		if status.Operator == reg.Operator.Name {
+			owned++
+		}
+	}
+	if owned >= reg.Operator.MaxServers {
+		return NewServerAddError(ServerAddErrOperatorQuota, "operator has registered the most servers allowed",
+			zap.String("operator", reg.Operator.Name), zap.Int("maxServers", reg.Operator.MaxServers))
+	}
+	return nil
+}
+
+// ListOperatorServers lists all servers registered by an operator, whether or not they are up.
+func (m *Monitor) ListOperatorServers(operator string) []*PublicServerInfo {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	infos := []*PublicServerInfo{}
+	for _, info := range m.listLocalServersLocked(true) {
+		if m.statuses[info.Addr].Operator == operator {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// RemoveOperatorServer delists a server registered by an operator, and notifies the Listener.
+func (m *Monitor) RemoveOperatorServer(operator, serverAddr string) error {
+	m.m.Lock()
+	status := m.statuses[serverAddr]
+	if status == nil {
+		m.m.Unlock()
+		return ErrNotRegistered
+	}
+	if status.Operator != operator {
+		m.m.Unlock()
+		return ErrNotOwner
+	}
+	m.removeServerLocked(serverAddr)
+	m.m.Unlock()
+
+	if m.Listener != nil {
+		m.Listener.ServersDelisted([]string{serverAddr})
+	}
+	return nil
+}
+
+// DisownServers makes the servers registered by an operator anonymous, e.g. because the operator was
+// deleted. Their leases, which were granted to the operator, are dropped, so that anyone may claim them. It
+// returns how many there were.
+func (m *Monitor) DisownServers(operator string) int {
+	m.m.Lock()
+	defer m.m.Unlock()
+	n := 0
+	for _, status := range m.statuses {
+		if status.Operator == operator {
+			status.Operator = ""
+			for id := range status.leases {
+				m.dropLeaseLocked(status, id)
+			}
+			n++
+		}
+	}
+	return n
+}
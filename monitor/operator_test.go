@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOperatorOwnershipAndQuota(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	alice := &Operator{Name: "alice", MaxServers: 2}
+	bob := &Operator{Name: "bob"}
+
+	if _, err := m.Register(&Registration{Addr: "127.0.0.1:1"}); err != nil {
+		t.Fatalf("failed to register anonymously: %v", err)
+	}
+	// Taking over an anonymous server counts towards the quota
+	claims := []*Registration{
+		{Addr: "127.0.0.1:1", Operator: alice},
+		{Addr: "127.0.0.1:2", Operator: alice},
+	}
+	for _, reg := range claims {
+		if _, err := m.Register(reg); err != nil {
+			t.Fatalf("failed to register %s: %v", reg.Addr, err)
+		}
+	}
+	var addErr ServerAddError
+	_, err := m.Register(&Registration{Addr: "127.0.0.1:3", Operator: alice})
+	if !errors.As(err, &addErr) || addErr.Code != ServerAddErrOperatorQuota {
+		t.Errorf("expected ServerAddErrOperatorQuota, got %v", err)
+	}
+	if _, err := m.Register(&Registration{Addr: "127.0.0.1:2", Operator: alice}); err != nil {
+		t.Errorf("expected re-registering an owned server not to count against the quota: %v", err)
+	}
+	for _, reg := range []*Registration{{Addr: "127.0.0.1:2", Operator: bob}, {Addr: "127.0.0.1:2"}} {
+		_, err := m.Register(reg)
+		if !errors.As(err, &addErr) || addErr.Code != ServerAddErrOwned {
+			t.Errorf("expected ServerAddErrOwned, got %v", err)
+		}
+	}
+
+	owned := m.ListOperatorServers("alice")
+	if len(owned) != 2 || !owned[0].Verified {
+		t.Errorf("expected 2 verified servers, got %+v", owned)
+	}
+	if err := m.RemoveOperatorServer("bob", "127.0.0.1:1"); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("expected ErrNotOwner, got %v", err)
+	}
+	if err := m.RemoveOperatorServer("alice", "127.0.0.1:1"); err != nil {
+		t.Errorf("failed to remove: %v", err)
+	}
+	if err := m.RemoveOperatorServer("alice", "127.0.0.1:1"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("expected ErrNotRegistered, got %v", err)
+	}
+
+	if n := m.DisownServers("alice"); n != 1 {
+		t.Errorf("expected 1 server to be disowned, got %d", n)
+	}
+	if _, err := m.Register(&Registration{Addr: "127.0.0.1:2", Operator: bob}); err != nil {
+		t.Errorf("expected disowned server to be claimable: %v", err)
+	}
+}
+
+func TestRestoreKeepsOperator(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	if err := m.Restore(&Registration{Addr: testServerAddr, Operator: &Operator{Name: "alice"}}); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	regs := m.ListRegistrations()
+	if len(regs) != 1 || regs[0].Operator == nil || regs[0].Operator.Name != "alice" {
+		t.Errorf("expected registration owned by alice, got %+v", regs)
+	}
+}
+
+// Registering a server anonymously before its operator mustn't keep the operator from registering it.
+func TestOperatorTakesOverAnonymousServer(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	squatter, err := m.Register(&Registration{Addr: testServerAddr, Metadata: ServerMetadata{Description: "spam"}})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	alice := &Operator{Name: "alice"}
+	if _, err := m.Register(&Registration{Addr: testServerAddr, Operator: alice,
+		Metadata: ServerMetadata{Description: "real"}}); err != nil {
+		t.Fatalf("expected the operator to take the server over, got %v", err)
+	}
+	regs := m.ListRegistrations()
+	if len(regs) != 1 || regs[0].Operator == nil || regs[0].Operator.Name != "alice" ||
+		regs[0].Metadata.Description != "real" || len(regs[0].Leases) != 1 {
+		t.Errorf("expected the server to be alice's, with her metadata and lease only, got %+v", regs)
+	}
+	reg := &Registration{Addr: testServerAddr, LeaseID: squatter.ID, LeaseSecret: squatter.Secret}
+	if _, err := m.Register(reg); !errors.Is(err, ErrUnknownLease) {
+		t.Errorf("expected the squatter's lease to be dropped, got %v", err)
+	}
+
+	var addErr ServerAddError
+	_, err = m.Register(&Registration{Addr: testServerAddr, Operator: &Operator{Name: "bob"}})
+	if !errors.As(err, &addErr) || addErr.Code != ServerAddErrOwned {
+		t.Errorf("expected ServerAddErrOwned, got %v", err)
+	}
+}
@@ -1,131 +1,150 @@
 package monitor
 
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
-	"io"
+	"github.com/conwayste/registrar/codec"
 )
 
+// ServerGetStatus and ServerStatus are variants of netwayste's Packet enum. Their wire format is derived by
+// the codec package from these definitions. The limits on ServerStatus are checked by UnmarshalStrict, so that
+// a server can't put junk in what the registrar publishes.
 type ServerGetStatus struct {
+	_     struct{} `nw:"variant=4"`
 	Nonce uint64
 }
 
 type ServerStatus struct {
+	_             struct{} `nw:"variant=5"`
 	Nonce         uint64
-	ServerVersion string
-	PlayerCount   uint64
-	RoomCount     uint64
-	ServerName    string
+	ServerVersion string `nw:"max=64,text"`
+	PlayerCount   uint64 `nw:"max=100000"`
+	RoomCount     uint64 `nw:"max=10000"`
+	ServerName    string `nw:"max=128,text"`
+}
+
+// ServerGetRoomList asks a server for its rooms, and ServerRoomList is one part of the answer. A server with
+// many rooms splits them across parts, each small enough for a datagram; the parts of an answer share the
+// request's nonce, and are numbered from 0 to Parts-1.
+//
+// Their variant numbers are provisional: they are not reserved in netwayste's Packet enum, where they may mean
+// something else, which is why room lists are only requested if Monitor.RoomListInterval is set.
+type ServerGetRoomList struct {
+	_     struct{} `nw:"variant=6"`
+	Nonce uint64
+}
+
+type ServerRoomList struct {
+	_     struct{} `nw:"variant=7"`
+	Nonce uint64
+	Part  uint8
+	Parts uint8
+	Rooms []RoomInfo `nw:"max=128"`
+}
+
+// RoomInfo describes one room of a server.
+type RoomInfo struct {
+	Name       string `json:"name" nw:"max=64,text"`
+	Players    uint32 `json:"players" nw:"max=1000"`
+	Capacity   uint32 `json:"capacity" nw:"max=1000"` // 0 if the room has no limit
+	InProgress bool   `json:"in_progress"`            // whether a game is being played in the room
+}
+
+// These packets let a client connect to a server behind NAT through the registrar (see Monitor.Rendezvous).
+// RendezvousRegister is sent by the server, from its game socket, to open a NAT mapping to the registrar and
+// prove that it holds a lease of the server; it is answered with RendezvousRegistered. ConnectRequest is sent
+// by a client, and answered by a PeerAddress to both the client and the server, after which each can send to
+// the other's address to punch through their NATs. So that no one can send PeerAddress to an address they
+// don't receive at, a ConnectRequest without a valid cookie is only answered with a ConnectChallenge, which is
+// smaller than the request, and whose cookie the client sends back in its ConnectRequest. A request that fails
+// is answered with RendezvousError, unless it is a RendezvousRegister without a valid lease, which is dropped.
+// Addresses are "ip:port" as seen by the registrar.
+//
+// Like those of the room list packets, their variant numbers (8 to 13) are provisional until they are reserved
+// in netwayste's Packet enum, which is one reason Monitor.Rendezvous is off by default.
+type RendezvousRegister struct {
+	_           struct{} `nw:"variant=8"`
+	Nonce       uint64
+	LeaseID     string `nw:"max=64,text"`
+	LeaseSecret string `nw:"max=128,text"`
+}
+
+type RendezvousRegistered struct {
+	_            struct{} `nw:"variant=9"`
+	Nonce        uint64
+	ObservedAddr string `nw:"max=64,text"`
+}
+
+type ConnectRequest struct {
+	_          struct{} `nw:"variant=10"`
+	Nonce      uint64
+	ServerAddr string `nw:"max=255,text"` // as registered, e.g. "myserver.example.com:2016"
+	Cookie     uint64 // from a ConnectChallenge; 0 if the client hasn't been sent one
+}
+
+type PeerAddress struct {
+	_        struct{} `nw:"variant=11"`
+	Nonce    uint64   // the ConnectRequest's nonce
+	PeerAddr string   `nw:"max=64,text"`
+}
+
+type RendezvousError struct {
+	_      struct{} `nw:"variant=12"`
+	Nonce  uint64
+	Reason string `nw:"max=255,text"`
+}
+
+type ConnectChallenge struct {
+	_      struct{} `nw:"variant=13"`
+	Nonce  uint64   // the ConnectRequest's nonce
+	Cookie uint64
+}
+
+// rendezvousRequest is a rendezvous packet the registrar receives.
+type rendezvousRequest interface {
+	isRendezvousRequest()
+}
+
+func (RendezvousRegister) isRendezvousRequest() {}
+func (ConnectRequest) isRendezvousRequest()     {}
+
+// serverReply is a packet a server sends to the registrar.
+type serverReply interface {
+	isServerReply()
+}
+
+func (ServerStatus) isServerReply()   {}
+func (ServerRoomList) isServerReply() {}
+
+func init() {
+	codec.RegisterEnum((*serverReply)(nil), ServerStatus{}, ServerRoomList{})
+	codec.RegisterEnum((*rendezvousRequest)(nil), RendezvousRegister{}, ConnectRequest{})
 }
 
 var (
-	ErrUnknownType  = errors.New("unknown type for marshal/unmarshal operation")
-	ErrMalformed    = errors.New("malformed packet")
-	ErrWrongVariant = errors.New("wrong variant")
+	ErrUnknownType  = codec.ErrUnsupportedType
+	ErrMalformed    = codec.ErrMalformed
+	ErrWrongVariant = codec.ErrWrongVariant
+
+	// Reasons for a *codec.DecodeError, which also matches ErrMalformed
+	ErrTruncated     = codec.ErrTruncated
+	ErrTrailingBytes = codec.ErrTrailingBytes
+	ErrTooLong       = codec.ErrTooLong
+	ErrInvalidText   = codec.ErrInvalidText
+	ErrOutOfRange    = codec.ErrOutOfRange
 )
 
+// Marshal encodes a packet, such as a *ServerGetStatus.
 func Marshal(v interface{}) ([]byte, error) {
-	buf := &bytes.Buffer{}
-	switch msg := v.(type) {
-	case *ServerGetStatus:
-		variantNum := uint32(4)
-		if err := binary.Write(buf, binary.LittleEndian, &variantNum); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(buf, binary.LittleEndian, &msg.Nonce); err != nil {
-			return nil, err
-		}
-	case *ServerStatus:
-		variantNum := uint32(5)
-		if err := binary.Write(buf, binary.LittleEndian, &variantNum); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(buf, binary.LittleEndian, &msg.Nonce); err != nil {
-			return nil, err
-		}
-		if err := writeString(buf, msg.ServerVersion); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(buf, binary.LittleEndian, &msg.PlayerCount); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(buf, binary.LittleEndian, &msg.RoomCount); err != nil {
-			return nil, err
-		}
-		if err := writeString(buf, msg.ServerName); err != nil {
-			return nil, err
-		}
-	default:
-		return nil, ErrUnknownType
-	}
-	return buf.Bytes(), nil
-}
-
-func writeString(buf io.Writer, s string) error {
-	sLen := uint64(len(s))
-	if err := binary.Write(buf, binary.LittleEndian, &sLen); err != nil {
-		return err
-	}
-	_, err := buf.Write([]byte(s))
-	return err
+	return codec.Marshal(v)
 }
 
+// Unmarshal decodes a packet into v, such as a *ServerStatus. It returns ErrWrongVariant if the packet is
+// of another type.
 func Unmarshal(packetBytes []byte, v interface{}) error {
-	var variantNum uint32
-	buf := bytes.NewBuffer(packetBytes)
-	if err := binary.Read(buf, binary.LittleEndian, &variantNum); err != nil {
-		return err
-	}
-	switch msg := v.(type) {
-	case *ServerGetStatus:
-		if variantNum != 4 {
-			return ErrWrongVariant
-		}
-		if err := binary.Read(buf, binary.LittleEndian, &msg.Nonce); err != nil {
-			return err
-		}
-	case *ServerStatus:
-		if variantNum != 5 {
-			return ErrWrongVariant
-		}
-		if err := binary.Read(buf, binary.LittleEndian, &msg.Nonce); err != nil {
-			return err
-		}
-		serverVersion, err := readString(buf)
-		if err != nil {
-			return err
-		}
-		msg.ServerVersion = serverVersion
-		if err := binary.Read(buf, binary.LittleEndian, &msg.PlayerCount); err != nil {
-			return err
-		}
-		if err := binary.Read(buf, binary.LittleEndian, &msg.RoomCount); err != nil {
-			return err
-		}
-		serverName, err := readString(buf)
-		if err != nil {
-			return err
-		}
-		msg.ServerName = serverName
-	default:
-		return ErrUnknownType
-	}
-	return nil
-}
-
-func readString(buf *bytes.Buffer) (string, error) {
-	var sLen uint64
-	if err := binary.Read(buf, binary.LittleEndian, &sLen); err != nil {
-		return "", err
-	}
-	if sLen > uint64(buf.Len()) {
-		return "", ErrMalformed
-	}
-	sBuf := make([]byte, int(sLen))
-	_, err := buf.Read(sBuf)
-	if err != nil {
-		return "", err
-	}
-	return string(sBuf), nil
+	return codec.Unmarshal(packetBytes, v)
+}
+
+// UnmarshalStrict is like Unmarshal, but rejects trailing bytes and values that break the limits of the packet
+// type, such as an overlong ServerName. Use it for packets from game servers.
+func UnmarshalStrict(packetBytes []byte, v interface{}) error {
+	return codec.UnmarshalStrict(packetBytes, v)
 }
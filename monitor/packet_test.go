@@ -1,7 +1,13 @@
 package monitor
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,3 +59,107 @@ func TestUnmarshalStatus(t *testing.T) {
 		t.Errorf("expected %+v, got %+v", expectedStatus, status)
 	}
 }
+
+func TestUnmarshalStatusStrict(t *testing.T) {
+	var status ServerStatus
+	if err := UnmarshalStrict(inputStatusBytes, &status); err != nil || status != expectedStatus {
+		t.Fatalf("expected %+v, got %+v %v", expectedStatus, status, err)
+	}
+
+	tests := []struct {
+		desc   string
+		status ServerStatus
+		reason error
+	}{
+		{"long name", ServerStatus{ServerName: strings.Repeat("x", 129)}, ErrTooLong},
+		{"long version", ServerStatus{ServerVersion: strings.Repeat("1", 65)}, ErrTooLong},
+		{"invalid UTF-8", ServerStatus{ServerName: "bad\xff"}, ErrInvalidText},
+		{"control character", ServerStatus{ServerName: "<script>\x1b[2J"}, ErrInvalidText},
+		{"too many players", ServerStatus{PlayerCount: 1 << 63}, ErrOutOfRange},
+		{"too many rooms", ServerStatus{RoomCount: 10001}, ErrOutOfRange},
+	}
+	for _, test := range tests {
+		b, err := Marshal(&test.status)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %v", test.desc, err)
+		}
+		if err := Unmarshal(b, &status); err != nil {
+			t.Errorf("%s: expected Unmarshal to accept it, got %v", test.desc, err)
+		}
+		if err := UnmarshalStrict(b, &status); !errors.Is(err, ErrMalformed) || !errors.Is(err, test.reason) {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.reason, err)
+		}
+	}
+
+	trailing := append(append([]byte(nil), inputStatusBytes...), 0)
+	if err := UnmarshalStrict(trailing, &status); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("expected ErrTrailingBytes, got %v", err)
+	}
+}
+
+// goldenPackets are the decoded packets of testdata/packets.golden, in order.
+var goldenPackets = []interface{}{
+	&ServerGetStatus{Nonce: 0x123456789ABCDEF0},
+	&expectedStatus,
+	&ServerStatus{Nonce: 1},
+}
+
+// provisionalGoldenPackets are the decoded packets of testdata/provisional_packets.golden, in order.
+var provisionalGoldenPackets = []interface{}{
+	&ServerGetRoomList{Nonce: 2},
+	&ServerRoomList{Nonce: 2, Part: 1, Parts: 2, Rooms: []RoomInfo{{Name: "lobby", Players: 3, Capacity: 8, InProgress: true}}},
+	&RendezvousRegister{Nonce: 1, LeaseID: "id", LeaseSecret: "secret"},
+	&RendezvousRegistered{Nonce: 1, ObservedAddr: "1.2.3.4:5"},
+	&ConnectRequest{Nonce: 2, ServerAddr: "a.b:1", Cookie: 3},
+	&PeerAddress{Nonce: 2, PeerAddr: "1.2.3.4:5"},
+	&RendezvousError{Nonce: 2, Reason: "no"},
+	&ConnectChallenge{Nonce: 2, Cookie: 3},
+}
+
+func TestGoldenPackets(t *testing.T) {
+	checkGoldenPackets(t, "testdata/packets.golden", goldenPackets)
+}
+
+func TestProvisionalGoldenPackets(t *testing.T) {
+	checkGoldenPackets(t, "testdata/provisional_packets.golden", provisionalGoldenPackets)
+}
+
+// checkGoldenPackets checks that each line of a golden file is the encoding of the packet at the same index.
+func checkGoldenPackets(t *testing.T, path string, goldenPackets []interface{}) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	i := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		expectedBytes, err := hex.DecodeString(strings.Join(fields[1:], ""))
+		if err != nil {
+			t.Fatalf("bad hex in %q: %v", line, err)
+		}
+		if i >= len(goldenPackets) {
+			t.Fatalf("no expected packet for %q", line)
+		}
+		expected := goldenPackets[i]
+		i++
+
+		gotBytes, err := Marshal(expected)
+		if err != nil || !bytes.Equal(gotBytes, expectedBytes) {
+			t.Errorf("%s: expected %x, got %x %v", fields[0], expectedBytes, gotBytes, err)
+		}
+		got := reflect.New(reflect.TypeOf(expected).Elem()).Interface()
+		if err := UnmarshalStrict(expectedBytes, got); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %+v, got %+v %v", fields[0], expected, got, err)
+		}
+	}
+	if i != len(goldenPackets) {
+		t.Errorf("expected %d golden packets, got %d", len(goldenPackets), i)
+	}
+}
@@ -0,0 +1,123 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNotReceiving = errors.New("registrar is not receiving packets")
+	ErrProbeTimeout = errors.New("no reply before the timeout")
+)
+
+// ProbeReply is a server's answer to a GetStatus sent by ProbeNow.
+type ProbeReply struct {
+	Name      string        `json:"name"`
+	Version   string        `json:"version"`
+	Players   uint64        `json:"players"`
+	Rooms     uint64        `json:"rooms"`
+	RTT       time.Duration `json:"-"`
+	RTTMillis float64       `json:"rtt_ms"`
+}
+
+// probeWaiter is a ProbeNow waiting for the reply to its GetStatus.
+type probeWaiter struct {
+	reply chan *ProbeReply // buffered, so that the reply can be sent while holding m
+	// decodeErr is the last error decoding a packet from the server while waiting
+	decodeErr error
+}
+
+// ProbeNow sends a GetStatus to a registered server right away, on the socket Receive is reading, and waits
+// until ctx is done for the reply. The ping is tracked like those sent by Send, so its reply counts towards
+// the server's state, and if it is lost it will time out like them. If no reply arrives, the error is
+// ErrProbeTimeout, or, if packets that failed to decode arrived from the server meanwhile, wraps the last
+// decoding error.
+func (m *Monitor) ProbeNow(ctx context.Context, log *zap.Logger, serverAddr string) (*ProbeReply, error) {
+	m.m.Lock()
+	if m.conn == nil {
+		m.m.Unlock()
+		return nil, ErrNotReceiving
+	}
+	status, ok := m.statuses[serverAddr]
+	if !ok {
+		m.m.Unlock()
+		return nil, ErrNotRegistered
+	}
+	nonce := m.NewNonce()
+	if err := m.sendGetStatusLocked(log, m.conn, status, nonce); err != nil {
+		m.m.Unlock()
+		return nil, err
+	}
+	w := &probeWaiter{reply: make(chan *ProbeReply, 1)}
+	if status.probeWaiters == nil {
+		status.probeWaiters = make(map[uint64]*probeWaiter)
+	}
+	status.probeWaiters[nonce] = w
+	m.m.Unlock()
+
+	select {
+	case reply := <-w.reply:
+		return reply, nil
+	case <-ctx.Done():
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	delete(status.probeWaiters, nonce)
+	select {
+	case reply := <-w.reply: // Arrived while taking the lock
+		return reply, nil
+	default:
+	}
+	if w.decodeErr != nil {
+		return nil, fmt.Errorf("no valid reply before the timeout: %w", w.decodeErr)
+	}
+	return nil, ErrProbeTimeout
+}
+
+// sendGetStatusLocked sends a GetStatus to a server, and records it as in flight.
+func (m *Monitor) sendGetStatusLocked(log *zap.Logger, conn net.PacketConn, status *Status, nonce uint64) error {
+	packetBytes, err := Marshal(&ServerGetStatus{Nonce: nonce})
+	if err != nil {
+		log.Error("failed to marshal GetStatus", zap.Error(err))
+		return err
+	}
+	if _, err := conn.WriteTo(packetBytes, status.pingAddr()); err != nil {
+		log.Error("failed to send GetStatus", zap.Error(err))
+		return err
+	}
+	log.Debug("sent successfully")
+	atomic.AddUint64(&m.pingsSent, 1)
+	status.diag.pingsSent++
+	status.inFlight[nonce] = m.Clock.Now()
+	return nil
+}
+
+// probeRepliedLocked hands a reply to the ProbeNow waiting for it, if any.
+func (s *Status) probeRepliedLocked(nonce uint64, packetStatus *ServerStatus, rtt time.Duration) {
+	w, ok := s.probeWaiters[nonce]
+	if !ok {
+		return
+	}
+	delete(s.probeWaiters, nonce)
+	w.reply <- &ProbeReply{
+		Name:      packetStatus.ServerName,
+		Version:   packetStatus.ServerVersion,
+		Players:   packetStatus.PlayerCount,
+		Rooms:     packetStatus.RoomCount,
+		RTT:       rtt,
+		RTTMillis: float64(rtt) / float64(time.Millisecond),
+	}
+}
+
+// probeDecodeFailedLocked tells each ProbeNow waiting for the server that a packet from it failed to decode.
+func (s *Status) probeDecodeFailedLocked(err error) {
+	for _, w := range s.probeWaiters {
+		w.decodeErr = err
+	}
+}
@@ -0,0 +1,92 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type probeResult struct {
+	reply *ProbeReply
+	err   error
+}
+
+// startProbe calls ProbeNow in the background, and returns once its GetStatus has been sent.
+func startProbe(t *testing.T, ctx context.Context, m *Monitor, conn *fakePacketConn) (<-chan probeResult, []byte) {
+	t.Helper()
+	m.m.Lock()
+	m.conn = conn // as if Receive were running
+	m.m.Unlock()
+	done := make(chan probeResult, 1)
+	go func() {
+		reply, err := m.ProbeNow(ctx, zap.NewNop(), testServerAddr)
+		done <- probeResult{reply, err}
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if written := conn.Written(); len(written) > 0 {
+			return done, written[len(written)-1].buf
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for GetStatus")
+	return nil, nil
+}
+
+func TestProbeNow(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done, getStatus := startProbe(t, ctx, m, conn)
+	clock.Advance(20 * time.Millisecond)
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, statusReplyTo(t, getStatus))
+
+	result := <-done
+	if result.err != nil {
+		t.Fatalf("failed to probe: %v", result.err)
+	}
+	expected := ProbeReply{Name: "test server", Version: "0.3.2", Players: 3, Rooms: 1, RTT: 20 * time.Millisecond,
+		RTTMillis: 20}
+	if *result.reply != expected {
+		t.Errorf("expected %+v, got %+v", expected, *result.reply)
+	}
+	// The reply counts like that to any other ping
+	if servers := m.ListServers(false); len(servers) != 1 {
+		t.Errorf("expected the server to be listed, got %+v", servers)
+	}
+	if stats := m.Stats(); stats.PingsSent != 1 || stats.RepliesReceived != 1 {
+		t.Errorf("expected the probe to be counted, got %+v", stats)
+	}
+}
+
+func TestProbeNowFails(t *testing.T) {
+	m, _, conn := newTestMonitor(t)
+	if _, err := m.ProbeNow(context.Background(), zap.NewNop(), testServerAddr); !errors.Is(err, ErrNotReceiving) {
+		t.Errorf("expected ErrNotReceiving, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done, _ := startProbe(t, ctx, m, conn)
+	cancel()
+	if result := <-done; !errors.Is(result.err, ErrProbeTimeout) {
+		t.Errorf("expected ErrProbeTimeout, got %v", result.err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	done, _ = startProbe(t, ctx, m, conn)
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, []byte{5, 0, 0, 0, 1})
+	cancel()
+	if result := <-done; !errors.Is(result.err, ErrMalformed) || !errors.Is(result.err, ErrTruncated) {
+		t.Errorf("expected a decoding error, got %v", result.err)
+	}
+	if len(m.statuses[testServerAddr].probeWaiters) != 0 {
+		t.Error("expected no probes to be waiting")
+	}
+
+	if _, err := m.ProbeNow(context.Background(), zap.NewNop(), "127.0.0.1:1"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("expected ErrNotRegistered, got %v", err)
+	}
+}
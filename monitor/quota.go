@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const quotaWindow = 24 * time.Hour
+
+// Quotas limit how many servers can be registered, so that no one can list thousands of addresses, or
+// point the registrar's pings at someone else's network. Zero means no limit. Quotas are only checked by
+// Register; servers restored from a backup or by a peer are trusted.
+type Quotas struct {
+	// How many distinct servers a caller IP, or a caller /24 (IPv4) or /48 (IPv6), may register per day
+	PerCallerIP     int
+	PerCallerPrefix int
+	// How many servers may be registered at the same target IP, or in the same target /24 or /48
+	PerTargetIP     int
+	PerTargetPrefix int
+	// How many servers may be registered in total
+	Total int
+}
+
+// quotaUsage counts the distinct servers registered by a caller IP or prefix since start.
+type quotaUsage struct {
+	start       time.Time
+	serverAddrs map[string]struct{}
+}
+
+// prefixKey returns the /24 (IPv4) or /48 (IPv6) network containing ip, as a string.
+func prefixKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// checkQuotasLocked checks whether reg may register a server at dst, which is existing if it is already
+// registered, and if so, counts it against the caller's quotas. Re-registering a server never counts against
+// the target or total quotas.
+func (m *Monitor) checkQuotasLocked(reg *Registration, dst *net.UDPAddr, existing *Status) error {
+	q := m.Quotas
+	if existing == nil {
+		if err := m.checkTargetQuotasLocked(reg, dst); err != nil {
+			return err
+		}
+	}
+	if reg.CallerIP == nil {
+		return nil
+	}
+	now := m.Clock.Now()
+	var usages []*quotaUsage
+	for _, c := range []struct {
+		key   string
+		limit int
+	}{
+		{"ip:" + reg.CallerIP.String(), q.PerCallerIP},
+		{"prefix:" + prefixKey(reg.CallerIP), q.PerCallerPrefix},
+	} {
+		if c.limit == 0 {
+			continue
+		}
+		usage := m.callerUsage[c.key]
+		if usage == nil || !now.Before(usage.start.Add(quotaWindow)) {
+			usage = &quotaUsage{start: now, serverAddrs: make(map[string]struct{})}
+			m.callerUsage[c.key] = usage
+		}
+		if _, ok := usage.serverAddrs[reg.Addr]; !ok && len(usage.serverAddrs) >= c.limit {
+			err := NewServerAddError(ServerAddErrCallerQuota, "too many servers registered from this network today",
+				zap.String("serverAddr", reg.Addr), zap.String("caller", c.key))
+			err.RetryAfter = usage.start.Add(quotaWindow).Sub(now)
+			return err
+		}
+		usages = append(usages, usage)
+	}
+	for _, usage := range usages {
+		usage.serverAddrs[reg.Addr] = struct{}{}
+	}
+	return nil
+}
+
+// checkTargetQuotasLocked checks whether there is room for a new server at dst.
+func (m *Monitor) checkTargetQuotasLocked(reg *Registration, dst *net.UDPAddr) error {
+	q := m.Quotas
+	if q.Total > 0 && len(m.statuses) >= q.Total {
+		return m.targetQuotaError(ServerAddErrTotalQuota, "registrar has the most servers allowed", reg)
+	}
+	if q.PerTargetIP == 0 && q.PerTargetPrefix == 0 {
+		return nil
+	}
+	prefix := prefixKey(dst.IP)
+	sameIP, samePrefix := 0, 0
+	for _, status := range m.statuses {
+		if status.ResolvedAddr == nil {
+			continue
+		}
+		if status.ResolvedAddr.IP.Equal(dst.IP) {
+			sameIP++
+		}
+		if prefixKey(status.ResolvedAddr.IP) == prefix {
+			samePrefix++
+		}
+	}
+	if q.PerTargetIP > 0 && sameIP >= q.PerTargetIP {
+		return m.targetQuotaError(ServerAddErrTargetQuota, "too many servers are registered at this IP", reg)
+	}
+	if q.PerTargetPrefix > 0 && samePrefix >= q.PerTargetPrefix {
+		return m.targetQuotaError(ServerAddErrTargetQuota, "too many servers are registered in this network", reg)
+	}
+	return nil
+}
+
+// targetQuotaError returns an error for a full target or total quota.
+func (m *Monitor) targetQuotaError(code ServerAddErrorCode, msg string, reg *Registration) ServerAddError {
+	err := NewServerAddError(code, msg, zap.String("serverAddr", reg.Addr))
+	err.RetryAfter = m.roomRetryAfter()
+	return err
+}
+
+// roomRetryAfter returns how long a caller refused for lack of room for a server should wait. Room is made
+// as leases expire, so that is a lease TTL; if leases don't expire, room is only made as servers are delisted
+// for missing pings or leases are released, so it is a ping cycle.
+func (m *Monitor) roomRetryAfter() time.Duration {
+	if m.LeaseTTL > 0 {
+		return m.LeaseTTL
+	}
+	return m.PingInterval
+}
+
+// expireCallerUsageLocked forgets the usage of callers whose quota windows have ended.
+func (m *Monitor) expireCallerUsageLocked() {
+	now := m.Clock.Now()
+	for key, usage := range m.callerUsage {
+		if !now.Before(usage.start.Add(quotaWindow)) {
+			delete(m.callerUsage, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package monitor
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCallerQuota(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	clock := newFakeClock()
+	m.Clock = clock
+	m.Quotas = Quotas{PerCallerIP: 2, PerCallerPrefix: 3}
+	register := func(addr, caller string) error {
+		_, err := m.Register(&Registration{Addr: addr, CallerIP: net.ParseIP(caller)})
+		return err
+	}
+
+	// Registering a server again is refused before it counts towards the quota
+	for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:1"} {
+		if err := register(addr, "198.51.100.1"); err != nil && !errors.Is(err, ErrAlreadyRegistered) {
+			t.Fatalf("failed to register %s: %v", addr, err)
+		}
+	}
+	var addErr ServerAddError
+	if err := register("127.0.0.1:3", "198.51.100.1"); !errors.As(err, &addErr) || addErr.Code != ServerAddErrCallerQuota {
+		t.Fatalf("expected ServerAddErrCallerQuota, got %v", err)
+	}
+	if addErr.RetryAfter != quotaWindow {
+		t.Errorf("expected RetryAfter %v, got %v", quotaWindow, addErr.RetryAfter)
+	}
+	if err := register("127.0.0.1:3", "198.51.100.2"); err != nil {
+		t.Fatalf("expected another IP in the prefix to have room: %v", err)
+	}
+	if err := register("127.0.0.1:4", "198.51.100.3"); !errors.As(err, &addErr) || addErr.Code != ServerAddErrCallerQuota {
+		t.Errorf("expected the prefix quota to be full, got %v", err)
+	}
+	if err := register("127.0.0.1:4", "203.0.113.1"); err != nil {
+		t.Errorf("expected another prefix to have room: %v", err)
+	}
+
+	clock.Advance(quotaWindow)
+	if err := register("127.0.0.1:5", "198.51.100.1"); err != nil {
+		t.Errorf("expected the quota to reset after a day: %v", err)
+	}
+}
+
+func TestTargetAndTotalQuotas(t *testing.T) {
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Quotas = Quotas{PerTargetIP: 2, PerTargetPrefix: 3, Total: 4}
+	var addErr ServerAddError
+	expectCode := func(addr string, code ServerAddErrorCode) {
+		t.Helper()
+		_, err := m.Register(&Registration{Addr: addr})
+		if !errors.As(err, &addErr) || addErr.Code != code {
+			t.Errorf("%s: expected code %d, got %v", addr, code, err)
+		} else if addErr.RetryAfter != m.PingInterval {
+			t.Errorf("%s: expected RetryAfter of a ping cycle, since leases don't expire, got %v", addr,
+				addErr.RetryAfter)
+		}
+	}
+
+	for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.2:1"} {
+		if err := m.AddServer(addr); err != nil {
+			t.Fatalf("failed to register %s: %v", addr, err)
+		}
+	}
+	expectCode("127.0.0.1:3", ServerAddErrTargetQuota)
+	expectCode("127.0.0.3:1", ServerAddErrTargetQuota)
+	if err := m.AddServer("127.0.0.1:2"); err != nil {
+		t.Errorf("expected re-registration not to count against the quota: %v", err)
+	}
+	if err := m.AddServer("127.0.1.1:1"); err != nil {
+		t.Fatalf("failed to register in another prefix: %v", err)
+	}
+	expectCode("127.0.2.1:1", ServerAddErrTotalQuota)
+	if err := m.Restore(&Registration{Addr: "127.0.2.1:1"}); err != nil {
+		t.Errorf("expected restored servers to ignore quotas: %v", err)
+	}
+}
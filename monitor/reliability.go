@@ -0,0 +1,85 @@
+package monitor
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	lossAlpha             = 0.05 // weight of each ping in the moving average of the loss rate
+	flapWindow            = time.Hour
+	flapSuppressThreshold = 6 // up/down changes within flapWindow at which a server stops being listed
+	flapRecoverThreshold  = 2 // up/down changes within flapWindow at or below which it is listed again
+)
+
+// reliability tracks how dependable a server is, for its reliability score.
+type reliability struct {
+	lossRate float64 // moving average of the fraction of pings that timed out
+	// flaps are the times at which the server changed between listed and not listed (see setStateLocked),
+	// within flapWindow
+	flaps []time.Time
+	// flapping servers are not listed, until they have settled down
+	flapping bool
+	score    float64
+}
+
+func (r *reliability) pingAnswered() {
+	r.lossRate *= 1 - lossAlpha
+}
+
+func (r *reliability) pingTimedOut() {
+	r.lossRate = r.lossRate*(1-lossAlpha) + lossAlpha
+}
+
+// updateReliabilityLocked forgets old flaps, and updates the reliability score of each server. It is called
+// each time the servers are pinged, after their history is recorded.
+func (m *Monitor) updateReliabilityLocked() {
+	now := m.Clock.Now()
+	for serverAddr, status := range m.statuses {
+		r := &status.rel
+		drop := 0
+		for drop < len(r.flaps) && now.Sub(r.flaps[drop]) > flapWindow {
+			drop++
+		}
+		r.flaps = append(r.flaps[:0], r.flaps[drop:]...)
+		if len(r.flaps) >= flapSuppressThreshold {
+			r.flapping = true
+		} else if len(r.flaps) <= flapRecoverThreshold {
+			r.flapping = false
+		}
+
+		var dayUptime float64
+		if h := m.history[serverAddr]; h != nil {
+			hours := h.Hours
+			if len(hours) > 24 {
+				hours = hours[len(hours)-24:]
+			}
+			dayUptime = uptime(hours)
+		}
+		score := 100 * dayUptime * (1 - r.lossRate)
+		score /= 1 + rttVariation(status.rtts)
+		score /= 1 + float64(len(r.flaps))/flapSuppressThreshold
+		r.score = math.Round(score*10) / 10
+	}
+}
+
+// rttVariation returns the coefficient of variation (standard deviation divided by mean) of the round trip
+// times, or 0 if there are too few of them.
+func rttVariation(rtts []time.Duration) float64 {
+	if len(rtts) < 2 {
+		return 0
+	}
+	var sum float64
+	for _, rtt := range rtts {
+		sum += float64(rtt)
+	}
+	mean := sum / float64(len(rtts))
+	if mean == 0 {
+		return 0
+	}
+	var squares float64
+	for _, rtt := range rtts {
+		squares += (float64(rtt) - mean) * (float64(rtt) - mean)
+	}
+	return math.Sqrt(squares/float64(len(rtts))) / mean
+}
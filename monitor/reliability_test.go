@@ -0,0 +1,60 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlappingServerIsSuppressed(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	info := m.ListServers(false)
+	if len(info) != 1 || info[0].Reliability <= 0 || info[0].Flapping {
+		t.Fatalf("expected a reliable server, got %+v", info)
+	}
+	reliable := info[0].Reliability
+
+	for i := 0; i < flapSuppressThreshold/2; i++ {
+		missPings(m, clock, conn, maxMissedPings+1)
+		pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+		pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	}
+	if servers := m.ListServers(false); len(servers) != 0 {
+		t.Fatalf("expected flapping server not to be listed, got %+v", servers)
+	}
+	all := m.ListServers(true)
+	if len(all) != 1 || !all[0].Flapping || all[0].Reliability >= reliable {
+		t.Errorf("expected a flapping server with a lower score than %v, got %+v", reliable, all)
+	}
+	// A peer that saw it up doesn't get it listed
+	m.SetRemoteServers("peer", []*PublicServerInfo{{Addr: testServerAddr, State: StateUp}})
+	if servers := m.ListServers(false); len(servers) != 0 {
+		t.Fatalf("expected flapping server not to be listed from a peer's view, got %+v", servers)
+	}
+	if all := m.ListServers(true); len(all) != 1 || !all[0].Flapping {
+		t.Errorf("expected only the local, flapping entry, got %+v", all)
+	}
+	m.SetRemoteServers("peer", nil)
+
+	// It stays suppressed while the flaps age out, until only a few are left
+	clock.Advance(flapWindow - 30*time.Second)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if servers := m.ListServers(false); len(servers) != 0 {
+		t.Fatalf("expected server to still be suppressed, got %+v", servers)
+	}
+	clock.Advance(time.Minute)
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if servers := m.ListServers(false); len(servers) != 1 || servers[0].Flapping {
+		t.Errorf("expected server to be listed again, got %+v", servers)
+	}
+}
+
+func TestRTTVariation(t *testing.T) {
+	if v := rttVariation([]time.Duration{time.Second, time.Second}); v != 0 {
+		t.Errorf("expected no variation, got %v", v)
+	}
+	if v := rttVariation([]time.Duration{time.Second, 3 * time.Second}); v != 0.5 {
+		t.Errorf("expected 0.5, got %v", v)
+	}
+}
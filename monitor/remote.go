@@ -0,0 +1,62 @@
+package monitor
+
+import (
+	"time"
+)
+
+const remoteViewTTL = 2 * time.Minute // How long another registrar's view is used after it was last updated
+
+// remoteView is the list of servers that another registrar sees as up.
+type remoteView struct {
+	servers   []*PublicServerInfo
+	updatedAt time.Time
+}
+
+// SetRemoteServers replaces the list of servers that the registrar called source sees as up. ListServers
+// lists a server that is down here if any other registrar has seen it up recently, but only if it is also
+// registered here, and not suppressed here for flapping.
+func (m *Monitor) SetRemoteServers(source string, servers []*PublicServerInfo) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.remoteViews[source] = &remoteView{
+		servers:   servers,
+		updatedAt: m.Clock.Now(),
+	}
+}
+
+// mergeRemoteServersLocked replaces entries in infos for servers that are down here, and adds servers
+// missing from infos, using copies of entries from the remote views. Stale remote views are ignored, and so
+// are entries for servers that aren't registered here or are flapping here, which must stay hidden even if
+// they happened to be up whenever a peer pinged them.
+func (m *Monitor) mergeRemoteServersLocked(infos []*PublicServerInfo) []*PublicServerInfo {
+	if len(m.remoteViews) == 0 {
+		return infos
+	}
+	byAddr := make(map[string]int, len(infos)) // index into infos
+	for i, info := range infos {
+		byAddr[info.Addr] = i
+	}
+	now := m.Clock.Now()
+	for _, view := range m.remoteViews {
+		if now.Sub(view.updatedAt) > remoteViewTTL {
+			continue
+		}
+		for _, remote := range view.servers {
+			if status, ok := m.statuses[remote.Addr]; !ok || status.rel.flapping {
+				continue
+			}
+			remoteCopy := *remote
+			i, ok := byAddr[remote.Addr]
+			if !ok {
+				byAddr[remote.Addr] = len(infos)
+				infos = append(infos, &remoteCopy)
+				continue
+			}
+			if local := infos[i]; !local.State.Listed() &&
+				(remote.State.Listed() || remote.MissedPings < local.MissedPings) {
+				infos[i] = &remoteCopy
+			}
+		}
+	}
+	return infos
+}
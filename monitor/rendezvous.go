@@ -0,0 +1,282 @@
+package monitor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/conwayste/registrar/codec"
+
+	"go.uber.org/zap"
+)
+
+// RendezvousTTL is how long the registrar keeps the address a server was seen at by RendezvousRegister.
+// Servers should send it more often than that, and more often than their NAT forgets idle mappings (often
+// after 30 seconds), to keep both alive.
+const RendezvousTTL = 2 * time.Minute
+
+const (
+	// minRendezvousRequestSize is the size of a ConnectRequest with an empty address (a variant, a nonce, a
+	// string length and a cookie), which is also that of a RendezvousRegister with empty strings. It is larger
+	// than a ConnectChallenge, so challenges never amplify what a spoofed request sends to its victim.
+	minRendezvousRequestSize = 4 + 8 + 8 + 8
+	// maxRendezvousRequestSize is the size of a ConnectRequest with the longest address, which is larger than
+	// any RendezvousRegister
+	maxRendezvousRequestSize = 4 + 8 + 8 + 255 + 8
+	// rendezvousErrorOverhead is the size of a RendezvousError with an empty reason (a variant, a nonce and a
+	// string length), which is less than minRendezvousRequestSize
+	rendezvousErrorOverhead = 4 + 8 + 8
+
+	// Rendezvous requests are limited per source IP, and introductions per server, in each rendezvousRateWindow
+	rendezvousRateWindow       = time.Minute
+	maxRendezvousRequestsPerIP = 30
+	maxIntroductionsPerServer  = 60
+	connectCookieEpoch         = 30 * time.Second // a cookie is valid in the epoch it was issued and the next
+)
+
+var (
+	rendezvousRegisterVariant, _ = codec.Variant(RendezvousRegister{})
+	connectRequestVariant, _     = codec.Variant(ConnectRequest{})
+)
+
+// looksLikeRendezvousRequest returns whether buf may be a rendezvous request, judging only by its variant
+// number and size. It lets enqueuePacket drop other packets from unknown senders without decoding them.
+func looksLikeRendezvousRequest(buf []byte) bool {
+	if len(buf) < minRendezvousRequestSize || len(buf) > maxRendezvousRequestSize {
+		return false
+	}
+	variant := binary.LittleEndian.Uint32(buf)
+	return variant == rendezvousRegisterVariant || variant == connectRequestVariant
+}
+
+// rendezvous is the address a server behind NAT was seen at, which it is pinged at instead of its
+// registered address, and which clients are told to connect to.
+type rendezvous struct {
+	addr      *net.UDPAddr
+	expiresAt time.Time
+}
+
+// pingAddr is the address to send a server packets at.
+func (s *Status) pingAddr() *net.UDPAddr {
+	if s.rendezvous != nil {
+		return s.rendezvous.addr
+	}
+	return s.ResolvedAddr
+}
+
+// behindNAT returns whether the server is seen at another address than it registered.
+func (s *Status) behindNAT() bool {
+	return s.rendezvous != nil && s.rendezvous.addr.String() != s.ResolvedAddr.String()
+}
+
+// rateWindow counts the requests of a source IP, or the introductions to a server, since start.
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+// allowRendezvousLocked counts a request against the limit of key in the current rendezvousRateWindow, and
+// returns whether it is within the limit.
+func (m *Monitor) allowRendezvousLocked(key string, limit int) bool {
+	now := m.Clock.Now()
+	w := m.rendezvousRates[key]
+	if w == nil || !now.Before(w.start.Add(rendezvousRateWindow)) {
+		w = &rateWindow{start: now}
+		m.rendezvousRates[key] = w
+	}
+	if w.n >= limit {
+		return false
+	}
+	w.n++
+	return true
+}
+
+// connectCookieLocked returns the cookie that a ConnectRequest from clientAddr for serverAddr must have in the
+// given connectCookieEpoch. Cookies are keyed with a secret, so only a client that received a ConnectChallenge
+// at clientAddr knows its cookie. It returns 0 if the secret can't be generated.
+func (m *Monitor) connectCookieLocked(clientAddr *net.UDPAddr, serverAddr string, epoch int64) uint64 {
+	if m.cookieKey == nil {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return 0
+		}
+		m.cookieKey = key
+	}
+	mac := hmac.New(sha256.New, m.cookieKey)
+	var epochBytes [8]byte
+	binary.LittleEndian.PutUint64(epochBytes[:], uint64(epoch))
+	mac.Write(epochBytes[:])
+	mac.Write([]byte(clientAddr.String()))
+	mac.Write([]byte{0})
+	mac.Write([]byte(serverAddr))
+	return binary.LittleEndian.Uint64(mac.Sum(nil))
+}
+
+// checkConnectCookieLocked returns whether request has a cookie issued to clientAddr in this epoch or the
+// previous one, and if not, the ConnectChallenge to answer it with.
+func (m *Monitor) checkConnectCookieLocked(clientAddr *net.UDPAddr, request *ConnectRequest) (bool, *ConnectChallenge) {
+	epoch := m.Clock.Now().UnixNano() / int64(connectCookieEpoch)
+	cookie := m.connectCookieLocked(clientAddr, request.ServerAddr, epoch)
+	if cookie == 0 {
+		return false, nil
+	}
+	if request.Cookie == cookie || request.Cookie == m.connectCookieLocked(clientAddr, request.ServerAddr, epoch-1) {
+		return true, nil
+	}
+	return false, &ConnectChallenge{Nonce: request.Nonce, Cookie: cookie}
+}
+
+// outgoingPacket is a packet to send once the Monitor's lock is released.
+type outgoingPacket struct {
+	dst    *net.UDPAddr
+	packet interface{}
+}
+
+// processRendezvousPacket handles buf if it is a rendezvous request, and returns whether it was one.
+func (m *Monitor) processRendezvousPacket(log *zap.Logger, conn net.PacketConn, remoteAddr *net.UDPAddr,
+	buf []byte) bool {
+	var request rendezvousRequest
+	if err := UnmarshalStrict(buf, &request); err != nil {
+		return false
+	}
+	var replies []outgoingPacket
+	m.m.Lock()
+	if !m.allowRendezvousLocked("ip:"+remoteAddr.IP.String(), maxRendezvousRequestsPerIP) {
+		m.m.Unlock()
+		log.Debug("dropped rendezvous request over the rate limit of its source IP")
+		return true
+	}
+	switch request := request.(type) {
+	case RendezvousRegister:
+		replies = m.rendezvousRegisterLocked(log, remoteAddr, &request, len(buf))
+	case ConnectRequest:
+		replies = m.connectRequestLocked(log, remoteAddr, &request)
+	}
+	m.m.Unlock()
+
+	for _, reply := range replies {
+		packetBytes, err := Marshal(reply.packet)
+		if err != nil {
+			log.Error("failed to marshal rendezvous reply", zap.Error(err))
+			continue
+		}
+		if _, err := conn.WriteTo(packetBytes, reply.dst); err != nil {
+			log.Error("failed to send rendezvous reply", zap.Error(err))
+		}
+	}
+	return true
+}
+
+// rendezvousRegisterLocked handles a RendezvousRegister of requestSize bytes. Since its source may be spoofed, a
+// request without a valid lease is dropped without an answer, and the RendezvousError answering any other
+// failure has its reason cut short so that it is no larger than the request.
+func (m *Monitor) rendezvousRegisterLocked(log *zap.Logger, remoteAddr *net.UDPAddr,
+	request *RendezvousRegister, requestSize int) []outgoingPacket {
+	fail := func(reason string) []outgoingPacket {
+		log.Info("refused rendezvous registration", zap.String("reason", reason))
+		if maxLen := requestSize - rendezvousErrorOverhead; len(reason) > maxLen {
+			reason = reason[:maxLen]
+		}
+		return []outgoingPacket{{remoteAddr, &RendezvousError{Nonce: request.Nonce, Reason: reason}}}
+	}
+	l, err := m.findLeaseLocked(request.LeaseID, request.LeaseSecret)
+	if err != nil {
+		log.Debug("dropped rendezvous registration", zap.Error(err))
+		return nil
+	}
+	status := m.statuses[l.serverAddr]
+	if status == nil {
+		return nil // Probably unreachable, since its lease was found
+	}
+	// Since clients are sent wherever this comes from, an unverified server must have been registered by the
+	// lease holder, and may only move to another port at its registered IP
+	verified := status.Operator != "" || status.DNSVerified
+	if !verified && l.claimed {
+		return fail("lease was not granted to the server's first registrant")
+	}
+	if !verified && !remoteAddr.IP.Equal(status.ResolvedAddr.IP) {
+		return fail("address is not at the server's registered IP")
+	}
+	addrStr := remoteAddr.String()
+	if other, ok := m.ipToName[addrStr]; ok && other != l.serverAddr {
+		return fail("address is in use by another server")
+	}
+	if status.rendezvous == nil || status.rendezvous.addr.String() != addrStr {
+		m.clearRendezvousLocked(status)
+		addr := *remoteAddr
+		status.rendezvous = &rendezvous{addr: &addr}
+		m.ipToName[addrStr] = l.serverAddr
+		m.knownAddrs.Store(addrStr, struct{}{})
+		log.Info("server registered for rendezvous", zap.String("serverAddr", l.serverAddr))
+	}
+	status.rendezvous.expiresAt = m.Clock.Now().Add(RendezvousTTL)
+	return []outgoingPacket{{remoteAddr, &RendezvousRegistered{Nonce: request.Nonce, ObservedAddr: addrStr}}}
+}
+
+func (m *Monitor) connectRequestLocked(log *zap.Logger, remoteAddr *net.UDPAddr,
+	request *ConnectRequest) []outgoingPacket {
+	// The source address may be spoofed until the client proves it received a cookie there, so until then it
+	// is only sent a challenge, and the server is not told about it
+	ok, challenge := m.checkConnectCookieLocked(remoteAddr, request)
+	if !ok {
+		if challenge == nil {
+			log.Error("failed to generate a connect cookie")
+			return nil
+		}
+		return []outgoingPacket{{remoteAddr, challenge}}
+	}
+	status := m.statuses[request.ServerAddr]
+	var reason string
+	switch {
+	case status == nil:
+		reason = "server is not registered"
+	case status.rendezvous == nil:
+		reason = "server is not registered for rendezvous"
+	case !status.State.Listed():
+		reason = "server is not up"
+	case !m.allowRendezvousLocked("server:"+request.ServerAddr, maxIntroductionsPerServer):
+		reason = "server has too many connection requests; try again later"
+	}
+	if reason != "" {
+		return []outgoingPacket{{remoteAddr, &RendezvousError{Nonce: request.Nonce, Reason: reason}}}
+	}
+	log.Debug("introducing client to server", zap.String("serverAddr", request.ServerAddr))
+	r := status.rendezvous
+	return []outgoingPacket{
+		{remoteAddr, &PeerAddress{Nonce: request.Nonce, PeerAddr: r.addr.String()}},
+		{r.addr, &PeerAddress{Nonce: request.Nonce, PeerAddr: remoteAddr.String()}},
+	}
+}
+
+// clearRendezvousLocked forgets the address a server was seen at, so that it is pinged at its registered
+// address again.
+func (m *Monitor) clearRendezvousLocked(status *Status) {
+	if status.rendezvous == nil {
+		return
+	}
+	addrStr := status.rendezvous.addr.String()
+	if status.ResolvedAddr == nil || addrStr != status.ResolvedAddr.String() {
+		delete(m.ipToName, addrStr)
+		m.knownAddrs.Delete(addrStr)
+	}
+	status.rendezvous = nil
+}
+
+// expireRendezvousLocked forgets the addresses of servers that haven't sent RendezvousRegister for
+// RendezvousTTL, and the rate limit windows that have ended.
+func (m *Monitor) expireRendezvousLocked() {
+	now := m.Clock.Now()
+	for _, status := range m.statuses {
+		if status.rendezvous != nil && !now.Before(status.rendezvous.expiresAt) {
+			m.clearRendezvousLocked(status)
+		}
+	}
+	for key, w := range m.rendezvousRates {
+		if !now.Before(w.start.Add(rendezvousRateWindow)) {
+			delete(m.rendezvousRates, key)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// natConn is a loopback socket behind a simulated port-restricted cone NAT: its address is the host's public
+// address, and packets from an ip:port the host hasn't sent to are dropped.
+type natConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	allowed map[string]bool
+}
+
+func newNATConn(t *testing.T) *natConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &natConn{PacketConn: conn, allowed: make(map[string]bool)}
+}
+
+func (c *natConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.allowed[addr.String()] = true
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *natConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		c.mu.Lock()
+		allowed := c.allowed[addr.String()]
+		c.mu.Unlock()
+		if allowed {
+			return n, addr, nil
+		}
+	}
+}
+
+type natPacket struct {
+	buf  []byte
+	addr net.Addr
+}
+
+// natPeer is a host behind NAT. If it is a server, it answers GetStatus by itself.
+type natPeer struct {
+	conn     *natConn
+	received chan natPacket
+}
+
+func newNATPeer(t *testing.T, server bool) *natPeer {
+	p := &natPeer{conn: newNATConn(t), received: make(chan natPacket, 100)}
+	go func() {
+		for {
+			buf := make([]byte, maxPacketSize)
+			n, addr, err := p.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var getStatus ServerGetStatus
+			if err := UnmarshalStrict(buf[:n], &getStatus); err == nil && server {
+				reply, _ := Marshal(&ServerStatus{Nonce: getStatus.Nonce, ServerName: "behind NAT"})
+				p.conn.WriteTo(reply, addr)
+				continue
+			}
+			p.received <- natPacket{buf[:n], addr}
+		}
+	}()
+	return p
+}
+
+func (p *natPeer) send(t *testing.T, dst net.Addr, packet interface{}) {
+	t.Helper()
+	b, err := Marshal(packet)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	if _, err := p.conn.WriteTo(b, dst); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+}
+
+// expect waits for a packet that decodes into v.
+func (p *natPeer) expect(t *testing.T, v interface{}) net.Addr {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case pkt := <-p.received:
+			if err := UnmarshalStrict(pkt.buf, v); err == nil {
+				return pkt.addr
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %T", v)
+			return nil
+		}
+	}
+}
+
+// punch sends punch packets to dst until one arrives from it.
+func (p *natPeer) punch(t *testing.T, dst string) <-chan bool {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		t.Fatalf("bad peer address %q: %v", dst, err)
+	}
+	done := make(chan bool, 1)
+	go func() {
+		timeout := time.After(2 * time.Second)
+		for {
+			p.conn.WriteTo([]byte("punch"), addr)
+			select {
+			case pkt := <-p.received:
+				if bytes.Equal(pkt.buf, []byte("punch")) && pkt.addr.String() == dst {
+					done <- true
+					return
+				}
+			case <-time.After(10 * time.Millisecond):
+			case <-timeout:
+				done <- false
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func TestRendezvousThroughSimulatedNATs(t *testing.T) {
+	registrarConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer registrarConn.Close()
+	registrarAddr := registrarConn.LocalAddr()
+	// The server registers an address that nothing answers at, as if its NAT had no port forwarded
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	registeredAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	m := NewMonitor()
+	m.AllowSpecialIPs = true
+	m.Rendezvous = true
+	m.RoomListInterval = 0
+	lease, err := m.Register(&Registration{Addr: registeredAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Receive(ctx, zap.NewNop(), registrarConn)
+
+	server := newNATPeer(t, true)
+	client := newNATPeer(t, false)
+
+	server.send(t, registrarAddr, &RendezvousRegister{Nonce: 1, LeaseID: lease.ID, LeaseSecret: "wrong"})
+	server.send(t, registrarAddr, &RendezvousRegister{Nonce: 2, LeaseID: lease.ID, LeaseSecret: lease.Secret})
+	var registered RendezvousRegistered
+	server.expect(t, &registered)
+	serverPublicAddr := server.conn.LocalAddr().String()
+	if registered.Nonce != 2 || registered.ObservedAddr != serverPublicAddr {
+		t.Fatalf("expected to be seen at %s, got %+v", serverPublicAddr, registered)
+	}
+
+	// The server is pinged through its NAT mapping
+	deadline := time.Now().Add(2 * time.Second)
+	for len(m.ListServers(false)) == 0 && time.Now().Before(deadline) {
+		m.sendPings(zap.NewNop(), registrarConn)
+		time.Sleep(20 * time.Millisecond)
+	}
+	servers := m.ListServers(false)
+	if len(servers) != 1 || !servers[0].NAT || servers[0].Name != "behind NAT" {
+		t.Fatalf("expected the server to be listed as behind NAT, got %+v", servers)
+	}
+
+	// The client must prove it receives at its address before it is told anything
+	client.send(t, registrarAddr, &ConnectRequest{Nonce: 3, ServerAddr: "127.0.0.1:1"})
+	var challenge ConnectChallenge
+	client.expect(t, &challenge)
+	client.send(t, registrarAddr, &ConnectRequest{Nonce: 3, ServerAddr: "127.0.0.1:1", Cookie: challenge.Cookie})
+	var rendezvousErr RendezvousError
+	client.expect(t, &rendezvousErr)
+	if rendezvousErr.Nonce != 3 {
+		t.Errorf("expected an error for nonce 3, got %+v", rendezvousErr)
+	}
+
+	// Until the server sends to the client, its NAT drops the client's packets
+	client.send(t, server.conn.LocalAddr(), &ConnectRequest{Nonce: 4})
+	client.send(t, registrarAddr, &ConnectRequest{Nonce: 5, ServerAddr: registeredAddr})
+	client.expect(t, &challenge)
+	client.send(t, registrarAddr, &ConnectRequest{Nonce: 5, ServerAddr: registeredAddr, Cookie: challenge.Cookie})
+	var clientPeer, serverPeer PeerAddress
+	client.expect(t, &clientPeer)
+	server.expect(t, &serverPeer)
+	if clientPeer.Nonce != 5 || clientPeer.PeerAddr != serverPublicAddr {
+		t.Errorf("expected the client to be told %s, got %+v", serverPublicAddr, clientPeer)
+	}
+	if serverPeer.Nonce != 5 || serverPeer.PeerAddr != client.conn.LocalAddr().String() {
+		t.Errorf("expected the server to be told %s, got %+v", client.conn.LocalAddr(), serverPeer)
+	}
+	select {
+	case pkt := <-server.received:
+		t.Fatalf("expected the NAT to drop the client's packet, got %x", pkt.buf)
+	default:
+	}
+
+	clientDone := client.punch(t, clientPeer.PeerAddr)
+	serverDone := server.punch(t, serverPeer.PeerAddr)
+	if !<-clientDone || !<-serverDone {
+		t.Error("expected the client and server to reach each other")
+	}
+}
+
+func TestRendezvousExpires(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.Rendezvous = true
+	m.RemoveServer(testServerAddr) // so that the lease of the server is held by the test
+	lease, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	natAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	b, err := Marshal(&RendezvousRegister{LeaseID: lease.ID, LeaseSecret: lease.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.processRendezvousPacket(zap.NewNop(), conn, natAddr, b) {
+		t.Fatal("expected a rendezvous packet")
+	}
+	conn.Written()
+	m.sendPings(zap.NewNop(), conn)
+	if written := conn.Written(); len(written) == 0 || written[0].addr.String() != natAddr.String() {
+		t.Fatalf("expected pings to be sent to %v, got %+v", natAddr, written)
+	}
+	if !m.isKnownAddr(natAddr) {
+		t.Error("expected the NAT address to be known")
+	}
+
+	clock.Advance(RendezvousTTL)
+	m.sendPings(zap.NewNop(), conn)
+	if written := conn.Written(); len(written) == 0 || written[0].addr.String() != testServerAddr {
+		t.Fatalf("expected pings to be sent to %v again, got %+v", testServerAddr, written)
+	}
+	if m.isKnownAddr(natAddr) {
+		t.Error("expected the NAT address to be forgotten")
+	}
+}
+
+// Since the source of a RendezvousRegister may be spoofed, one without a valid lease mustn't be answered.
+func TestRendezvousWithoutLeaseIsDropped(t *testing.T) {
+	m, _, conn := newTestMonitor(t)
+	m.Rendezvous = true
+	m.RemoveServer(testServerAddr)
+	lease, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	victim := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	for _, request := range []*RendezvousRegister{{}, {LeaseID: lease.ID, LeaseSecret: "wrong"}} {
+		b, err := Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Written()
+		if !m.processRendezvousPacket(zap.NewNop(), conn, victim, b) {
+			t.Fatal("expected a rendezvous packet")
+		}
+		if written := conn.Written(); len(written) != 0 {
+			t.Errorf("expected no reply to %+v, got %+v", request, written)
+		}
+	}
+}
+
+func TestRendezvousNeedsOwnership(t *testing.T) {
+	m, _, conn := newTestMonitor(t)
+	m.Rendezvous = true
+	m.RemoveServer(testServerAddr)
+	lease, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	rendezvous := func(lease *Lease, from *net.UDPAddr) bool {
+		t.Helper()
+		b, err := Marshal(&RendezvousRegister{LeaseID: lease.ID, LeaseSecret: lease.Secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Written()
+		m.processRendezvousPacket(zap.NewNop(), conn, from, b)
+		written := conn.Written()
+		if len(written) != 1 {
+			t.Fatalf("expected one reply, got %+v", written)
+		}
+		if len(written[0].buf) > len(b) {
+			t.Errorf("expected the reply to be no larger than the request (%d bytes), got %d", len(b),
+				len(written[0].buf))
+		}
+		var registered RendezvousRegistered
+		err = UnmarshalStrict(written[0].buf, &registered)
+		return err == nil
+	}
+
+	otherIP := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}
+	if rendezvous(lease, otherIP) {
+		t.Error("expected an unverified server to be refused at another IP")
+	}
+	if !rendezvous(lease, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}) {
+		t.Error("expected the server to be allowed at another port of its IP")
+	}
+	m.m.Lock()
+	m.statuses[testServerAddr].DNSVerified = true
+	m.m.Unlock()
+	if !rendezvous(lease, otherIP) {
+		t.Error("expected a verified server to be allowed at another IP")
+	}
+
+	// A lease granted by claiming a restored server doesn't prove who registered it
+	const restoredAddr = "127.0.0.1:2017"
+	if err := m.Restore(&Registration{Addr: restoredAddr}); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	claimed, err := m.Register(&Registration{Addr: restoredAddr})
+	if err != nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	if rendezvous(claimed, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}) {
+		t.Error("expected a claimed lease to be refused")
+	}
+}
+
+func TestConnectRequestNeedsCookie(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.Rendezvous = true
+	m.RemoveServer(testServerAddr)
+	lease, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	serverNAT := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	b, err := Marshal(&RendezvousRegister{LeaseID: lease.ID, LeaseSecret: lease.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.processRendezvousPacket(zap.NewNop(), conn, serverNAT, b)
+	m.m.Lock()
+	m.statuses[testServerAddr].State = StateUp
+	m.m.Unlock()
+	conn.Written()
+
+	victim := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2016}
+	connect := func(from *net.UDPAddr, cookie uint64) []fakePacket {
+		t.Helper()
+		b, err := Marshal(&ConnectRequest{Nonce: 7, ServerAddr: testServerAddr, Cookie: cookie})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.processRendezvousPacket(zap.NewNop(), conn, from, b)
+		written := conn.Written()
+		for _, w := range written {
+			if w.addr.String() != from.String() && w.addr.String() != serverNAT.String() {
+				t.Fatalf("expected packets only to the client and the server, got one to %v", w.addr)
+			}
+			if w.addr.String() == from.String() && len(w.buf) > len(b) && cookie == 0 {
+				t.Errorf("expected the reply to an unverified request not to be larger than it, got %d > %d bytes",
+					len(w.buf), len(b))
+			}
+		}
+		return written
+	}
+
+	// A spoofed request only gets a challenge, sent to the spoofed address, and the server isn't told
+	written := connect(victim, 0)
+	var challenge ConnectChallenge
+	if len(written) != 1 || written[0].addr.String() != victim.String() {
+		t.Fatalf("expected one challenge to %v, got %+v", victim, written)
+	}
+	if err := UnmarshalStrict(written[0].buf, &challenge); err != nil || challenge.Nonce != 7 {
+		t.Fatalf("expected a ConnectChallenge, got %x %v", written[0].buf, err)
+	}
+	if written := connect(victim, challenge.Cookie+1); len(written) != 1 || written[0].addr.String() != victim.String() {
+		t.Fatalf("expected a wrong cookie to be challenged again, got %+v", written)
+	}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2016}
+	if written := connect(other, challenge.Cookie); len(written) != 1 {
+		t.Fatalf("expected a cookie from another address to be challenged again, got %+v", written)
+	}
+
+	// The cookie is good for the epoch after the one it was issued in, but not later
+	clock.Advance(connectCookieEpoch)
+	if written := connect(victim, challenge.Cookie); len(written) != 2 {
+		t.Fatalf("expected the client and the server to be sent PeerAddress, got %+v", written)
+	}
+	clock.Advance(connectCookieEpoch)
+	if written := connect(victim, challenge.Cookie); len(written) != 1 {
+		t.Fatalf("expected an expired cookie to be challenged again, got %+v", written)
+	}
+}
+
+func TestRendezvousRateLimits(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.Rendezvous = true
+	m.RemoveServer(testServerAddr)
+	lease, err := m.Register(&Registration{Addr: testServerAddr})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	serverNAT := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	b, err := Marshal(&RendezvousRegister{LeaseID: lease.ID, LeaseSecret: lease.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.processRendezvousPacket(zap.NewNop(), conn, serverNAT, b)
+	m.m.Lock()
+	m.statuses[testServerAddr].State = StateUp
+	m.m.Unlock()
+	conn.Written()
+
+	// Each source IP is limited, whichever port it sends from
+	b, err = Marshal(&ConnectRequest{ServerAddr: testServerAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxRendezvousRequestsPerIP+5; i++ {
+		m.processRendezvousPacket(zap.NewNop(), conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000 + i}, b)
+	}
+	if written := conn.Written(); len(written) != maxRendezvousRequestsPerIP {
+		t.Errorf("expected %d challenges, got %d", maxRendezvousRequestsPerIP, len(written))
+	}
+
+	// Each server is limited, however many clients ask for it
+	introductions := 0
+	for i := 0; i < maxIntroductionsPerServer+5; i++ {
+		client := &net.UDPAddr{IP: net.IPv4(127, 0, 1, byte(i)), Port: 2016}
+		m.m.Lock()
+		cookie := m.connectCookieLocked(client, testServerAddr, clock.Now().UnixNano()/int64(connectCookieEpoch))
+		m.m.Unlock()
+		b, err := Marshal(&ConnectRequest{ServerAddr: testServerAddr, Cookie: cookie})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.processRendezvousPacket(zap.NewNop(), conn, client, b)
+		for _, w := range conn.Written() {
+			if w.addr.String() == serverNAT.String() {
+				introductions++
+			}
+		}
+	}
+	if introductions != maxIntroductionsPerServer {
+		t.Errorf("expected the server to be sent %d PeerAddress, got %d", maxIntroductionsPerServer, introductions)
+	}
+
+	// The limits are reset once their window ends
+	clock.Advance(rendezvousRateWindow)
+	m.sendPings(zap.NewNop(), conn)
+	m.m.RLock()
+	windows := len(m.rendezvousRates)
+	m.m.RUnlock()
+	if windows != 0 {
+		t.Errorf("expected ended rate limit windows to be forgotten, got %d", windows)
+	}
+}
+
+func TestEnqueuePacketOnlyLetsRendezvousRequestsFromUnknownSenders(t *testing.T) {
+	m := NewMonitor()
+	m.Rendezvous = true
+	unknown := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2017}
+	encode := func(v interface{}) []byte {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tooLong := encode(&ConnectRequest{ServerAddr: "127.0.0.1:2016"})
+	tooLong = append(tooLong, make([]byte, maxRendezvousRequestSize)...)
+	for _, tc := range []struct {
+		desc   string
+		buf    []byte
+		queued bool
+	}{
+		{"ConnectRequest", encode(&ConnectRequest{ServerAddr: "127.0.0.1:2016"}), true},
+		{"RendezvousRegister", encode(&RendezvousRegister{LeaseID: "id", LeaseSecret: "s"}), true},
+		{"Status", encode(&ServerStatus{ServerName: "impostor"}), false},
+		{"oversized ConnectRequest", tooLong, false},
+		{"junk", []byte{1, 2, 3}, false},
+	} {
+		queue := make(chan *receivedPacket, 1)
+		bufPtr := packetBufPool.Get().(*[]byte)
+		n := copy(*bufPtr, tc.buf)
+		m.enqueuePacket(queue, &receivedPacket{remoteAddr: unknown, bufPtr: bufPtr, n: n})
+		if queued := len(queue) == 1; queued != tc.queued {
+			t.Errorf("%s: expected queued %v, got %v", tc.desc, tc.queued, queued)
+		}
+	}
+	if stats := m.Stats(); stats.DroppedUnknownSender != 3 {
+		t.Errorf("expected 3 packets from unknown senders to be dropped, got %+v", stats)
+	}
+}
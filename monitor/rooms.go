@@ -0,0 +1,93 @@
+package monitor
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultRoomListInterval = 0 // off until the room list variants are reserved in netwayste
+
+var ErrNoRooms = errors.New("no room list for server")
+
+// RoomListing is the latest room list of a server.
+type RoomListing struct {
+	Addr      string     `json:"addr"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Rooms     []RoomInfo `json:"rooms"`
+}
+
+// roomQuery is a GetRoomList waiting for all parts of its answer.
+type roomQuery struct {
+	nonce    uint64
+	sentTime time.Time
+	numParts uint8 // 0 until the first part arrives
+	parts    map[uint8][]RoomInfo
+}
+
+// RoomList returns the latest room list of a registered server, or ErrNoRooms if it hasn't sent one.
+func (m *Monitor) RoomList(serverAddr string) (*RoomListing, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	status, ok := m.statuses[serverAddr]
+	if !ok || status.rooms == nil {
+		return nil, ErrNoRooms
+	}
+	listing := *status.rooms
+	listing.Addr = serverAddr
+	listing.Rooms = append([]RoomInfo{}, status.rooms.Rooms...)
+	return &listing, nil
+}
+
+// queryRoomsLocked sends a GetRoomList to a listed server if it hasn't been sent one for RoomListInterval. An
+// unfinished query that has timed out is dropped.
+func (m *Monitor) queryRoomsLocked(log *zap.Logger, conn net.PacketConn, status *Status, now time.Time) {
+	if q := status.roomQuery; q != nil && q.sentTime.Add(pingTimeout).Before(now) {
+		log.Debug("room list timed out", zap.Int("partsReceived", len(q.parts)))
+		status.roomQuery = nil
+	}
+	if m.RoomListInterval <= 0 || !status.State.Listed() || status.roomQuery != nil ||
+		now.Sub(status.roomsQueriedAt) < m.RoomListInterval {
+		return
+	}
+	q := &roomQuery{nonce: m.NewNonce(), sentTime: now, parts: make(map[uint8][]RoomInfo)}
+	packetBytes, err := Marshal(&ServerGetRoomList{Nonce: q.nonce})
+	if err != nil {
+		log.Error("failed to marshal GetRoomList", zap.Error(err))
+		return
+	}
+	if _, err := conn.WriteTo(packetBytes, status.pingAddr()); err != nil {
+		log.Error("failed to send GetRoomList", zap.Error(err))
+		return
+	}
+	status.roomQuery = q
+	status.roomsQueriedAt = now
+}
+
+// roomListReceivedLocked adds a part of a room list to the server's query, and replaces its room list once
+// all parts have arrived.
+func (m *Monitor) roomListReceivedLocked(log *zap.Logger, status *Status, roomList *ServerRoomList) {
+	q := status.roomQuery
+	if q == nil || roomList.Nonce != q.nonce {
+		log.Error("unrecognized nonce from received room list", zap.Uint64("nonce", roomList.Nonce))
+		return
+	}
+	if roomList.Part >= roomList.Parts || (q.numParts != 0 && roomList.Parts != q.numParts) {
+		log.Error("bad room list part", zap.Uint8("part", roomList.Part), zap.Uint8("parts", roomList.Parts))
+		return
+	}
+	q.numParts = roomList.Parts
+	q.parts[roomList.Part] = roomList.Rooms
+	if len(q.parts) < int(q.numParts) {
+		return
+	}
+	rooms := []RoomInfo{}
+	for i := 0; i < int(q.numParts); i++ {
+		rooms = append(rooms, q.parts[uint8(i)]...)
+	}
+	status.rooms = &RoomListing{UpdatedAt: m.Clock.Now(), Rooms: rooms}
+	status.roomQuery = nil
+	log.Debug("received room list", zap.Int("rooms", len(rooms)))
+}
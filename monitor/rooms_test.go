@@ -0,0 +1,90 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// roomListQuery returns the nonce of the GetRoomList written to conn, if any.
+func roomListQuery(t *testing.T, conn *fakePacketConn) (uint64, bool) {
+	t.Helper()
+	for _, pkt := range conn.Written() {
+		var getRoomList ServerGetRoomList
+		if err := UnmarshalStrict(pkt.buf, &getRoomList); err == nil {
+			return getRoomList.Nonce, true
+		}
+	}
+	return 0, false
+}
+
+func sendRoomList(t *testing.T, m *Monitor, roomList *ServerRoomList) {
+	t.Helper()
+	b, err := Marshal(roomList)
+	if err != nil {
+		t.Fatalf("failed to marshal RoomList: %v", err)
+	}
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, b)
+}
+
+func TestRoomList(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	m.RoomListInterval = time.Minute
+	if _, err := m.RoomList(testServerAddr); !errors.Is(err, ErrNoRooms) {
+		t.Fatalf("expected ErrNoRooms, got %v", err)
+	}
+
+	// Servers are only asked for rooms once they are up
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if _, ok := roomListQuery(t, conn); ok {
+		t.Fatal("expected no GetRoomList before the server was up")
+	}
+	m.sendPings(zap.NewNop(), conn)
+	nonce, ok := roomListQuery(t, conn)
+	if !ok {
+		t.Fatal("expected a GetRoomList")
+	}
+
+	lobby := RoomInfo{Name: "lobby", Players: 3, Capacity: 8}
+	arena := RoomInfo{Name: "arena", Players: 2, Capacity: 2, InProgress: true}
+	sendRoomList(t, m, &ServerRoomList{Nonce: nonce, Part: 1, Parts: 2, Rooms: []RoomInfo{arena}})
+	sendRoomList(t, m, &ServerRoomList{Nonce: nonce + 100, Part: 0, Parts: 2, Rooms: []RoomInfo{lobby}})
+	sendRoomList(t, m, &ServerRoomList{Nonce: nonce, Part: 0, Parts: 3, Rooms: []RoomInfo{lobby}})
+	if _, err := m.RoomList(testServerAddr); !errors.Is(err, ErrNoRooms) {
+		t.Fatalf("expected ErrNoRooms until all parts have arrived, got %v", err)
+	}
+	sendRoomList(t, m, &ServerRoomList{Nonce: nonce, Part: 0, Parts: 2, Rooms: []RoomInfo{lobby}})
+	listing, err := m.RoomList(testServerAddr)
+	if err != nil {
+		t.Fatalf("failed to get room list: %v", err)
+	}
+	expected := &RoomListing{Addr: testServerAddr, UpdatedAt: clock.Now(), Rooms: []RoomInfo{lobby, arena}}
+	if !reflect.DeepEqual(listing, expected) {
+		t.Errorf("expected %+v, got %+v", expected, listing)
+	}
+
+	// Room lists are requested less often than pings
+	m.sendPings(zap.NewNop(), conn)
+	if _, ok := roomListQuery(t, conn); ok {
+		t.Error("expected no GetRoomList within RoomListInterval")
+	}
+	clock.Advance(time.Minute)
+	m.sendPings(zap.NewNop(), conn)
+	nonce, ok = roomListQuery(t, conn)
+	if !ok {
+		t.Fatal("expected another GetRoomList after RoomListInterval")
+	}
+
+	// A query that isn't fully answered times out, keeping the last room list
+	sendRoomList(t, m, &ServerRoomList{Nonce: nonce, Part: 0, Parts: 2})
+	clock.Advance(time.Second)
+	m.sendPings(zap.NewNop(), conn)
+	sendRoomList(t, m, &ServerRoomList{Nonce: nonce, Part: 1, Parts: 2})
+	if listing, err := m.RoomList(testServerAddr); err != nil || len(listing.Rooms) != 2 {
+		t.Errorf("expected the last room list, got %+v %v", listing, err)
+	}
+}
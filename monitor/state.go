@@ -0,0 +1,160 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+)
+
+// ServerState is where a server is in its lifecycle, as seen by this registrar (see StateThresholds). A
+// server is pending until it first answers a ping, and is then up. An up server that misses a few pings in a
+// row is degraded, and any server that misses more is down. A degraded or down server is up again after
+// answering a few pings in a row. A server that misses very many pings in a row is delisted, as is one that
+// is removed in any other way. Servers are listed while they are up or degraded.
+type ServerState int
+
+const (
+	StatePending  ServerState = iota // registered, but hasn't answered a ping yet
+	StateUp                          // answering pings
+	StateDegraded                    // has missed a few pings in a row
+	StateDown                        // has missed too many pings in a row to be listed
+	StateDelisted                    // no longer registered; it must register again
+	numStates
+)
+
+var stateNames = [numStates]string{"pending", "up", "degraded", "down", "delisted"}
+
+func (s ServerState) String() string {
+	if s < 0 || s >= numStates {
+		return fmt.Sprintf("ServerState(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+func (s ServerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ServerState) UnmarshalText(b []byte) error {
+	for i, name := range stateNames {
+		if name == string(b) {
+			*s = ServerState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown server state %q", b)
+}
+
+// Listed returns whether servers in this state are listed.
+func (s ServerState) Listed() bool {
+	return s == StateUp || s == StateDegraded
+}
+
+// StateThresholds are the counts of pings in a row that move a server from one state to another.
+type StateThresholds struct {
+	DegradedAfter int // missed pings after which an up server is degraded
+	DownAfter     int // missed pings after which a server is down
+	DelistAfter   int // missed pings after which a server is delisted
+	UpAfter       int // answered pings after which a degraded or down server is up; pending servers need one
+}
+
+func DefaultStateThresholds() StateThresholds {
+	return StateThresholds{
+		DegradedAfter: 2,
+		DownAfter:     maxMissedPings + 1,
+		DelistAfter:   missedPingsToDelist + 1,
+		UpAfter:       2,
+	}
+}
+
+// StateChange is a change of a server's state, as passed to a StateListener.
+type StateChange struct {
+	ServerAddr string
+	From, To   ServerState
+	At         time.Time
+}
+
+// StateListener is notified of every change of a server's state. Its method is called without any Monitor
+// locks held.
+type StateListener interface {
+	ServerStateChanged(change StateChange)
+}
+
+// pingMissedLocked counts a ping that timed out, and returns the server's new state.
+func (m *Monitor) pingMissedLocked(serverAddr string, status *Status) ServerState {
+	status.missedPings++
+	status.answeredPings = 0
+	th := m.StateThresholds
+	next := status.State
+	switch {
+	case status.missedPings >= th.DelistAfter:
+		next = StateDelisted
+	case status.missedPings >= th.DownAfter:
+		next = StateDown
+	case status.State == StateUp && status.missedPings >= th.DegradedAfter:
+		next = StateDegraded
+	}
+	m.setStateLocked(serverAddr, status, next)
+	return next
+}
+
+// pingAnsweredLocked counts a ping that was answered, and returns the server's new state.
+func (m *Monitor) pingAnsweredLocked(serverAddr string, status *Status) ServerState {
+	status.missedPings = 0
+	status.answeredPings++
+	next := status.State
+	switch status.State {
+	case StatePending:
+		next = StateUp
+	case StateDegraded, StateDown:
+		if status.answeredPings >= m.StateThresholds.UpAfter {
+			next = StateUp
+		}
+	}
+	m.setStateLocked(serverAddr, status, next)
+	return next
+}
+
+// setStateLocked moves a server to a state, recording the change for the StateListener and counting flaps.
+func (m *Monitor) setStateLocked(serverAddr string, status *Status, to ServerState) {
+	from := status.State
+	if from == to {
+		return
+	}
+	now := m.Clock.Now()
+	status.State = to
+	status.StateSince = now
+	if from != StatePending && to != StateDelisted && from.Listed() != to.Listed() {
+		status.rel.flaps = append(status.rel.flaps, now)
+		if len(status.rel.flaps) >= flapSuppressThreshold {
+			status.rel.flapping = true
+		}
+	}
+	if m.StateListener != nil {
+		m.stateChanges = append(m.stateChanges, StateChange{ServerAddr: serverAddr, From: from, To: to, At: now})
+	}
+}
+
+// notifyStateChanges passes the state changes recorded since it was last called to the StateListener.
+func (m *Monitor) notifyStateChanges() {
+	if m.StateListener == nil {
+		return
+	}
+	m.m.Lock()
+	changes := m.stateChanges
+	m.stateChanges = nil
+	m.m.Unlock()
+	for _, change := range changes {
+		m.StateListener.ServerStateChanged(change)
+	}
+}
+
+// StateCounts returns how many registered servers are in each state.
+func (m *Monitor) StateCounts() map[ServerState]int {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	counts := make(map[ServerState]int)
+	for _, status := range m.statuses {
+		counts[status.State]++
+	}
+	return counts
+}
@@ -0,0 +1,91 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type stateRecorder struct {
+	changes []StateChange
+}
+
+func (r *stateRecorder) ServerStateChanged(change StateChange) {
+	r.changes = append(r.changes, change)
+}
+
+func (r *stateRecorder) states() []ServerState {
+	var states []ServerState
+	for _, change := range r.changes {
+		states = append(states, change.To)
+	}
+	return states
+}
+
+func TestStateMachine(t *testing.T) {
+	m, clock, conn := newTestMonitor(t)
+	recorder := &stateRecorder{}
+	m.StateListener = recorder
+	state := func() ServerState { return m.statuses[testServerAddr].State }
+
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if state() != StateUp {
+		t.Fatalf("expected up, got %v", state())
+	}
+	missPings(m, clock, conn, m.StateThresholds.DegradedAfter)
+	if state() != StateDegraded || len(m.ListServers(false)) != 1 {
+		t.Fatalf("expected degraded server to be listed, got %v", state())
+	}
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if state() != StateDegraded {
+		t.Errorf("expected server to stay degraded after one reply, got %v", state())
+	}
+	pingAndReply(t, m, clock, conn, 10*time.Millisecond)
+	if state() != StateUp {
+		t.Errorf("expected up, got %v", state())
+	}
+	missPings(m, clock, conn, m.StateThresholds.DownAfter)
+	if state() != StateDown {
+		t.Errorf("expected down, got %v", state())
+	}
+	if counts := m.StateCounts(); counts[StateDown] != 1 || len(counts) != 1 {
+		t.Errorf("expected 1 down server, got %v", counts)
+	}
+	m.RemoveServer(testServerAddr)
+
+	m.notifyStateChanges()
+	expected := []ServerState{StateUp, StateDegraded, StateUp, StateDegraded, StateDown, StateDelisted}
+	if got := recorder.states(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected changes to %v, got %v", expected, got)
+	}
+	if len(m.stateChanges) != 0 {
+		t.Error("expected notified changes to be cleared")
+	}
+}
+
+func TestJunkPacketDoesNotBringServerUp(t *testing.T) {
+	m, _, conn := newTestMonitor(t)
+	m.sendPings(zap.NewNop(), conn)
+	processPacket(context.Background(), zap.NewNop(), m, testServerUDPAddr, []byte{0xde, 0xad})
+	if state := m.statuses[testServerAddr].State; state != StatePending {
+		t.Errorf("expected server to still be pending, got %v", state)
+	}
+}
+
+func TestServerStateJSON(t *testing.T) {
+	b, err := json.Marshal(StateDegraded)
+	if err != nil || string(b) != `"degraded"` {
+		t.Fatalf("expected \"degraded\", got %s %v", b, err)
+	}
+	var s ServerState
+	if err := json.Unmarshal(b, &s); err != nil || s != StateDegraded {
+		t.Errorf("expected StateDegraded, got %v %v", s, err)
+	}
+	if err := json.Unmarshal([]byte(`"sideways"`), &s); err == nil {
+		t.Error("expected unknown state to fail")
+	}
+}
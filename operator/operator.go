@@ -0,0 +1,188 @@
+// Package operator manages the accounts of server operators. Each operator has an API key, which they can
+// send with registrations to have their servers listed as verified, and to list and remove their servers.
+//
+// Only SHA-256 hashes of the keys are stored. Keys are random, so a plain hash is enough to keep a leaked
+// operators file from revealing them.
+package operator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/conwayste/registrar/monitor"
+)
+
+var (
+	ErrExists      = errors.New("operator already exists")
+	ErrNotFound    = errors.New("operator not found")
+	ErrInvalidName = errors.New("operator names are 1 to 64 letters, digits, dots, underscores, and hyphens")
+)
+
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Account is an operator as stored in the operators file.
+type Account struct {
+	Name       string `json:"name"`
+	KeyHash    string `json:"key_hash"`              // hex SHA-256 of the API key
+	MaxServers int    `json:"max_servers,omitempty"` // 0 means no limit
+}
+
+// Store holds the operator accounts. It satisfies monitor.OperatorAuthenticator.
+type Store struct {
+	mu       sync.RWMutex
+	path     string              // empty if not saved
+	accounts map[string]*Account // keyed by name
+	byHash   map[string]*Account // keyed by KeyHash
+}
+
+// NewStore returns an empty Store that is not saved.
+func NewStore() *Store {
+	return &Store{
+		accounts: make(map[string]*Account),
+		byHash:   make(map[string]*Account),
+	}
+}
+
+// LoadStore loads the operators file at path, which is saved whenever operators are created or deleted. A
+// missing file means there are no operators yet.
+func LoadStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*Account
+	if err := json.Unmarshal(b, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to parse operators file: %w", err)
+	}
+	for _, a := range accounts {
+		s.accounts[a.Name] = a
+		s.byHash[a.KeyHash] = a
+	}
+	return s, nil
+}
+
+func hashKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the operator that the API key belongs to.
+func (s *Store) Authenticate(apiKey string) (*monitor.Operator, bool) {
+	if apiKey == "" {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a := s.byHash[hashKey(apiKey)]
+	if a == nil {
+		return nil, false
+	}
+	return &monitor.Operator{Name: a.Name, MaxServers: a.MaxServers}, true
+}
+
+// Create creates an operator and returns its API key, which can't be retrieved later.
+func (s *Store) Create(name string, maxServers int) (apiKey string, err error) {
+	if !nameRE.MatchString(name) {
+		return "", ErrInvalidName
+	}
+	if maxServers < 0 {
+		return "", errors.New("max_servers must not be negative")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	apiKey = hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accounts[name] != nil {
+		return "", ErrExists
+	}
+	a := &Account{Name: name, KeyHash: hashKey(apiKey), MaxServers: maxServers}
+	s.accounts[name] = a
+	s.byHash[a.KeyHash] = a
+	if err := s.saveLocked(); err != nil {
+		delete(s.accounts, name)
+		delete(s.byHash, a.KeyHash)
+		return "", err
+	}
+	return apiKey, nil
+}
+
+// Delete deletes an operator, invalidating its API key.
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[name]
+	if a == nil {
+		return ErrNotFound
+	}
+	delete(s.accounts, name)
+	delete(s.byHash, a.KeyHash)
+	if err := s.saveLocked(); err != nil {
+		s.accounts[name] = a
+		s.byHash[a.KeyHash] = a
+		return err
+	}
+	return nil
+}
+
+// List returns the operators sorted by name, without their key hashes.
+func (s *Store) List() []Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	accounts := make([]Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, Account{Name: a.Name, MaxServers: a.MaxServers})
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts
+}
+
+// saveLocked writes the operators file (safely), if there is one.
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	b, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".new")
+	if err != nil {
+		return fmt.Errorf("failed to save operators: %w", err)
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save operators: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package operator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func TestStorePersistsHashedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "operators.json")
+	s, err := LoadStore(path)
+	if err != nil {
+		t.Fatalf("failed to load missing file: %v", err)
+	}
+	key, err := s.Create("alice", 3)
+	if err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if _, err := s.Create("alice", 0); err != ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	if _, err := s.Create("no spaces", 0); err != ErrInvalidName {
+		t.Errorf("expected ErrInvalidName, got %v", err)
+	}
+
+	reloaded, err := LoadStore(path)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if reloaded.accounts["alice"].KeyHash == key {
+		t.Error("expected the key to be stored hashed")
+	}
+	op, ok := reloaded.Authenticate(key)
+	if !ok || op.Name != "alice" || op.MaxServers != 3 {
+		t.Errorf("expected key to authenticate alice, got %+v %v", op, ok)
+	}
+	if _, ok := reloaded.Authenticate("wrong"); ok {
+		t.Error("expected wrong key not to authenticate")
+	}
+
+	if err := reloaded.Delete("alice"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, ok := reloaded.Authenticate(key); ok {
+		t.Error("expected deleted operator's key not to authenticate")
+	}
+}
+
+func TestOperatorEndpoints(t *testing.T) {
+	m := monitor.NewMonitor()
+	m.AllowSpecialIPs = true
+	s := NewStore()
+	m.Operators = s
+	router := mux.NewRouter()
+	api.AddRoutes(router, m, zap.NewNop(), false)
+	s.AddRoutes(router, m, zap.NewNop(), "admin-key")
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	// Avoid an import cycle with the client package by making requests directly
+	do := func(method, path, key, body string) int {
+		req, err := http.NewRequestWithContext(context.Background(), method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do(http.MethodPost, "/admin/operators", "not-admin", `{"name":"alice"}`); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin key, got %d", code)
+	}
+	key, err := s.Create("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := do(http.MethodPost, "/addServer", "wrong", `{"host_and_port":"127.0.0.1:1"}`); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unknown API key, got %d", code)
+	}
+	if code := do(http.MethodPost, "/addServer", key, `{"host_and_port":"127.0.0.1:1"}`); code != http.StatusOK {
+		t.Fatalf("failed to register: %d", code)
+	}
+	if code := do(http.MethodPost, "/addServer", key, `{"host_and_port":"127.0.0.1:2"}`); code != http.StatusForbidden {
+		t.Errorf("expected 403 over quota, got %d", code)
+	}
+	if servers := m.ListOperatorServers("alice"); len(servers) != 1 || !servers[0].Verified {
+		t.Errorf("expected one verified server, got %+v", servers)
+	}
+	if code := do(http.MethodPost, "/operator/removeServer", key, `{"host_and_port":"127.0.0.1:1"}`); code != http.StatusOK {
+		t.Errorf("failed to remove: %d", code)
+	}
+	if code := do(http.MethodDelete, "/admin/operators/alice", "admin-key", ""); code != http.StatusOK {
+		t.Errorf("failed to delete operator: %d", code)
+	}
+	if code := do(http.MethodGet, "/operator/servers", key, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after deletion, got %d", code)
+	}
+}
@@ -0,0 +1,167 @@
+package operator
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/conwayste/registrar/api"
+	"github.com/conwayste/registrar/monitor"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const maxRequestBodySize = 1000
+
+// AddRoutes adds the admin endpoints for managing operators, which require the admin key, and the endpoints
+// operators call with their API keys.
+func (s *Store) AddRoutes(router *mux.Router, m *monitor.Monitor, log *zap.Logger, adminKey string) {
+	router.HandleFunc("/admin/operators", api.RequireBearerToken(adminKey, log,
+		api.WithMonitorAndLog(m, log, s.operators)))
+	router.HandleFunc("/admin/operators/{name}", api.RequireBearerToken(adminKey, log,
+		api.WithMonitorAndLog(m, log, s.deleteOperator)))
+	router.HandleFunc("/operator/servers", api.WithMonitorAndLog(m, log, listOwnServers))
+	router.HandleFunc("/operator/removeServer", api.WithMonitorAndLog(m, log, removeOwnServer))
+}
+
+type CreateRequestBody struct {
+	Name       string `json:"name"`
+	MaxServers int    `json:"max_servers"`
+}
+
+type CreateResponseBody struct {
+	Name       string `json:"name"`
+	APIKey     string `json:"api_key"`
+	MaxServers int    `json:"max_servers"`
+}
+
+// operators lists the operators (GET) or creates one (POST).
+func (s *Store) operators(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, struct {
+			Operators []Account `json:"operators"`
+		}{s.List()})
+	case http.MethodPost:
+		var reqBody CreateRequestBody
+		if err := readJSON(r, &reqBody); err != nil {
+			return err
+		}
+		apiKey, err := s.Create(reqBody.Name, reqBody.MaxServers)
+		switch {
+		case errors.Is(err, ErrExists):
+			return api.NewApiError(http.StatusConflict, err.Error(), err)
+		case errors.Is(err, ErrInvalidName):
+			return api.NewApiError(http.StatusBadRequest, err.Error(), err)
+		case err != nil:
+			return err
+		}
+		log.Info("created operator", zap.String("operator", reqBody.Name))
+		return writeJSON(w, CreateResponseBody{reqBody.Name, apiKey, reqBody.MaxServers})
+	}
+	return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+}
+
+// deleteOperator deletes an operator. Its servers stay registered, but are no longer verified.
+func (s *Store) deleteOperator(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodDelete {
+		return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	name := mux.Vars(r)["name"]
+	if err := s.Delete(name); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return api.NewApiError(http.StatusNotFound, err.Error(), err)
+		}
+		return err
+	}
+	disowned := m.DisownServers(name)
+	log.Info("deleted operator", zap.String("operator", name), zap.Int("disowned", disowned))
+	return writeJSON(w, struct {
+		Deleted  bool `json:"deleted"`
+		Disowned int  `json:"disowned"`
+	}{true, disowned})
+}
+
+// requireOperator returns the operator whose API key was sent, or an error if there was none.
+func requireOperator(r *http.Request, m *monitor.Monitor) (*monitor.Operator, error) {
+	operator, err := api.AuthenticateOperator(r, m)
+	if err != nil {
+		return nil, err
+	}
+	if operator == nil {
+		return nil, api.NewApiError(http.StatusUnauthorized, "an API key is required", nil)
+	}
+	return operator, nil
+}
+
+func listOwnServers(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodGet {
+		return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	operator, err := requireOperator(r, m)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, struct {
+		Servers []*monitor.PublicServerInfo `json:"servers"`
+	}{m.ListOperatorServers(operator.Name)})
+}
+
+type RemoveServerRequestBody struct {
+	HostAndPort string `json:"host_and_port"`
+}
+
+func removeOwnServer(w http.ResponseWriter, r *http.Request, m *monitor.Monitor, log *zap.Logger) error {
+	if r.Method != http.MethodPost {
+		return api.NewApiError(http.StatusMethodNotAllowed, "unsupported method", nil)
+	}
+	operator, err := requireOperator(r, m)
+	if err != nil {
+		return err
+	}
+	var reqBody RemoveServerRequestBody
+	if err := readJSON(r, &reqBody); err != nil {
+		return err
+	}
+	switch err := m.RemoveOperatorServer(operator.Name, reqBody.HostAndPort); {
+	case errors.Is(err, monitor.ErrNotRegistered):
+		return api.NewApiError(http.StatusNotFound, err.Error(), err)
+	case errors.Is(err, monitor.ErrNotOwner):
+		return api.NewApiError(http.StatusForbidden, err.Error(), err)
+	case err != nil:
+		return err
+	}
+	log.Info("operator removed server", zap.String("operator", operator.Name),
+		zap.String("serverAddr", reqBody.HostAndPort))
+	return writeJSON(w, struct {
+		Removed bool `json:"removed"`
+	}{true})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return errors.New("request body is nil")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return api.NewApiError(http.StatusBadRequest, "invalid JSON", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return nil
+}
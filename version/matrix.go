@@ -0,0 +1,79 @@
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Matrix decides which server versions are compatible with which client versions, and which server
+// versions are deprecated. The zero value (or nil) uses only the default rule.
+//
+// A client is compatible with the servers matched by the Servers constraint of the first rule whose
+// Client constraint matches the client's version. If no rule matches, the default rule applies: the
+// versions must have the same major version, and if that is 0, the same minor version too.
+type Matrix struct {
+	Rules []Rule `json:"rules"`
+	// Deprecated server versions are still listed, but flagged
+	Deprecated []Constraint `json:"deprecated"`
+}
+
+type Rule struct {
+	Client  Constraint `json:"client"`
+	Servers Constraint `json:"servers"`
+}
+
+// LoadMatrix reads a Matrix from a JSON file such as:
+//
+//	{
+//	  "rules": [{"client": ">=0.4.0 <0.5.0", "servers": ">=0.3.5 <0.5.0"}],
+//	  "deprecated": ["<0.3.5"]
+//	}
+func LoadMatrix(path string) (*Matrix, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mx Matrix
+	if err := json.Unmarshal(b, &mx); err != nil {
+		return nil, fmt.Errorf("failed to parse compatibility matrix: %w", err)
+	}
+	return &mx, nil
+}
+
+// Compatible returns whether a client can connect to a server. Servers whose versions can't be parsed are
+// never compatible.
+func (mx *Matrix) Compatible(client Version, serverVersion string) bool {
+	server, err := Parse(serverVersion)
+	if err != nil {
+		return false
+	}
+	if mx != nil {
+		for _, rule := range mx.Rules {
+			if rule.Client.Matches(client) {
+				return rule.Servers.Matches(server)
+			}
+		}
+	}
+	if client.Major != server.Major {
+		return false
+	}
+	return client.Major != 0 || client.Minor == server.Minor
+}
+
+// IsDeprecated returns whether a server version is deprecated. Unparseable versions are not.
+func (mx *Matrix) IsDeprecated(serverVersion string) bool {
+	if mx == nil {
+		return false
+	}
+	server, err := Parse(serverVersion)
+	if err != nil {
+		return false
+	}
+	for _, c := range mx.Deprecated {
+		if c.Matches(server) {
+			return true
+		}
+	}
+	return false
+}
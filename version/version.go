@@ -0,0 +1,189 @@
+// Package version parses semantic versions of Conwayste clients and servers, and decides which servers a
+// client can connect to.
+package version
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalid = errors.New("invalid version")
+
+// Version is a semantic version. Build metadata ("+...") is discarded when parsing.
+type Version struct {
+	Major, Minor, Patch uint64
+	Pre                 string // pre-release, e.g. "beta.1"; empty for releases
+}
+
+// Parse parses versions such as "0.3.2", "v1.0.0-beta.1" and "1.2" (which means "1.2.0").
+func Parse(s string) (Version, error) {
+	orig := s
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var v Version
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.Pre = s[i+1:]
+		s = s[:i]
+		if v.Pre == "" {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalid, orig)
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("%w: %q", ErrInvalid, orig)
+	}
+	nums := [3]uint64{}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil || (len(p) > 1 && p[0] == '0') {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalid, orig)
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0, or 1 if v is less than, equal to, or greater than w. Pre-releases sort before
+// the release, and are compared as in the semver specification.
+func (v Version) Compare(w Version) int {
+	for _, pair := range [][2]uint64{{v.Major, w.Major}, {v.Minor, w.Minor}, {v.Patch, w.Patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return comparePre(v.Pre, w.Pre)
+}
+
+func comparePre(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+	aIDs, bIDs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		if c := compareIdentifier(aIDs[i], bIDs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aIDs) < len(bIDs):
+		return -1
+	case len(aIDs) > len(bIDs):
+		return 1
+	}
+	return 0
+}
+
+func compareIdentifier(a, b string) int {
+	aNum, aErr := strconv.ParseUint(a, 10, 64)
+	bNum, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1 // numeric identifiers sort before alphanumeric ones
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Constraint is a set of comparisons that a version must all satisfy, e.g. ">=0.3.0 <0.4.0".
+type Constraint struct {
+	comparisons []comparison
+	str         string
+}
+
+type comparison struct {
+	op string
+	v  Version
+}
+
+// ParseConstraint parses space-separated comparisons using the operators =, >, >=, <, and <=. A version
+// without an operator means =. "*" matches everything.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{str: s}
+	for _, field := range strings.Fields(s) {
+		if field == "*" {
+			continue
+		}
+		op := "="
+		for _, candidate := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(field, candidate) {
+				op = candidate
+				field = field[len(candidate):]
+				break
+			}
+		}
+		v, err := Parse(field)
+		if err != nil {
+			return Constraint{}, fmt.Errorf("bad constraint %q: %w", s, err)
+		}
+		c.comparisons = append(c.comparisons, comparison{op, v})
+	}
+	return c, nil
+}
+
+func (c Constraint) Matches(v Version) bool {
+	for _, cmp := range c.comparisons {
+		r := v.Compare(cmp.v)
+		var ok bool
+		switch cmp.op {
+		case "=":
+			ok = r == 0
+		case ">":
+			ok = r > 0
+		case ">=":
+			ok = r >= 0
+		case "<":
+			ok = r < 0
+		case "<=":
+			ok = r <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Constraint) String() string {
+	return c.str
+}
+
+// UnmarshalText lets constraints be read directly from JSON strings.
+func (c *Constraint) UnmarshalText(text []byte) error {
+	parsed, err := ParseConstraint(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
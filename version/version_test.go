@@ -0,0 +1,72 @@
+package version
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAndCompare(t *testing.T) {
+	ordered := []string{"0.1.0", "0.3.0-alpha", "0.3.0-alpha.1", "0.3.0-alpha.beta", "0.3.0-beta.2", "0.3.0-beta.11", "v0.3.0", "0.3.1", "1.0", "1.0.1+build.5", "10.0.0"}
+	for i := 0; i < len(ordered)-1; i++ {
+		a, err := Parse(ordered[i])
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", ordered[i], err)
+		}
+		b, err := Parse(ordered[i+1])
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", ordered[i+1], err)
+		}
+		if a.Compare(b) != -1 || b.Compare(a) != 1 || a.Compare(a) != 0 {
+			t.Errorf("expected %s < %s", a, b)
+		}
+	}
+
+	for _, bad := range []string{"", "1", "1.2.3.4", "a.b.c", "01.2.3", "1.2.3-", "-1.2.3"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	var mx Matrix
+	err := json.Unmarshal([]byte(`{
+		"rules": [{"client": ">=0.4.0 <0.5.0", "servers": ">=0.3.5 <0.5.0"}],
+		"deprecated": ["<0.3.5", "=0.4.1"]
+	}`), &mx)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	tests := []struct {
+		client, server string
+		compatible     bool
+	}{
+		{"0.4.2", "0.3.5", true},  // rule
+		{"0.4.2", "0.3.4", false}, // rule
+		{"0.3.1", "0.3.9", true},  // default: same 0.x minor
+		{"0.3.1", "0.4.0", false}, // default
+		{"1.2.0", "1.9.9", true},  // default: same major
+		{"1.2.0", "2.0.0", false}, // default
+		{"1.2.0", "junk", false},
+	}
+	for _, test := range tests {
+		client, err := Parse(test.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mx.Compatible(client, test.server); got != test.compatible {
+			t.Errorf("client %s, server %s: expected %v", test.client, test.server, test.compatible)
+		}
+	}
+
+	for server, deprecated := range map[string]bool{"0.3.4": true, "0.4.1": true, "0.4.2": false, "junk": false} {
+		if mx.IsDeprecated(server) != deprecated {
+			t.Errorf("server %s: expected deprecated=%v", server, deprecated)
+		}
+	}
+	var nilMatrix *Matrix
+	if nilMatrix.IsDeprecated("0.0.1") {
+		t.Error("expected nil matrix to deprecate nothing")
+	}
+}